@@ -3,24 +3,34 @@ package client
 import (
 	"context"
 	"encoding/binary"
-	"fmt"
 	"net"
+	"net/netip"
 	"sync"
 	"time"
 
+	"github.com/JoelVCrasta/clover/config"
 	"github.com/JoelVCrasta/clover/handshake"
+	"github.com/JoelVCrasta/clover/ipfilter"
 	"github.com/JoelVCrasta/clover/message"
+	"github.com/JoelVCrasta/clover/mse"
 	"github.com/JoelVCrasta/clover/peer"
 )
 
 type Client struct {
-	peerChan   <-chan peer.Peer
-	dedupePeer map[string]time.Time
-	infoHash   [20]byte
-	peerId     [20]byte
-	mu         sync.Mutex
-	ctx        context.Context
-	cancel     context.CancelFunc
+	peerChan     <-chan peer.Peer
+	pool         *Pool
+	infoHash     [20]byte
+	peerId       [20]byte
+	dhtPort      uint16
+	listenPort   uint16
+	metadataSize int
+	extensions   *ExtensionRegistry
+	ipFilter     *ipfilter.Filter
+	policy       ClientPolicy
+	activePeers  chan<- *ActivePeer // set once the client is started
+	mu           sync.Mutex
+	ctx          context.Context
+	cancel       context.CancelFunc
 }
 
 // PeerInfo represents information about a peer connected to clover.
@@ -32,6 +42,18 @@ type ActivePeer struct {
 	mu          sync.Mutex
 	Bitfield    Bitfield
 	FailedCount int
+	SupportsDHT bool
+	Client      peer.ClientInfo // the client of the peer, from its peer ID or extended handshake
+	Inbound     bool            // the peer connected to us
+	Encrypted   bool            // the connection is encrypted with MSE
+
+	SupportsExtensions bool
+	ExtendedHandshake  *message.ExtendedHandshake // the extended handshake of the peer, once it arrived
+
+	portReceived   bool // the peer sent its DHT port, later PORT messages are ignored
+	done           chan struct{}
+	disconnectOnce sync.Once
+	onDisconnect   func()
 }
 
 func (ap *ActivePeer) SetChoked(choked bool) {
@@ -46,12 +68,36 @@ func (ap *ActivePeer) IsChoked() bool {
 	return ap.Choked
 }
 
+// SetClient sets the client of the peer, once its extended handshake named it.
+func (ap *ActivePeer) SetClient(info peer.ClientInfo) {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+	ap.Client = info
+}
+
+// ReceivedPort records a PORT message of the peer, and reports whether it is the first one of the connection.
+func (ap *ActivePeer) ReceivedPort() bool {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+
+	first := !ap.portReceived
+	ap.portReceived = true
+	return first
+}
+
+func (ap *ActivePeer) GetClient() peer.ClientInfo {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+	return ap.Client
+}
+
 func NewClient(ctx context.Context, peerChan <-chan peer.Peer, infoHash [20]byte, peerId [20]byte) *Client {
 	ctx, cancel := context.WithCancel(ctx)
 
 	return &Client{
 		peerChan:   peerChan,
-		dedupePeer: make(map[string]time.Time),
+		pool:       NewPool(config.Config.MaxHalfOpenConnections, config.Config.MaxPeerConnections),
+		extensions: NewExtensionRegistry(),
 		infoHash:   infoHash,
 		peerId:     peerId,
 		mu:         sync.Mutex{},
@@ -60,13 +106,92 @@ func NewClient(ctx context.Context, peerChan <-chan peer.Peer, infoHash [20]byte
 	}
 }
 
+// SetDHTPort sets the UDP port of our DHT node, which is sent to the peers that support the DHT.
+func (c *Client) SetDHTPort(port uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dhtPort = port
+}
+
+// SetListenPort sets the TCP port we accept connections on, which is sent in the extended handshake.
+func (c *Client) SetListenPort(port uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.listenPort = port
+}
+
+// SetMetadataSize sets the size of the info dictionary, which is sent in the extended handshake for ut_metadata.
+func (c *Client) SetMetadataSize(size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.metadataSize = size
+}
+
+// SetIPFilter sets the filter of the addresses the client never connects to or accepts connections from.
+func (c *Client) SetIPFilter(f *ipfilter.Filter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ipFilter = f
+}
+
+// BlockedPeers returns the number of peers the IP filter blocked.
+func (c *Client) BlockedPeers() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ipFilter == nil {
+		return 0
+	}
+	return c.ipFilter.Blocked()
+}
+
+// allowAddr reports whether the IP filter allows connections to or from the address.
+func (c *Client) allowAddr(addr netip.Addr) bool {
+	c.mu.Lock()
+	f := c.ipFilter
+	c.mu.Unlock()
+
+	return f == nil || f.Allow(addr)
+}
+
+// Pool returns the pool of the peers the client knows of.
+func (c *Client) Pool() *Pool {
+	return c.pool
+}
+
+// SetClientPolicy sets the policy that decides which clients the client keeps connections to.
+func (c *Client) SetClientPolicy(policy ClientPolicy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.policy = policy
+}
+
+// AllowClient reports whether the client policy allows connections to peers running the client.
+func (c *Client) AllowClient(info peer.ClientInfo) bool {
+	c.mu.Lock()
+	policy := c.policy
+	c.mu.Unlock()
+
+	return policy == nil || policy(info)
+}
+
+// BanPeer bans the peer, so the client never connects to it again.
+func (c *Client) BanPeer(p peer.Peer) {
+	c.pool.Ban(p)
+}
+
 /*
-StartClient starts the client and listens for incoming peers.
-It returns a channel of active peers that can be used to interact with the connected peers.
+StartClient starts the client and listens for incoming peers, which are added to the pool.
+The peers of the pool are connected to within the connection limits, and the connected peers
+are sent on the returned channel, which can be used to interact with them.
 */
 func (c *Client) StartClient() <-chan *ActivePeer {
 	activePeerChan := make(chan *ActivePeer, 500)
 
+	c.mu.Lock()
+	c.activePeers = activePeerChan
+	c.mu.Unlock()
+
 	go func() {
 		for {
 			select {
@@ -76,36 +201,141 @@ func (c *Client) StartClient() <-chan *ActivePeer {
 				if !ok {
 					return
 				}
-				// time.Sleep(100 * time.Millisecond)
-				go c.AddPeer(p, activePeerChan)
+				c.AddPeer(p)
 			}
 		}
 	}()
 
+	go c.dial(activePeerChan)
+
 	return activePeerChan
 }
 
-// AddPeer connects to a peer and adds it to the active peers list.
-func (c *Client) AddPeer(p peer.Peer, apC chan<- *ActivePeer) {
+// AddPeer adds a peer to the pool to be connected to, unless it is invalid, blocked or already known.
+func (c *Client) AddPeer(p peer.Peer) bool {
+	if !c.validatePeer(p) {
+		// log.Printf("[client] invalid peer: %s:%d", p.IpAddr, p.Port)
+		return false
+	}
+
+	return c.pool.Add(p)
+}
+
+// dial connects to the peers the pool hands out until the client is stopped.
+func (c *Client) dial(apC chan<- *ActivePeer) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		peers, wakeAt := c.pool.next(time.Now())
+		for _, p := range peers {
+			go c.connect(p, apC)
+		}
+
+		// Wait for a peer to get ready, or for a change in the pool
+		wait := time.Minute
+		if !wakeAt.IsZero() {
+			wait = max(time.Until(wakeAt), 0)
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-c.pool.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// connect connects to a peer of the pool and sends it on the channel of active peers.
+func (c *Client) connect(p peer.Peer, apC chan<- *ActivePeer) {
 	if c.ctx.Err() != nil {
+		c.pool.failed(p)
 		return // Client is stopped
 	}
 
-	if !c.validatePeer(p) {
-		// log.Printf("[client] invalid peer: %s:%d", p.IpAddr, p.Port)
+	conn, res, err := c.handshakePeer(p)
+	if err != nil {
+		// log.Printf("[client] failed to connect to peer %s:%d: %v", p.IpAddr, p.Port, err)
+		c.pool.failed(p)
 		return
 	}
 
-	conn, res, err := handshake.SendHandshake(c.infoHash, c.peerId, p.IpAddr, p.Port)
-	if err != nil {
-		// log.Printf("[client] failed to connect to peer %s:%d: %v", p.IpAddr, p.Port, err)
+	// One of our own addresses, which a tracker or the DHT handed back to us
+	if res.PeerId == c.peerId {
+		conn.Close()
+		c.pool.Ban(p)
+		c.pool.failed(p) // applies the ban and frees the half-open slot
 		return
 	}
 
-	bitfield, err := GetBitfieldFromPeer(conn)
+	c.startPeer(p, conn, res, false, apC)
+}
+
+/*
+handshakePeer connects to the peer and performs the handshake, encrypted as the policy of the config asks.
+With PolicyPrefer, a peer that answers but fails the encrypted handshake is connected to again in plaintext,
+as it may not support encryption.
+*/
+func (c *Client) handshakePeer(p peer.Peer) (net.Conn, *handshake.Handshake, error) {
+	policy := config.Config.Encryption
+	if policy == mse.PolicyPlaintext {
+		return handshake.SendHandshake(c.infoHash, c.peerId, p.IpAddr, p.Port)
+	}
+
+	conn, err := handshake.Dial(p.IpAddr, p.Port)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	encrypted, res, err := c.encryptedHandshake(conn, policy)
+	if err != nil {
+		conn.Close()
+		if policy == mse.PolicyPrefer && c.ctx.Err() == nil {
+			return handshake.SendHandshake(c.infoHash, c.peerId, p.IpAddr, p.Port)
+		}
+		return nil, nil, err
+	}
+
+	return encrypted, res, nil
+}
+
+// encryptedHandshake sends our handshake as the initial payload of the MSE handshake, and reads the handshake of the peer.
+func (c *Client) encryptedHandshake(conn net.Conn, policy mse.Policy) (net.Conn, *handshake.Handshake, error) {
+	conn.SetDeadline(time.Now().Add(config.Config.PeerHandshakeTimeout))
+
+	encrypted, err := mse.Initiate(conn, c.infoHash, policy, handshake.Payload(c.infoHash, c.peerId))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res, err := handshake.ReadHandshake(encrypted)
 	if err != nil {
+		return nil, nil, err
+	}
+
+	return encrypted, res, nil
+}
+
+/*
+startPeer sends our extended handshake and PORT to a peer we completed the handshake with, in either direction,
+and sends it on the channel of active peers unless the client policy refuses it. Nothing is read from the peer
+here: its bitfield, which a peer without pieces may not send at all, may come after its extended handshake,
+PORT or have messages, so every message after the handshake is left to the reader of the active peer.
+*/
+func (c *Client) startPeer(p peer.Peer, conn net.Conn, res *handshake.Handshake, inbound bool, apC chan<- *ActivePeer) {
+	info := peer.IdentifyClient(res.PeerId)
+	if !c.AllowClient(info) {
+		conn.Close()
+		c.pool.Ban(p)
+		c.pool.failed(p) // applies the ban and frees the half-open slot
+		return
+	}
+
+	// The peer may have been banned during the handshake
+	if !c.pool.connected(p) {
 		conn.Close()
-		// log.Printf("[client] failed to read bitfield from peer %s:%d: %v", p.IpAddr, p.Port, err)
 		return
 	}
 
@@ -116,23 +346,54 @@ func (c *Client) AddPeer(p peer.Peer, apC chan<- *ActivePeer) {
 		Conn:        conn,
 		PeerId:      res.PeerId,
 		Choked:      true,
-		Bitfield:    bitfield,
 		FailedCount: 0,
+		SupportsDHT: res.SupportsDHT(),
+		Client:      info,
+		Inbound:     inbound,
+		Encrypted:   isEncrypted(conn),
+
+		SupportsExtensions: res.SupportsExtensions(),
+
+		done: make(chan struct{}),
+	}
+
+	extensions := c.extensions.all()
+	activePeer.onDisconnect = func() {
+		c.pool.disconnected(p)
+		for _, ext := range extensions {
+			ext.PeerDisconnected(activePeer)
+		}
+	}
+
+	c.mu.Lock()
+	dhtPort := c.dhtPort
+	c.mu.Unlock()
+
+	// The extended handshake goes first, right after the handshake (BEP 10)
+	if activePeer.SupportsExtensions {
+		_ = activePeer.SendExtendedHandshake(c.extendedHandshake(activePeer))
+	}
+	if activePeer.SupportsDHT && dhtPort != 0 {
+		_ = activePeer.SendPort(dhtPort)
+	}
+	for _, ext := range extensions {
+		ext.PeerConnected(activePeer)
 	}
 
+	// The deadline of the handshake would cut the peer off in the middle of the download
+	conn.SetDeadline(time.Time{})
+
 	// Unblock reads on cancellation
 	go func() {
 		<-c.ctx.Done()
 		activePeer.Disconnect()
 	}()
 
+	// The download may be busy, but a connected peer is never dropped
 	select {
 	case apC <- activePeer:
 	case <-c.ctx.Done():
 		activePeer.Disconnect()
-		return
-	default:
-		activePeer.Disconnect()
 	}
 }
 
@@ -150,32 +411,40 @@ func (c *Client) AddPeer(p peer.Peer, apC chan<- *ActivePeer) {
 // 	}
 // }
 
-// validatePeer checks if the peer is valid and not already in the dedupe map.
+// validatePeer checks if the peer has a valid address that the IP filter allows.
 func (c *Client) validatePeer(p peer.Peer) bool {
 	if p.IpAddr == nil || p.IpAddr.IsUnspecified() {
 		return false
 	}
 
-	key := p.String()
-
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	if lastSeen, exists := c.dedupePeer[key]; exists {
-		if time.Since(lastSeen) < 5*time.Minute {
-			return false
-		}
+	// IPv4-mapped IPv6 addresses share the key of their IPv4 address
+	addrPort := p.AddrPort()
+	if !addrPort.IsValid() || addrPort.Port() == 0 {
+		return false
 	}
-	c.dedupePeer[key] = time.Time{}
 
-	return true
+	return c.allowAddr(addrPort.Addr())
 }
 
-// Disconnect closes the connection to the peer.
+// isEncrypted reports whether the connection is encrypted with RC4 after an MSE handshake.
+func isEncrypted(conn net.Conn) bool {
+	encrypted, ok := conn.(*mse.Conn)
+	return ok && encrypted.Encrypted()
+}
+
+// Disconnect closes the connection to the peer and frees its connection slot in the pool.
 func (ap *ActivePeer) Disconnect() {
-	if ap.Conn != nil {
-		_ = ap.Conn.Close()
-	}
+	ap.disconnectOnce.Do(func() {
+		if ap.Conn != nil {
+			_ = ap.Conn.Close()
+		}
+		if ap.done != nil {
+			close(ap.done)
+		}
+		if ap.onDisconnect != nil {
+			ap.onDisconnect()
+		}
+	})
 }
 
 // StopClient stops the client
@@ -183,27 +452,6 @@ func (c *Client) StopClient() {
 	c.cancel()
 }
 
-// GetBitfieldFromPeer reads the bitfield message right after the handshake done with the peer.
-func GetBitfieldFromPeer(conn net.Conn) (Bitfield, error) {
-	msg, err := message.ReadMessage(conn)
-	if err != nil {
-		return nil, err
-	}
-
-	if msg == nil {
-		return nil, fmt.Errorf("expected Bitfield message, got KeepAlive")
-	}
-
-	if msg.MessageId != message.BitfieldId {
-		return nil, fmt.Errorf("expected Bitfield message, got %v", msg.MessageId)
-	}
-
-	bitfield := make(Bitfield, len(msg.Payload))
-	copy(bitfield, msg.Payload)
-
-	return bitfield, nil
-}
-
 // ------------ Messages ------------
 
 func (ap *ActivePeer) SendChoke() error {
@@ -267,3 +515,34 @@ func (ap *ActivePeer) SendCancel(pieceIndex, offset, length int) error {
 
 	return err
 }
+
+func (ap *ActivePeer) SendPort(port uint16) error {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, port)
+
+	msg := message.NewMessage(message.PortId, payload)
+	_, err := ap.Conn.Write(msg.EncodeMessage())
+
+	return err
+}
+
+func (ap *ActivePeer) SendExtended(extendedId byte, payload []byte) error {
+	msg := message.NewExtendedMessage(extendedId, payload)
+	_, err := ap.Conn.Write(msg.EncodeMessage())
+
+	return err
+}
+
+// Done returns a channel that is closed once the peer is disconnected.
+func (ap *ActivePeer) Done() <-chan struct{} {
+	return ap.done
+}
+
+func (ap *ActivePeer) SendExtendedHandshake(eh *message.ExtendedHandshake) error {
+	payload, err := eh.Encode()
+	if err != nil {
+		return err
+	}
+
+	return ap.SendExtended(message.ExtendedHandshakeId, payload)
+}
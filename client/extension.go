@@ -0,0 +1,188 @@
+package client
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/JoelVCrasta/clover/message"
+	"github.com/JoelVCrasta/clover/peer"
+)
+
+// requestQueueSize is the number of outstanding requests we announce in reqq of the extended handshake.
+const requestQueueSize = 250
+
+/*
+Extension is an extension of the extension protocol (BEP 10), such as ut_pex, that handles its own
+extended messages. Its methods are called from the goroutines of the connections, so they must not block.
+*/
+type Extension interface {
+	// Name is the name of the extension in the extended handshakes.
+	Name() string
+
+	// PeerConnected is called for every connected peer, before its extended handshake arrives.
+	PeerConnected(ap *ActivePeer)
+
+	// Handshake is called once the extended handshake of the peer says it supports the extension.
+	Handshake(ap *ActivePeer)
+
+	// Message handles a message of the extension from the peer. An error drops the peer.
+	Message(ap *ActivePeer, payload []byte) error
+
+	// PeerDisconnected is called when a connected peer disconnects.
+	PeerDisconnected(ap *ActivePeer)
+}
+
+/*
+ExtensionRegistry holds the registered extensions and assigns each the extended message ID
+we receive its messages on, which is sent to the peers in the m of our extended handshake.
+*/
+type ExtensionRegistry struct {
+	extensions []Extension // the extension with the message ID i+1 is at index i
+	mu         sync.RWMutex
+}
+
+func NewExtensionRegistry() *ExtensionRegistry {
+	return &ExtensionRegistry{}
+}
+
+// Register registers the extension and returns the extended message ID assigned to it.
+func (r *ExtensionRegistry) Register(ext Extension) (byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, registered := range r.extensions {
+		if registered.Name() == ext.Name() {
+			return 0, fmt.Errorf("extension %q is already registered", ext.Name())
+		}
+	}
+	if len(r.extensions) == 255 {
+		return 0, fmt.Errorf("too many extensions")
+	}
+
+	r.extensions = append(r.extensions, ext)
+	return byte(len(r.extensions)), nil
+}
+
+// IDs returns the names of the registered extensions with their extended message IDs.
+func (r *ExtensionRegistry) IDs() map[string]int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ids := make(map[string]int, len(r.extensions))
+	for i, ext := range r.extensions {
+		ids[ext.Name()] = i + 1
+	}
+	return ids
+}
+
+// Get returns the extension with the extended message ID, or nil.
+func (r *ExtensionRegistry) Get(id byte) Extension {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if id == message.ExtendedHandshakeId || int(id) > len(r.extensions) {
+		return nil
+	}
+	return r.extensions[id-1]
+}
+
+// all returns the registered extensions.
+func (r *ExtensionRegistry) all() []Extension {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]Extension(nil), r.extensions...)
+}
+
+// RegisterExtension registers an extension with the client, before it is started.
+func (c *Client) RegisterExtension(ext Extension) (byte, error) {
+	return c.extensions.Register(ext)
+}
+
+// extendedHandshake returns our extended handshake for the peer.
+func (c *Client) extendedHandshake(ap *ActivePeer) *message.ExtendedHandshake {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	eh := &message.ExtendedHandshake{
+		M:            c.extensions.IDs(),
+		V:            "Clover " + peer.ClientVersion,
+		P:            c.listenPort,
+		Reqq:         requestQueueSize,
+		MetadataSize: c.metadataSize,
+	}
+	if addrPort := ap.Peer.AddrPort(); addrPort.IsValid() {
+		eh.YourIp = addrPort.Addr()
+	}
+
+	return eh
+}
+
+/*
+HandleExtended handles an extended message from the peer. The extended handshake is stored on the peer
+and passed to the extensions it supports, and the other messages go to the extension registered with their ID.
+Messages of unknown extensions are ignored.
+*/
+func (c *Client) HandleExtended(ap *ActivePeer, msg *message.Message) error {
+	extendedId, payload, err := msg.DecodeExtended()
+	if err != nil {
+		return err
+	}
+
+	if extendedId != message.ExtendedHandshakeId {
+		if ext := c.extensions.Get(extendedId); ext != nil {
+			return ext.Message(ap, payload)
+		}
+		return nil
+	}
+
+	eh, err := message.DecodeExtendedHandshake(payload)
+	if err != nil {
+		return err
+	}
+	ap.SetExtendedHandshake(eh)
+
+	// The client name of the handshake is more precise than the one of the peer ID
+	if info := peer.ParseClientVersion(eh.V); info.Known() {
+		ap.SetClient(info)
+		if !c.AllowClient(info) {
+			c.BanPeer(ap.Peer)
+			return fmt.Errorf("refused client %s", info)
+		}
+	}
+
+	for _, ext := range c.extensions.all() {
+		if _, ok := eh.M[ext.Name()]; ok {
+			ext.Handshake(ap)
+		}
+	}
+
+	return nil
+}
+
+// SetExtendedHandshake sets the extended handshake the peer sent.
+func (ap *ActivePeer) SetExtendedHandshake(eh *message.ExtendedHandshake) {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+	ap.ExtendedHandshake = eh
+}
+
+// GetExtendedHandshake returns the extended handshake the peer sent, or nil if it has not sent one yet.
+func (ap *ActivePeer) GetExtendedHandshake() *message.ExtendedHandshake {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+	return ap.ExtendedHandshake
+}
+
+// SendExtension sends a message of the extension with the ID the peer assigned to it in its extended handshake.
+func (ap *ActivePeer) SendExtension(name string, payload []byte) error {
+	eh := ap.GetExtendedHandshake()
+	if eh == nil {
+		return fmt.Errorf("peer %s did not send an extended handshake", ap.Peer)
+	}
+
+	id, ok := eh.M[name]
+	if !ok {
+		return fmt.Errorf("peer %s does not support %s", ap.Peer, name)
+	}
+	return ap.SendExtended(byte(id), payload)
+}
@@ -0,0 +1,103 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/JoelVCrasta/clover/message"
+	"github.com/JoelVCrasta/clover/peer"
+)
+
+type testExtension struct {
+	name       string
+	handshakes int
+	messages   [][]byte
+}
+
+func (e *testExtension) Name() string                    { return e.name }
+func (e *testExtension) PeerConnected(ap *ActivePeer)    {}
+func (e *testExtension) Handshake(ap *ActivePeer)        { e.handshakes++ }
+func (e *testExtension) PeerDisconnected(ap *ActivePeer) {}
+func (e *testExtension) Message(ap *ActivePeer, payload []byte) error {
+	e.messages = append(e.messages, payload)
+	return nil
+}
+
+func TestExtensionRegistry(t *testing.T) {
+	r := NewExtensionRegistry()
+
+	if id, err := r.Register(&testExtension{name: "ut_pex"}); err != nil || id != 1 {
+		t.Fatalf("expected ID 1, got %d (%v)", id, err)
+	}
+	if id, err := r.Register(&testExtension{name: "ut_metadata"}); err != nil || id != 2 {
+		t.Fatalf("expected ID 2, got %d (%v)", id, err)
+	}
+	if _, err := r.Register(&testExtension{name: "ut_pex"}); err == nil {
+		t.Error("duplicate extension was registered")
+	}
+
+	ids := r.IDs()
+	if len(ids) != 2 || ids["ut_pex"] != 1 || ids["ut_metadata"] != 2 {
+		t.Errorf("unexpected IDs %v", ids)
+	}
+	if r.Get(2).Name() != "ut_metadata" || r.Get(3) != nil || r.Get(message.ExtendedHandshakeId) != nil {
+		t.Error("unexpected lookup")
+	}
+}
+
+func TestHandleExtended(t *testing.T) {
+	c := NewClient(context.Background(), nil, [20]byte{}, [20]byte{})
+	ext := &testExtension{name: "x_test"}
+	c.RegisterExtension(ext)
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	ap := &ActivePeer{Peer: peer.NewPeer(net.IPv4(203, 0, 113, 1), 6881), Conn: local}
+
+	eh := &message.ExtendedHandshake{
+		M:      map[string]int{"x_test": 7},
+		V:      "qBittorrent/4.5.2",
+		P:      51413,
+		Reqq:   500,
+		YourIp: netip.MustParseAddr("198.51.100.7"),
+	}
+	payload, err := eh.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.HandleExtended(ap, message.NewExtendedMessage(message.ExtendedHandshakeId, payload)); err != nil {
+		t.Fatal(err)
+	}
+
+	received := ap.GetExtendedHandshake()
+	if received == nil || received.P != 51413 || received.Reqq != 500 || received.YourIp != eh.YourIp {
+		t.Errorf("unexpected extended handshake %+v", received)
+	}
+	if ap.GetClient().Name != "qBittorrent" || ext.handshakes != 1 {
+		t.Errorf("handshake was not handled: client %s, %d handshakes", ap.GetClient(), ext.handshakes)
+	}
+
+	// Messages on our ID go to the extension
+	if err := c.HandleExtended(ap, message.NewExtendedMessage(1, []byte("hello"))); err != nil {
+		t.Fatal(err)
+	}
+	if len(ext.messages) != 1 || string(ext.messages[0]) != "hello" {
+		t.Errorf("unexpected messages %q", ext.messages)
+	}
+
+	// Messages to the peer use its ID
+	go ap.SendExtension("x_test", []byte("hi"))
+
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(remote, buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf[4] != byte(message.ExtendedId) || buf[5] != 7 || string(buf[6:]) != "hi" {
+		t.Errorf("unexpected message %v", buf)
+	}
+}
@@ -0,0 +1,173 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/JoelVCrasta/clover/config"
+	"github.com/JoelVCrasta/clover/handshake"
+	"github.com/JoelVCrasta/clover/mse"
+	"github.com/JoelVCrasta/clover/peer"
+)
+
+// acceptRetryDelay is the wait after a failed accept, such as when we ran out of file descriptors.
+const acceptRetryDelay = time.Second
+
+/*
+Listener accepts the connections of the peers on the TCP port we announce, and hands every connection
+to the client of the torrent its handshake asks for. A single listener serves all the torrents.
+*/
+type Listener struct {
+	ln      net.Listener
+	clients map[[20]byte]*Client
+	mu      sync.Mutex
+}
+
+// Listen listens for peer connections on the TCP port, over IPv4 and IPv6. The port 0 picks a free port.
+func Listen(port uint16) (*Listener, error) {
+	ln, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(int(port))))
+	if err != nil {
+		return nil, fmt.Errorf("[listener] %v", err)
+	}
+
+	l := &Listener{
+		ln:      ln,
+		clients: make(map[[20]byte]*Client),
+	}
+	go l.serve()
+
+	return l, nil
+}
+
+// Port returns the TCP port the listener accepts connections on.
+func (l *Listener) Port() uint16 {
+	return uint16(l.ln.Addr().(*net.TCPAddr).Port)
+}
+
+// Add hands the connections for the torrent of the client to it, and sets its listen port for the extended handshake.
+func (l *Listener) Add(c *Client) {
+	c.SetListenPort(l.Port())
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.clients[c.infoHash] = c
+}
+
+// Remove stops handing connections to the client.
+func (l *Listener) Remove(c *Client) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.clients[c.infoHash] == c {
+		delete(l.clients, c.infoHash)
+	}
+}
+
+// Close stops accepting connections. The connections that were accepted stay open.
+func (l *Listener) Close() error {
+	return l.ln.Close()
+}
+
+// serve accepts connections until the listener is closed.
+func (l *Listener) serve() {
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("[listener] %v", err)
+			time.Sleep(acceptRetryDelay)
+			continue
+		}
+
+		go l.handle(conn)
+	}
+}
+
+/*
+handle reads the handshake of the peer, which comes first, and passes the connection to the client of its torrent.
+The handshake may be plaintext or encrypted (MSE), as the encryption policy of the config allows.
+*/
+func (l *Listener) handle(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(config.Config.PeerHandshakeTimeout))
+
+	encrypted, err := mse.Accept(conn, config.Config.Encryption, l.infoHashes)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	h, err := handshake.ReadHandshake(encrypted)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	l.mu.Lock()
+	c := l.clients[h.InfoHash]
+	l.mu.Unlock()
+
+	if c == nil {
+		// Not a torrent of ours
+		conn.Close()
+		return
+	}
+	c.accept(encrypted, h)
+}
+
+// infoHashes returns the info hashes of the torrents we accept connections for.
+func (l *Listener) infoHashes() [][20]byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	infoHashes := make([][20]byte, 0, len(l.clients))
+	for infoHash := range l.clients {
+		infoHashes = append(infoHashes, infoHash)
+	}
+	return infoHashes
+}
+
+/*
+accept replies to the handshake of a peer that connected to us, and starts it like the peers we connect to.
+The connection is dropped if the IP filter blocks the peer, the connection limit is reached or the client is not started.
+Our own connections are answered before they are dropped, so the dialing side sees our peer ID and bans the address.
+*/
+func (c *Client) accept(conn net.Conn, h *handshake.Handshake) {
+	addrPort, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		conn.Close()
+		return
+	}
+	addr := addrPort.Addr().Unmap()
+	p := peer.NewPeer(net.IP(addr.AsSlice()), addrPort.Port())
+
+	if h.PeerId == c.peerId {
+		_ = handshake.WriteHandshake(conn, c.infoHash, c.peerId)
+		conn.Close()
+		return
+	}
+
+	c.mu.Lock()
+	apC := c.activePeers
+	c.mu.Unlock()
+
+	if apC == nil || c.ctx.Err() != nil || !c.allowAddr(addr) || !c.pool.accept(p) {
+		conn.Close()
+		return
+	}
+
+	if err := handshake.WriteHandshake(conn, c.infoHash, c.peerId); err != nil {
+		conn.Close()
+		c.pool.failed(p)
+		return
+	}
+
+	c.startPeer(p, conn, h, true, apC)
+}
@@ -0,0 +1,213 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/JoelVCrasta/clover/handshake"
+	"github.com/JoelVCrasta/clover/message"
+	"github.com/JoelVCrasta/clover/mse"
+)
+
+// dialListener connects to the listener and sends a handshake for the info hash with the peer ID.
+func dialListener(t *testing.T, l *Listener, infoHash, peerId [20]byte) (net.Conn, *handshake.Handshake) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(l.Port()))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if err := handshake.WriteHandshake(conn, infoHash, peerId); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := handshake.ReadHandshake(conn)
+	if err != nil {
+		return conn, nil
+	}
+	return conn, h
+}
+
+func TestListenerAccept(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	ourId := [20]byte{'-', 'C', 'V'}
+	remoteId := [20]byte{'-', 'q', 'B'}
+
+	c := NewClient(context.Background(), nil, infoHash, ourId)
+	defer c.StopClient()
+	apC := c.StartClient()
+
+	l, err := Listen(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.Add(c)
+
+	_, h := dialListener(t, l, infoHash, remoteId)
+	if h == nil || h.InfoHash != infoHash || h.PeerId != ourId {
+		t.Fatalf("unexpected handshake reply %+v", h)
+	}
+
+	// A peer without pieces may send nothing after its handshake
+	select {
+	case ap := <-apC:
+		if !ap.Inbound || ap.PeerId != remoteId {
+			t.Errorf("unexpected peer %+v", ap)
+		}
+		if state, ok := c.Pool().State(ap.Peer); !ok || state != PeerConnected {
+			t.Errorf("unexpected pool state %v", state)
+		}
+
+		// The port of an incoming connection is not one to connect to, so the peer leaves the pool
+		ap.Disconnect()
+		if _, ok := c.Pool().State(ap.Peer); ok {
+			t.Error("disconnected incoming peer is still in the pool")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("incoming peer was not started")
+	}
+}
+
+func TestListenerRefuse(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	ourId := [20]byte{'-', 'C', 'V'}
+
+	c := NewClient(context.Background(), nil, infoHash, ourId)
+	defer c.StopClient()
+	c.StartClient()
+
+	l, err := Listen(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.Add(c)
+
+	// A torrent we do not have
+	if _, h := dialListener(t, l, [20]byte{9}, [20]byte{'-', 'q', 'B'}); h != nil {
+		t.Error("connection for an unknown torrent was answered")
+	}
+
+	// Our own connection is answered with our peer ID, and then closed
+	conn, h := dialListener(t, l, infoHash, ourId)
+	if h == nil || h.PeerId != ourId {
+		t.Fatalf("self connection was not answered: %+v", h)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("self connection was not closed: %v", err)
+	}
+
+	// No room left in the pool
+	c.pool.mu.Lock()
+	c.pool.maxConnections = 0
+	c.pool.mu.Unlock()
+	if _, h := dialListener(t, l, infoHash, [20]byte{'-', 'q', 'B'}); h != nil {
+		t.Error("connection over the limit was answered")
+	}
+}
+
+func TestListenerEncrypted(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	remoteId := [20]byte{'-', 'q', 'B'}
+
+	c := NewClient(context.Background(), nil, infoHash, [20]byte{'-', 'C', 'V'})
+	defer c.StopClient()
+	apC := c.StartClient()
+
+	l, err := Listen(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.Add(c)
+
+	conn, err := net.Dial("tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(l.Port()))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	encrypted, err := mse.Initiate(conn, infoHash, mse.PolicyRequire, handshake.Payload(infoHash, remoteId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, err := handshake.ReadHandshake(encrypted); err != nil || h.InfoHash != infoHash {
+		t.Fatalf("unexpected handshake reply %+v (%v)", h, err)
+	}
+	if _, err := encrypted.Write(message.NewMessage(message.BitfieldId, []byte{0x80}).EncodeMessage()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case ap := <-apC:
+		if !ap.Inbound || !ap.Encrypted {
+			t.Errorf("unexpected peer %+v", ap)
+		}
+		msg, err := message.ReadMessage(ap.Conn)
+		if err != nil || msg.MessageId != message.BitfieldId || !Bitfield(msg.Payload).Has(0) {
+			t.Errorf("bitfield was not decrypted: %+v (%v)", msg, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("encrypted peer was not started")
+	}
+}
+
+func TestListenerExtendedBeforeBitfield(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+
+	c := NewClient(context.Background(), nil, infoHash, [20]byte{'-', 'C', 'V'})
+	defer c.StopClient()
+	apC := c.StartClient()
+
+	l, err := Listen(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.Add(c)
+
+	conn, h := dialListener(t, l, infoHash, [20]byte{'-', 'T', 'R'})
+	if h == nil || !h.SupportsExtensions() {
+		t.Fatalf("unexpected handshake reply %+v", h)
+	}
+
+	// Our extended handshake follows our handshake, without waiting for the bitfield of the peer
+	msg, err := message.ReadMessage(conn)
+	if err != nil || msg.MessageId != message.ExtendedId || msg.Payload[0] != message.ExtendedHandshakeId {
+		t.Fatalf("expected our extended handshake, got %+v (%v)", msg, err)
+	}
+
+	payload, err := (&message.ExtendedHandshake{M: map[string]int{"ut_metadata": 1}, V: "Transmission 4.0.5"}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(message.NewExtendedMessage(message.ExtendedHandshakeId, payload).EncodeMessage())
+	conn.Write(message.NewMessage(message.BitfieldId, []byte{0x80}).EncodeMessage())
+
+	select {
+	case ap := <-apC:
+		// The messages of the peer are left to the reader of the active peer, in order
+		first, err := message.ReadMessage(ap.Conn)
+		if err != nil || first.MessageId != message.ExtendedId {
+			t.Fatalf("expected the extended handshake, got %+v (%v)", first, err)
+		}
+		if err := c.HandleExtended(ap, first); err != nil || ap.GetExtendedHandshake() == nil {
+			t.Fatalf("extended handshake was not handled: %v", err)
+		}
+		second, err := message.ReadMessage(ap.Conn)
+		if err != nil || second.MessageId != message.BitfieldId || !Bitfield(second.Payload).Has(0) {
+			t.Errorf("expected the bitfield, got %+v (%v)", second, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer that sent its extended handshake first was not started")
+	}
+}
@@ -0,0 +1,29 @@
+package client
+
+import (
+	"strings"
+
+	"github.com/JoelVCrasta/clover/peer"
+)
+
+// ClientPolicy decides whether to keep connections to peers running the client. Refused peers are banned.
+type ClientPolicy func(info peer.ClientInfo) bool
+
+/*
+BanClients returns a policy that refuses the clients given by their peer ID code or name,
+such as "XL" or "Xunlei". Names are matched case-insensitively and also match every version.
+*/
+func BanClients(clients ...string) ClientPolicy {
+	return func(info peer.ClientInfo) bool {
+		for _, banned := range clients {
+			banned = strings.TrimSpace(banned)
+			if banned == "" {
+				continue
+			}
+			if info.Code == banned || strings.EqualFold(info.Name, banned) {
+				return false
+			}
+		}
+		return true
+	}
+}
@@ -0,0 +1,478 @@
+package client
+
+import (
+	"cmp"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/JoelVCrasta/clover/peer"
+)
+
+// PeerState is the state of a peer in the pool.
+type PeerState int
+
+const (
+	PeerCandidate  PeerState = iota // discovered, waiting for a connection attempt
+	PeerConnecting                  // the handshake is in progress
+	PeerConnected                   // handed to the download
+	PeerFailed                      // the last attempt failed, retried after a backoff
+	PeerBanned                      // never connected to again
+)
+
+func (s PeerState) String() string {
+	switch s {
+	case PeerCandidate:
+		return "candidate"
+	case PeerConnecting:
+		return "connecting"
+	case PeerConnected:
+		return "connected"
+	case PeerFailed:
+		return "failed"
+	case PeerBanned:
+		return "banned"
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	// retryMinBackoff is the wait after the first failed attempt, doubled after every further failure up to retryMaxBackoff.
+	retryMinBackoff = 30 * time.Second
+	retryMaxBackoff = 30 * time.Minute
+
+	// maxConnectRetries is the number of failed attempts after which a peer is given up.
+	maxConnectRetries = 5
+
+	// reconnectDelay is the wait before a peer that disconnected is connected to again.
+	reconnectDelay = 5 * time.Minute
+
+	// givenUpTTL is how long a peer that was given up stays in the pool, so that rediscovering it does not retry it.
+	givenUpTTL = time.Hour
+
+	// maxPoolPeers bounds the peers in the pool.
+	maxPoolPeers = 5000
+
+	// maxBannedPeers bounds the banned peers in the pool, the oldest ban is forgotten to make room for a new one.
+	maxBannedPeers = 1000
+)
+
+// PoolStats are the number of peers in the pool in each state.
+type PoolStats struct {
+	Candidates int
+	Connecting int
+	Connected  int
+	Failed     int
+	Banned     int
+}
+
+// poolEntry is a peer of the pool.
+type poolEntry struct {
+	peer        peer.Peer
+	state       PeerState
+	seq         uint64 // the order the peers were discovered in
+	failures    int
+	nextAttempt time.Time
+	updatedAt   time.Time
+	inbound     bool // the peer connected to us, from a port that cannot be connected to
+	banned      bool // banned while connecting or connected, applied once the connection ends
+}
+
+// ready reports whether the peer can be connected to at the time.
+func (e *poolEntry) ready(now time.Time) bool {
+	switch e.state {
+	case PeerCandidate:
+		return !now.Before(e.nextAttempt)
+	case PeerFailed:
+		return e.failures < maxConnectRetries && !now.Before(e.nextAttempt)
+	default:
+		return false
+	}
+}
+
+/*
+Pool keeps every peer the client knows of with its connection state. It hands out the peers
+to connect to in the order they were discovered while capping the half-open and total connections,
+retries failed peers with an exponential backoff, and evicts old peers once it is full.
+*/
+type Pool struct {
+	entries        map[netip.AddrPort]*poolEntry
+	seq            uint64
+	halfOpen       int
+	numConnected   int
+	numBanned      int
+	maxHalfOpen    int
+	maxConnections int
+	maxEntries     int
+	wake           chan struct{}
+	mu             sync.Mutex
+}
+
+func NewPool(maxHalfOpen int, maxConnections int) *Pool {
+	return &Pool{
+		entries:        make(map[netip.AddrPort]*poolEntry),
+		maxHalfOpen:    maxHalfOpen,
+		maxConnections: maxConnections,
+		maxEntries:     maxPoolPeers,
+		wake:           make(chan struct{}, 1),
+	}
+}
+
+// Add adds a discovered peer as a candidate. It returns false if the peer is already known or the pool is full.
+func (p *Pool) Add(pr peer.Peer) bool {
+	addr := pr.AddrPort()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.entries[addr]; ok {
+		return false
+	}
+	if len(p.entries) >= p.maxEntries && !p.evict() {
+		return false
+	}
+
+	p.seq++
+	p.entries[addr] = &poolEntry{peer: pr, state: PeerCandidate, seq: p.seq, updatedAt: time.Now()}
+	p.signal()
+
+	return true
+}
+
+/*
+Ban bans the peer, so it is never connected to again. It does not close an open connection: a connecting
+or connected peer keeps its connection slot until the connection ends, and is banned then.
+*/
+func (p *Pool) Ban(pr peer.Peer) {
+	addr := pr.AddrPort()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e, ok := p.entries[addr]
+	if !ok {
+		if len(p.entries) >= p.maxEntries && !p.evict() {
+			return
+		}
+		p.seq++
+		e = &poolEntry{peer: pr, seq: p.seq, state: PeerCandidate}
+		p.entries[addr] = e
+	}
+
+	switch e.state {
+	case PeerConnecting, PeerConnected:
+		e.banned = true
+	case PeerBanned:
+		// already banned
+	default:
+		p.ban(e)
+	}
+}
+
+// State returns the state of the peer, false if it is not in the pool.
+func (p *Pool) State(pr peer.Peer) (PeerState, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if e, ok := p.entries[pr.AddrPort()]; ok {
+		return e.state, true
+	}
+	return 0, false
+}
+
+// Peers returns the peers of the pool that can be connected to, in the order they were discovered.
+func (p *Pool) Peers() []peer.Peer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entries := make([]*poolEntry, 0, len(p.entries))
+	for _, e := range p.entries {
+		if e.state != PeerBanned && !e.inbound {
+			entries = append(entries, e)
+		}
+	}
+	slices.SortFunc(entries, func(a, b *poolEntry) int {
+		return cmp.Compare(a.seq, b.seq)
+	})
+
+	peers := make([]peer.Peer, len(entries))
+	for i, e := range entries {
+		peers[i] = e.peer
+	}
+	return peers
+}
+
+// Stats returns the number of peers in each state.
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var stats PoolStats
+	for _, e := range p.entries {
+		switch e.state {
+		case PeerCandidate:
+			stats.Candidates++
+		case PeerConnecting:
+			stats.Connecting++
+		case PeerConnected:
+			stats.Connected++
+		case PeerFailed:
+			stats.Failed++
+		case PeerBanned:
+			stats.Banned++
+		}
+	}
+
+	return stats
+}
+
+/*
+next marks the peers that are ready to be connected to as connecting, as many as the connection limits allow,
+and returns them in the order they were discovered. It also returns when the next waiting peer gets ready,
+or the zero time if none is waiting.
+*/
+func (p *Pool) next(now time.Time) ([]peer.Peer, time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.expire(now)
+
+	var ready []*poolEntry
+	var wakeAt time.Time
+	for _, e := range p.entries {
+		if e.ready(now) {
+			ready = append(ready, e)
+		} else if (e.state == PeerCandidate || e.state == PeerFailed) && e.failures < maxConnectRetries {
+			if wakeAt.IsZero() || e.nextAttempt.Before(wakeAt) {
+				wakeAt = e.nextAttempt
+			}
+		}
+	}
+
+	slots := min(p.maxHalfOpen-p.halfOpen, p.maxConnections-p.halfOpen-p.numConnected)
+	if slots <= 0 {
+		return nil, wakeAt
+	}
+
+	slices.SortFunc(ready, func(a, b *poolEntry) int {
+		return cmp.Compare(a.seq, b.seq)
+	})
+
+	var peers []peer.Peer
+	for _, e := range ready[:min(slots, len(ready))] {
+		p.setState(e, PeerConnecting)
+		peers = append(peers, e.peer)
+	}
+
+	return peers, wakeAt
+}
+
+// connected moves a connecting peer to connected. It returns false if the peer was banned in the meantime.
+func (p *Pool) connected(pr peer.Peer) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e, ok := p.entries[pr.AddrPort()]
+	if !ok || e.state != PeerConnecting {
+		return false
+	}
+	if e.banned {
+		p.ban(e)
+		return false
+	}
+
+	e.failures = 0
+	p.setState(e, PeerConnected)
+	p.signal()
+	return true
+}
+
+/*
+accept adds a peer that connected to us as connecting, if the connection limit allows it, the peer
+is not known yet and its address is not banned. The entry is removed once the connection fails or ends,
+as its port is not the one the peer listens on.
+*/
+func (p *Pool) accept(pr peer.Peer) bool {
+	addr := pr.AddrPort()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.entries[addr]; ok {
+		return false
+	}
+	if p.halfOpen+p.numConnected >= p.maxConnections {
+		return false
+	}
+	for other, e := range p.entries {
+		if (e.state == PeerBanned || e.banned) && other.Addr() == addr.Addr() {
+			return false
+		}
+	}
+	if len(p.entries) >= p.maxEntries && !p.evict() {
+		return false
+	}
+
+	p.seq++
+	e := &poolEntry{peer: pr, state: PeerCandidate, seq: p.seq, inbound: true}
+	p.entries[addr] = e
+	p.setState(e, PeerConnecting)
+
+	return true
+}
+
+// failed records a failed connection attempt and schedules the next one after the backoff.
+func (p *Pool) failed(pr peer.Peer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e, ok := p.entries[pr.AddrPort()]
+	if !ok || e.state != PeerConnecting {
+		return
+	}
+	if e.banned {
+		p.ban(e)
+		return
+	}
+	if e.inbound {
+		p.remove(pr.AddrPort(), e)
+		return
+	}
+
+	e.failures++
+	e.nextAttempt = time.Now().Add(retryBackoff(e.failures))
+	p.setState(e, PeerFailed)
+	p.signal()
+}
+
+// disconnected moves a connected peer back to the candidates, to be connected to again after reconnectDelay.
+func (p *Pool) disconnected(pr peer.Peer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e, ok := p.entries[pr.AddrPort()]
+	if !ok || e.state != PeerConnected {
+		return
+	}
+	if e.banned {
+		p.ban(e)
+		return
+	}
+	if e.inbound {
+		p.remove(pr.AddrPort(), e)
+		return
+	}
+
+	e.nextAttempt = time.Now().Add(reconnectDelay)
+	p.setState(e, PeerCandidate)
+	p.signal()
+}
+
+// setState moves the peer to the state, keeping the connection counts in sync. The caller must hold p.mu.
+func (p *Pool) setState(e *poolEntry, state PeerState) {
+	switch e.state {
+	case PeerConnecting:
+		p.halfOpen--
+	case PeerConnected:
+		p.numConnected--
+	case PeerBanned:
+		p.numBanned--
+	}
+	switch state {
+	case PeerConnecting:
+		p.halfOpen++
+	case PeerConnected:
+		p.numConnected++
+	case PeerBanned:
+		p.numBanned++
+	}
+
+	e.state = state
+	e.updatedAt = time.Now()
+}
+
+/*
+ban moves the peer to banned and frees its connection slot, forgetting the oldest ban once there are
+maxBannedPeers of them. The caller must hold p.mu.
+*/
+func (p *Pool) ban(e *poolEntry) {
+	if p.numBanned >= maxBannedPeers {
+		var victim netip.AddrPort
+		var oldest *poolEntry
+		for addr, other := range p.entries {
+			if other.state == PeerBanned && (oldest == nil || other.updatedAt.Before(oldest.updatedAt)) {
+				victim, oldest = addr, other
+			}
+		}
+		if oldest != nil {
+			p.setState(oldest, PeerCandidate)
+			delete(p.entries, victim)
+		}
+	}
+
+	e.banned = false
+	p.setState(e, PeerBanned)
+	p.signal()
+}
+
+// remove removes the peer from the pool and frees its connection slot. The caller must hold p.mu.
+func (p *Pool) remove(addr netip.AddrPort, e *poolEntry) {
+	p.setState(e, PeerCandidate)
+	delete(p.entries, addr)
+	p.signal()
+}
+
+/*
+evict makes room for a new peer by removing a peer that was given up, or else the failed peer
+or candidate that has been waiting the longest. Connecting, connected and banned peers are never evicted,
+the banned peers are bounded by maxBannedPeers instead.
+The caller must hold p.mu.
+*/
+func (p *Pool) evict() bool {
+	var victim netip.AddrPort
+	var oldest *poolEntry
+
+	for addr, e := range p.entries {
+		if e.state != PeerCandidate && e.state != PeerFailed {
+			continue
+		}
+		if oldest == nil || e.failures > oldest.failures ||
+			(e.failures == oldest.failures && e.updatedAt.Before(oldest.updatedAt)) {
+			victim, oldest = addr, e
+		}
+	}
+
+	if oldest == nil {
+		return false
+	}
+	delete(p.entries, victim)
+	return true
+}
+
+// expire removes the peers that were given up more than givenUpTTL ago. The caller must hold p.mu.
+func (p *Pool) expire(now time.Time) {
+	for addr, e := range p.entries {
+		if e.state == PeerFailed && e.failures >= maxConnectRetries && now.Sub(e.updatedAt) > givenUpTTL {
+			delete(p.entries, addr)
+		}
+	}
+}
+
+// signal wakes up the dialer without blocking. The caller must hold p.mu.
+func (p *Pool) signal() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// retryBackoff returns the wait before the next attempt after the given number of failed attempts.
+func retryBackoff(failures int) time.Duration {
+	backoff := retryMinBackoff
+	for i := 1; i < failures && backoff < retryMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, retryMaxBackoff)
+}
@@ -0,0 +1,160 @@
+package client
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/JoelVCrasta/clover/peer"
+)
+
+func testPeer(i int) peer.Peer {
+	return peer.NewPeer(net.IPv4(203, 0, 113, byte(i)), 6881)
+}
+
+func TestPoolLimits(t *testing.T) {
+	pool := NewPool(2, 3)
+	for i := 1; i <= 5; i++ {
+		pool.Add(testPeer(i))
+	}
+	if pool.Add(testPeer(1)) {
+		t.Error("known peer was added again")
+	}
+
+	now := time.Now()
+
+	// The half-open cap allows two, in the order they were added
+	peers, _ := pool.next(now)
+	if len(peers) != 2 || !peers[0].IpAddr.Equal(testPeer(1).IpAddr) || !peers[1].IpAddr.Equal(testPeer(2).IpAddr) {
+		t.Fatalf("unexpected peers %v", peers)
+	}
+
+	pool.connected(peers[0])
+	pool.connected(peers[1])
+
+	// The total cap only leaves room for one more
+	if peers, _ := pool.next(now); len(peers) != 1 {
+		t.Fatalf("expected 1 peer, got %v", peers)
+	}
+
+	stats := pool.Stats()
+	if stats.Connected != 2 || stats.Connecting != 1 || stats.Candidates != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestPoolRetry(t *testing.T) {
+	pool := NewPool(10, 10)
+	p := testPeer(1)
+	pool.Add(p)
+
+	now := time.Now()
+	peers, _ := pool.next(now)
+	if len(peers) != 1 {
+		t.Fatalf("expected 1 peer, got %v", peers)
+	}
+
+	pool.failed(p)
+	if state, _ := pool.State(p); state != PeerFailed {
+		t.Errorf("expected failed, got %s", state)
+	}
+
+	// The peer waits for the backoff before the next attempt
+	peers, wakeAt := pool.next(now)
+	if len(peers) != 0 || wakeAt.Sub(now) < retryMinBackoff {
+		t.Fatalf("peer retried before the backoff, next attempt at %s", wakeAt)
+	}
+	if peers, _ := pool.next(wakeAt); len(peers) != 1 {
+		t.Fatal("peer was not retried after the backoff")
+	}
+
+	// A connected peer that disconnects is connected to again later
+	pool.connected(p)
+	pool.disconnected(p)
+	if state, _ := pool.State(p); state != PeerCandidate {
+		t.Errorf("expected candidate, got %s", state)
+	}
+
+	// A banned peer is never connected to again
+	pool.Ban(p)
+	if peers, _ := pool.next(now.Add(24 * time.Hour)); len(peers) != 0 {
+		t.Error("banned peer was handed out")
+	}
+}
+
+func TestPoolEvict(t *testing.T) {
+	pool := NewPool(10, 10)
+	pool.maxEntries = 2
+
+	pool.Add(testPeer(1))
+	pool.Add(testPeer(2))
+	pool.next(time.Now())
+	pool.connected(testPeer(1))
+	pool.failed(testPeer(2))
+
+	// The failed peer makes room, the connected one stays
+	if !pool.Add(testPeer(3)) {
+		t.Fatal("peer was not added to the full pool")
+	}
+	if _, ok := pool.State(testPeer(2)); ok {
+		t.Error("failed peer was not evicted")
+	}
+	if state, _ := pool.State(testPeer(1)); state != PeerConnected {
+		t.Errorf("connected peer is %s", state)
+	}
+
+	// Only connected and connecting peers are left
+	pool.next(time.Now())
+	if pool.Add(testPeer(4)) {
+		t.Error("peer was added to a pool of connections")
+	}
+}
+
+func TestPoolBanConnected(t *testing.T) {
+	pool := NewPool(10, 1)
+	pool.Add(testPeer(1))
+	pool.Add(testPeer(2))
+	pool.next(time.Now())
+	pool.connected(testPeer(1))
+
+	// The banned peer keeps its slot until its connection ends
+	pool.Ban(testPeer(1))
+	if peers, _ := pool.next(time.Now()); len(peers) != 0 {
+		t.Fatal("slot of the banned peer was handed out while it is connected")
+	}
+
+	pool.disconnected(testPeer(1))
+	if state, _ := pool.State(testPeer(1)); state != PeerBanned {
+		t.Errorf("expected banned, got %s", state)
+	}
+	if peers, _ := pool.next(time.Now()); len(peers) != 1 {
+		t.Error("slot was not freed once the banned peer disconnected")
+	}
+}
+
+func TestPoolBanConnecting(t *testing.T) {
+	pool := NewPool(1, 10)
+	pool.Add(testPeer(1))
+	pool.Add(testPeer(2))
+	pool.next(time.Now())
+
+	// The client bans a peer during the handshake and then ends the attempt
+	pool.Ban(testPeer(1))
+	pool.failed(testPeer(1))
+
+	if state, _ := pool.State(testPeer(1)); state != PeerBanned {
+		t.Errorf("expected banned, got %s", state)
+	}
+	if stats := pool.Stats(); stats.Connecting != 0 {
+		t.Errorf("half-open slot was not freed: %+v", stats)
+	}
+	if peers, _ := pool.next(time.Now()); len(peers) != 1 || !peers[0].IpAddr.Equal(testPeer(2).IpAddr) {
+		t.Errorf("next peer was not handed out, got %v", peers)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	if retryBackoff(1) != retryMinBackoff || retryBackoff(2) != 2*retryMinBackoff || retryBackoff(20) != retryMaxBackoff {
+		t.Errorf("unexpected backoffs %s, %s, %s", retryBackoff(1), retryBackoff(2), retryBackoff(20))
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/JoelVCrasta/clover/config"
+	"github.com/JoelVCrasta/clover/dht"
+	"github.com/JoelVCrasta/clover/metainfo"
+)
+
+// runDHT dispatches the dht subcommands.
+func runDHT(args []string) {
+	if len(args) > 0 {
+		switch args[0] {
+		case "put":
+			runDHTPut(args[1:])
+			return
+		case "get":
+			runDHTGet(args[1:])
+			return
+		case "crawl":
+			runDHTCrawl(args[1:])
+			return
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Usage: clover dht put [options] <value>\n")
+	fmt.Fprintf(os.Stderr, "       clover dht get [options] <target | public key>\n")
+	fmt.Fprintf(os.Stderr, "       clover dht crawl [options]\n")
+	os.Exit(1)
+}
+
+// dhtFlags adds the flags shared by the dht subcommands.
+func dhtFlags(fs *flag.FlagSet) (*uint, *string) {
+	port := fs.Uint("port", 0, "UDP port of the DHT node (Default: the DHT port of the client)")
+	bootstrap := fs.String("bootstrap", "", "Comma separated host:port list of DHT bootstrap nodes (Default: public routers)")
+	return port, bootstrap
+}
+
+// joinDHT applies the flags to the config and joins the DHT. Stop the returned DHT when done.
+func joinDHT(port uint, bootstrap string) (*dht.DHT, error) {
+	if port > 65535 {
+		return nil, fmt.Errorf("invalid DHT port %d", port)
+	}
+	if port != 0 {
+		config.Config.DHTPort = uint16(port)
+	}
+	if bootstrap != "" {
+		config.Config.DHTBootstrapNodes = strings.Split(bootstrap, ",")
+	}
+
+	d, err := dht.NewDHT(context.Background(), [20]byte{}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintln(os.Stderr, "Joining the DHT...")
+	if err := d.Bootstrap(); err != nil {
+		d.StopDHT()
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// runDHTPut stores an immutable item, or a mutable item signed with the key file, in the DHT.
+func runDHTPut(args []string) {
+	fs := flag.NewFlagSet("dht put", flag.ExitOnError)
+	keyFile := fs.String("key", "", "File with the hex ed25519 seed of a mutable item, created if missing (Default: immutable item)")
+	salt := fs.String("salt", "", "Salt of the mutable item")
+	seq := fs.Int64("seq", -1, "Sequence number of the mutable item (Default: one more than the stored item)")
+	cas := fs.Int64("cas", -1, "Only replace the mutable item if it has this sequence number (Default: no check)")
+	port, bootstrap := dhtFlags(fs)
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: clover dht put [options] <value>\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	value := fs.Arg(0)
+
+	var key ed25519.PrivateKey
+	if *keyFile != "" {
+		var err error
+		key, err = loadOrCreateKey(*keyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	d, err := joinDHT(*port, *bootstrap)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(1)
+	}
+	defer d.StopDHT()
+
+	var item *dht.Item
+	var casSeq *int64
+	if key == nil {
+		item, err = dht.NewImmutableItem(value)
+	} else {
+		if *cas >= 0 {
+			casSeq = cas
+		}
+
+		// Without a sequence number, the stored item is replaced if it did not change in the meantime
+		if *seq < 0 {
+			*seq = 0
+			current, err := d.Get(dht.MutableTarget(key.Public().(ed25519.PublicKey), []byte(*salt)), []byte(*salt))
+			if err == nil {
+				*seq = current.Seq + 1
+				casSeq = &current.Seq
+			} else if !errors.Is(err, dht.ErrNotFound) {
+				fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		item, err = dht.NewMutableItem(key, value, []byte(*salt), *seq)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(1)
+	}
+
+	stored, err := d.Put(item, casSeq)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Stored on %d nodes\n", stored)
+	fmt.Printf("Target: %s\n", item.Target())
+	if item.Mutable() {
+		fmt.Printf("Public key: %x\nSeq: %d\n", []byte(item.K), item.Seq)
+	}
+}
+
+// runDHTGet looks up an item by its target, or a mutable item by its public key and salt.
+func runDHTGet(args []string) {
+	fs := flag.NewFlagSet("dht get", flag.ExitOnError)
+	salt := fs.String("salt", "", "Salt of the mutable item")
+	port, bootstrap := dhtFlags(fs)
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: clover dht get [options] <target | public key>\n\n")
+		fmt.Fprintf(os.Stderr, "The 40 character hex target looks up an item, the 64 character hex public key a mutable item.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	decoded, err := hex.DecodeString(fs.Arg(0))
+	var target dht.NodeID
+	switch {
+	case err == nil && len(decoded) == 20:
+		target = dht.NodeID(decoded)
+	case err == nil && len(decoded) == ed25519.PublicKeySize:
+		target = dht.MutableTarget(ed25519.PublicKey(decoded), []byte(*salt))
+	default:
+		fmt.Fprintf(os.Stderr, "ERROR: invalid target or public key %q\n", fs.Arg(0))
+		os.Exit(1)
+	}
+
+	d, err := joinDHT(*port, *bootstrap)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(1)
+	}
+	defer d.StopDHT()
+
+	item, err := d.Get(target, []byte(*salt))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(1)
+	}
+
+	if item.Mutable() {
+		fmt.Fprintf(os.Stderr, "Seq: %d\n", item.Seq)
+	}
+
+	// Strings are printed as they are, other values bencoded
+	if v, ok := item.V.([]byte); ok {
+		fmt.Println(string(v))
+		return
+	}
+	encoded, _ := metainfo.BencodeMarshall(item.V)
+	fmt.Println(string(encoded))
+}
+
+// runDHTCrawl samples the info hashes of the DHT and writes them as JSON lines until interrupted.
+func runDHTCrawl(args []string) {
+	fs := flag.NewFlagSet("dht crawl", flag.ExitOnError)
+	duration := fs.Duration("duration", 0, "Stop crawling after this long (Default: until interrupted)")
+	port, bootstrap := dhtFlags(fs)
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: clover dht crawl [options]\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(args)
+
+	d, err := joinDHT(*port, *bootstrap)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(1)
+	}
+	defer d.StopDHT()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	crawler := dht.NewCrawler(ctx, d.Server())
+	infoHashChan, err := crawler.StartCrawler()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(1)
+	}
+	defer crawler.StopCrawler()
+
+	enc := json.NewEncoder(os.Stdout)
+	for infoHash := range infoHashChan {
+		enc.Encode(struct {
+			InfoHash string `json:"infohash"`
+		}{hex.EncodeToString(infoHash[:])})
+	}
+}
+
+// loadOrCreateKey reads the hex ed25519 seed from the file, or generates one and writes it to the file.
+func loadOrCreateKey(path string) (ed25519.PrivateKey, error) {
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		seed := make([]byte, ed25519.SeedSize)
+		if _, err := rand.Read(seed); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(seed)+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(os.Stderr, "Created a new key in %s\n", path)
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	seed, err := hex.DecodeString(strings.TrimSpace(string(buf)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s: invalid ed25519 seed", path)
+	}
+
+	return ed25519.NewKeyFromSeed(seed), nil
+}
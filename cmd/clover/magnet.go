@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/JoelVCrasta/clover/metainfo"
+)
+
+// runMagnet prints the magnet link of a torrent file.
+func runMagnet(args []string) {
+	fs := flag.NewFlagSet("magnet", flag.ExitOnError)
+	input := fs.String("i", "", "Path to the .torrent file")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: clover magnet -i <torrentfile>\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(args)
+
+	if *input == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	var tr metainfo.Torrent
+	if err := tr.Torrent(*input, ""); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println(tr.Magnet())
+}
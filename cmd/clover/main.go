@@ -4,27 +4,105 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 
 	torrent "github.com/JoelVCrasta/clover"
+	"github.com/JoelVCrasta/clover/config"
+	"github.com/JoelVCrasta/clover/mse"
+	"github.com/JoelVCrasta/clover/peer"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "scrape":
+			runScrape(os.Args[2:])
+			return
+		case "tracker":
+			runTracker(os.Args[2:])
+			return
+		case "dht":
+			runDHT(os.Args[2:])
+			return
+		case "magnet":
+			runMagnet(os.Args[2:])
+			return
+		}
+	}
+
 	input := flag.String("i", "", "Path to the .torrent file")
+	magnet := flag.String("m", "", "Magnet link to download instead of a .torrent file")
 	output := flag.String("o", "", "Path to the download directory (Default: ~/Downloads)")
+	dhtPort := flag.Uint("dht-port", 0, "UDP port of the DHT node (Default: same as the peer port)")
+	dhtBootstrap := flag.String("dht-bootstrap", "", "Comma separated host:port list of DHT bootstrap nodes (Default: public routers)")
+	var peerAddrs peerList
+	flag.Var(&peerAddrs, "peer", "host:port of a peer to connect to, can be repeated")
+	peersFile := flag.String("peers-file", "", "File with the host:port of a peer to connect to per line")
+	noTrackers := flag.Bool("no-trackers", false, "Do not announce to the trackers of the torrent")
+	noDHT := flag.Bool("no-dht", false, "Do not search the DHT for peers")
+	allowLoopbackTrackers := flag.Bool("allow-loopback-trackers", false, "Announce to trackers whose host name resolves to a loopback address")
+	banClients := flag.String("ban-clients", "", "Comma separated peer ID codes or names of clients to refuse, such as XL,SD,QD")
+	encryption := flag.String("encryption", config.Config.Encryption.String(), "Encryption of the peer connections: plaintext, prefer or require")
+	ipFilter := flag.String("ipfilter", "", "Comma separated eMule ipfilter.dat, P2P or CIDR lists of addresses to never connect to (reloaded on SIGHUP)")
 
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: clover -i <torrentfile> -o <outputdir>\n\n")
+		fmt.Fprintf(os.Stderr, "Usage: clover -i <torrentfile> -o <outputdir>\n")
+		fmt.Fprintf(os.Stderr, "       clover -m <magnetlink> -o <outputdir>\n")
+		fmt.Fprintf(os.Stderr, "       clover magnet -i <torrentfile>\n")
+		fmt.Fprintf(os.Stderr, "       clover scrape -i <torrentfile>\n")
+		fmt.Fprintf(os.Stderr, "       clover tracker serve [options]\n")
+		fmt.Fprintf(os.Stderr, "       clover dht put|get|crawl [options]\n\n")
 		fmt.Fprintf(os.Stderr, "Options:\n")
 		flag.PrintDefaults()
 	}
 
 	flag.Parse()
 
-	if *input == "" {
+	if (*input == "") == (*magnet == "") {
 		flag.Usage()
 		os.Exit(1)
 	}
 
+	if *dhtPort > 65535 {
+		fmt.Fprintf(os.Stderr, "ERROR: invalid DHT port %d\n", *dhtPort)
+		os.Exit(1)
+	}
+	config.Config.DHTPort = uint16(*dhtPort)
+
+	if *dhtBootstrap != "" {
+		config.Config.DHTBootstrapNodes = strings.Split(*dhtBootstrap, ",")
+	}
+
+	if *ipFilter != "" {
+		config.Config.IPFilterFiles = strings.Split(*ipFilter, ",")
+	}
+
+	if *banClients != "" {
+		config.Config.BannedClients = strings.Split(*banClients, ",")
+	}
+
+	policy, err := mse.ParsePolicy(*encryption)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(1)
+	}
+	config.Config.Encryption = policy
+
+	config.Config.UseTrackers = !*noTrackers
+	config.Config.UseDHT = !*noDHT
+	config.Config.AllowLoopbackTrackers = *allowLoopbackTrackers
+
+	peers, err := manualPeers(peerAddrs, *peersFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(1)
+	}
+
+	var sources []peer.PeerSource
+	if len(peers) > 0 {
+		sources = append(sources, peer.StaticSource(manualSource, peers))
+	}
+
 	if *output == "." {
 		cwd, err := os.Getwd()
 		if err != nil {
@@ -34,7 +112,11 @@ func main() {
 		*output = cwd
 	}
 
-	err := torrent.StartTorrent(*input, *output)
+	if *magnet != "" {
+		err = torrent.StartMagnet(*magnet, *output, sources...)
+	} else {
+		err = torrent.StartTorrent(*input, *output, sources...)
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
 		os.Exit(1)
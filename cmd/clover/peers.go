@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/JoelVCrasta/clover/peer"
+)
+
+// manualSource is the name of the peer source of the -peer and -peers-file peers.
+const manualSource = "manual"
+
+// peerList collects the addresses of a repeatable flag.
+type peerList []string
+
+func (pl *peerList) String() string {
+	return strings.Join(*pl, ",")
+}
+
+func (pl *peerList) Set(addr string) error {
+	*pl = append(*pl, addr)
+	return nil
+}
+
+// manualPeers resolves the host:port addresses given on the command line and in the peers file.
+func manualPeers(addrs []string, peersFile string) ([]peer.Peer, error) {
+	if peersFile != "" {
+		fileAddrs, err := readPeersFile(peersFile)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, fileAddrs...)
+	}
+
+	var peers []peer.Peer
+	for _, addr := range addrs {
+		p, err := peer.ParsePeer(addr)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, p)
+	}
+
+	return peers, nil
+}
+
+// readPeersFile reads the host:port addresses from the file, ignoring empty lines and # comments.
+func readPeersFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var addrs []string
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		if _, _, err := net.SplitHostPort(text); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid peer address %q", path, line, text)
+		}
+		addrs = append(addrs, text)
+	}
+
+	return addrs, scanner.Err()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"text/tabwriter"
+
+	torrent "github.com/JoelVCrasta/clover"
+)
+
+// runScrape prints the seeders, leechers and completed downloads reported by every tracker of a torrent.
+func runScrape(args []string) {
+	fs := flag.NewFlagSet("scrape", flag.ExitOnError)
+	input := fs.String("i", "", "Path to the .torrent file")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: clover scrape -i <torrentfile>\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(args)
+
+	if *input == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	tr, reports, err := torrent.ScrapeTorrent(ctx, *input)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Name: %s\nInfo hash: %x\n\n", tr.Info.Name, tr.InfoHash)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TRACKER\tSEEDERS\tLEECHERS\tCOMPLETED")
+
+	for _, report := range reports {
+		if report.Err != nil {
+			fmt.Fprintf(w, "%s\terror: %v\t\t\n", report.Url, report.Err)
+			continue
+		}
+		if len(report.Response.Results) == 0 {
+			fmt.Fprintf(w, "%s\tunknown torrent\t\t\n", report.Url)
+			continue
+		}
+
+		result := report.Response.Results[0]
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", report.Url, result.Seeders, result.Leechers, result.Completed)
+	}
+
+	w.Flush()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/JoelVCrasta/clover/tracker"
+)
+
+// runTracker dispatches the tracker subcommands.
+func runTracker(args []string) {
+	if len(args) == 0 || args[0] != "serve" {
+		fmt.Fprintf(os.Stderr, "Usage: clover tracker serve [options]\n")
+		os.Exit(1)
+	}
+
+	runTrackerServe(args[1:])
+}
+
+// runTrackerServe runs the built-in UDP and HTTP tracker until interrupted.
+func runTrackerServe(args []string) {
+	fs := flag.NewFlagSet("tracker serve", flag.ExitOnError)
+	udpAddr := fs.String("udp", ":6969", "Address of the UDP tracker, empty to disable it")
+	httpAddr := fs.String("http", ":6969", "Address of the HTTP tracker, empty to disable it")
+	interval := fs.Duration("interval", 30*time.Minute, "Announce interval sent to the clients")
+	expiry := fs.Duration("expiry", 45*time.Minute, "Drop peers that did not announce for this long")
+	allowFile := fs.String("allow", "", "File with the hex info hashes to track, one per line (Default: all)")
+
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: clover tracker serve [options]\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+
+	fs.Parse(args)
+
+	var allowlist [][20]byte
+	if *allowFile != "" {
+		var err error
+		allowlist, err = readAllowlist(*allowFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	srv := tracker.NewServer(tracker.ServerOptions{
+		UDPAddr:    *udpAddr,
+		HTTPAddr:   *httpAddr,
+		Interval:   *interval,
+		PeerExpiry: *expiry,
+		Allowlist:  allowlist,
+	})
+	if err := srv.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		os.Exit(1)
+	}
+	defer srv.Close()
+
+	if addr := srv.UDPAddr(); addr != nil {
+		fmt.Printf("UDP tracker listening on udp://%s\n", addr)
+	}
+	if addr := srv.HTTPAddr(); addr != nil {
+		fmt.Printf("HTTP tracker listening on http://%s/announce\n", addr)
+	}
+	if len(allowlist) > 0 {
+		fmt.Printf("Tracking %d torrents\n", len(allowlist))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	<-ctx.Done()
+	fmt.Println("Stopping tracker...")
+}
+
+// readAllowlist reads the hex encoded info hashes from the file, ignoring empty lines and # comments.
+func readAllowlist(path string) ([][20]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var allowlist [][20]byte
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		decoded, err := hex.DecodeString(text)
+		if err != nil || len(decoded) != 20 {
+			return nil, fmt.Errorf("%s:%d: invalid info hash %q", path, line, text)
+		}
+		allowlist = append(allowlist, [20]byte(decoded))
+	}
+
+	return allowlist, scanner.Err()
+}
@@ -7,6 +7,7 @@ import (
 	torrent "github.com/JoelVCrasta/clover"
 	"github.com/JoelVCrasta/clover/client"
 	"github.com/JoelVCrasta/clover/download"
+	"github.com/JoelVCrasta/clover/metadata"
 	"github.com/JoelVCrasta/clover/metainfo"
 	"github.com/JoelVCrasta/clover/peer"
 )
@@ -31,15 +32,27 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	pC, err := torrent.StartPeerDiscovery(ctx, tr.AnnounceList, tr.InfoHash, peerId)
+	dm := download.NewDownloadManager(ctx, tr)
+
+	pd, err := torrent.StartPeerDiscovery(ctx, &tr, peerId, dm)
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer pd.Stop()
+	dm.SetDHT(pd.DHT())
+	dm.SetSourceCounter(pd)
 
-	client := client.NewClient(ctx, pC, tr.InfoHash, peerId)
+	client := client.NewClient(ctx, pd.Peers, tr.InfoHash, peerId)
+	if pd.DHT() != nil {
+		client.SetDHTPort(pd.DHT().Port())
+	}
+	client.SetMetadataSize(len(tr.InfoBytes))
+	client.RegisterExtension(metadata.NewExchange(tr.InfoHash, tr.InfoBytes))
+	if pd.PeerExchange() != nil {
+		client.RegisterExtension(pd.PeerExchange())
+	}
 	apC := client.StartClient()
 
-	dm := download.NewDownloadManager(ctx, tr, client)
-	dm.StartDownload(apC)
+	dm.StartDownload(client, apC)
 
 }
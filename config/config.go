@@ -5,19 +5,37 @@ import (
 	"path/filepath"
 	"runtime"
 	"time"
+
+	"github.com/JoelVCrasta/clover/mse"
 )
 
 type GlobalConfig struct {
 	MinPeers               int
 	Port                   uint16
 	TrackerConnectTimeout  time.Duration
+	TrackerMaxRetransmits  int
+	HTTPTrackerTimeout     time.Duration
 	PeerHandshakeTimeout   time.Duration
 	PieceMessageTimeout    time.Duration
 	DefaultTrackerInterval uint32
 	DownloadDirectory      string
-	DataDirectory		   string
+	DataDirectory          string
 	MaxTrackerConnections  int
+	AnnounceToAllTiers     bool
+	TrackerMinBackoff      time.Duration
+	TrackerMaxBackoff      time.Duration
+	AllowLoopbackTrackers  bool
+	UseTrackers            bool
+	UseDHT                 bool
+	DHTPort                uint16
+	DHTBootstrapNodes      []string
+	LocalServiceDiscovery  bool
+	IPFilterFiles          []string
+	BannedClients          []string
 	MaxFailedRetries       int
+	MaxHalfOpenConnections int
+	MaxPeerConnections     int
+	Encryption             mse.Policy
 	PeerId                 [20]byte
 }
 
@@ -33,15 +51,36 @@ func init() {
 
 	Config = GlobalConfig{
 		MinPeers:               10,
-		Port:                   6881,
-		TrackerConnectTimeout:  5 * time.Second,
+		Port:                   6881, // TCP port peers connect to, a free port is used if it is taken
+		TrackerConnectTimeout:  15 * time.Second,
+		TrackerMaxRetransmits:  2, // BEP 15 allows up to 8
+		HTTPTrackerTimeout:     30 * time.Second,
 		PeerHandshakeTimeout:   20 * time.Second,
 		PieceMessageTimeout:    30 * time.Second,
 		DefaultTrackerInterval: 1800, // 20 minutes
 		DownloadDirectory:      defaultDownloadDir,
-		DataDirectory: 			getDataDir(),
+		DataDirectory:          getDataDir(),
 		MaxTrackerConnections:  20,
+		AnnounceToAllTiers:     false,
+		TrackerMinBackoff:      15 * time.Second,
+		TrackerMaxBackoff:      30 * time.Minute,
+		AllowLoopbackTrackers:  false, // only for trackers on this machine, such as `clover tracker serve`
+		UseTrackers:            true,
+		UseDHT:                 true,
+		DHTPort:                0, // 0 shares the UDP port with Port
+		DHTBootstrapNodes: []string{
+			"router.bittorrent.com:6881",
+			"dht.transmissionbt.com:6881",
+			"router.utorrent.com:6881",
+			"dht.libtorrent.org:25401",
+		},
+		LocalServiceDiscovery:  true, // multicast announces on the local network (BEP 14)
+		IPFilterFiles:          nil,  // eMule ipfilter.dat, PeerGuardian P2P or CIDR lists of blocked addresses
+		BannedClients:          nil,  // peer ID codes or names of clients to refuse, such as "XL" or "Xunlei"
 		MaxFailedRetries:       3,
+		MaxHalfOpenConnections: 20,               // peers in the handshake at once
+		MaxPeerConnections:     80,               // connected and connecting peers
+		Encryption:             mse.PolicyPrefer, // plaintext, prefer or require encrypted connections (MSE)
 	}
 }
 
@@ -62,4 +101,4 @@ func getDataDir() string {
 	_ = os.MkdirAll(dataDir, 0755)
 
 	return dataDir
-}
\ No newline at end of file
+}
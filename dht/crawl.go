@@ -0,0 +1,216 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// maxSamples is the number of info hashes in a sample_infohashes response, which keeps it in one packet.
+	maxSamples = 20
+
+	// sampleInterval is the interval we ask crawlers to wait before sampling us again, the largest allowed (BEP 51).
+	sampleInterval = 6 * time.Hour
+
+	// crawlConcurrency is the number of sample_infohashes queries the crawler keeps in flight.
+	crawlConcurrency = 8
+
+	// minCrawlInterval is how long the crawler waits before sampling a node again, even if its interval is lower.
+	minCrawlInterval = time.Minute
+
+	// maxCrawlNodes bounds the nodes the crawler keeps track of.
+	maxCrawlNodes = 100000
+)
+
+/*
+Crawler walks the keyspace of the DHT with sample_infohashes queries (BEP 51).
+Every node is queried with a random target, which returns a sample of the info hashes it stores
+and the nodes close to the target to visit next. A node is not sampled again before
+the interval it returned has passed.
+*/
+type Crawler struct {
+	server *Server
+	visits map[netip.AddrPort]time.Time // the time a node can be sampled again
+	dead   map[netip.AddrPort]bool      // nodes that did not respond or do not support sampling
+	seen   map[[20]byte]bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// sampleReply is the response of a node to a sample_infohashes query.
+type sampleReply struct {
+	addr     netip.AddrPort
+	samples  [][20]byte
+	nodes    []Node
+	interval time.Duration
+	err      error
+}
+
+// NewCrawler creates a crawler which sends its queries through the DHT node.
+func NewCrawler(ctx context.Context, server *Server) *Crawler {
+	ctx, cancel := context.WithCancel(ctx)
+
+	return &Crawler{
+		server: server,
+		visits: make(map[netip.AddrPort]time.Time),
+		dead:   make(map[netip.AddrPort]bool),
+		seen:   make(map[[20]byte]bool),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+/*
+StartCrawler starts crawling from the nodes of the routing table.
+It returns a channel that receives every sampled info hash once, and is closed when the crawler stops.
+*/
+func (c *Crawler) StartCrawler() (<-chan [20]byte, error) {
+	if c.server.NumNodes() == 0 {
+		return nil, ErrNoNodes
+	}
+
+	infoHashChan := make(chan [20]byte, 500)
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer close(infoHashChan)
+
+		for c.ctx.Err() == nil {
+			due, wait := c.dueNodes()
+			if len(due) == 0 {
+				select {
+				case <-time.After(wait):
+				case <-c.ctx.Done():
+				}
+				continue
+			}
+
+			for _, reply := range c.sampleAll(due) {
+				if !c.handleReply(reply, infoHashChan) {
+					return
+				}
+			}
+		}
+	}()
+
+	return infoHashChan, nil
+}
+
+// StopCrawler stops the crawler and waits for the pending queries.
+func (c *Crawler) StopCrawler() {
+	c.cancel()
+	c.wg.Wait()
+}
+
+/*
+dueNodes returns up to crawlConcurrency nodes that can be sampled now, or how long to wait for the next one.
+Once every known node is dead, the crawl starts over from the routing table.
+*/
+func (c *Crawler) dueNodes() ([]netip.AddrPort, time.Duration) {
+	if len(c.visits) == 0 {
+		for _, n := range c.server.Nodes() {
+			c.visits[n.Addr] = time.Time{}
+			delete(c.dead, n.Addr)
+		}
+	}
+
+	now := time.Now()
+	wait := minCrawlInterval
+
+	var due []netip.AddrPort
+	for addr, next := range c.visits {
+		if !next.After(now) {
+			due = append(due, addr)
+			if len(due) == crawlConcurrency {
+				break
+			}
+			continue
+		}
+		wait = min(wait, next.Sub(now))
+	}
+
+	return due, wait
+}
+
+// sampleAll queries the nodes concurrently with random targets and returns their replies.
+func (c *Crawler) sampleAll(addrs []netip.AddrPort) []sampleReply {
+	replies := make([]sampleReply, len(addrs))
+
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			replies[i] = c.server.sampleInfoHashes(c.ctx, addr, RandomNodeID())
+		}()
+	}
+	wg.Wait()
+
+	return replies
+}
+
+// handleReply schedules the next visit of the node, queues the new nodes and sends the new samples.
+func (c *Crawler) handleReply(reply sampleReply, infoHashChan chan<- [20]byte) bool {
+	if reply.err != nil {
+		if c.ctx.Err() != nil || errors.Is(reply.err, ErrClosed) {
+			return false
+		}
+		delete(c.visits, reply.addr)
+		c.dead[reply.addr] = true
+		return true
+	}
+
+	c.visits[reply.addr] = time.Now().Add(max(reply.interval, minCrawlInterval))
+
+	for _, n := range reply.nodes {
+		if _, ok := c.visits[n.Addr]; ok || c.dead[n.Addr] || len(c.visits) >= maxCrawlNodes {
+			continue
+		}
+		c.visits[n.Addr] = time.Time{}
+	}
+
+	for _, infoHash := range reply.samples {
+		if c.seen[infoHash] {
+			continue
+		}
+		c.seen[infoHash] = true
+
+		select {
+		case infoHashChan <- infoHash:
+		case <-c.ctx.Done():
+			return false
+		}
+	}
+
+	return true
+}
+
+/*
+sampleInfoHashes sends a sample_infohashes query to the node at the address (BEP 51).
+The reply holds a sample of the info hashes the node stores, the nodes closest to the target
+and the interval to wait before querying the node again.
+*/
+func (s *Server) sampleInfoHashes(ctx context.Context, addr netip.AddrPort, target NodeID) sampleReply {
+	reply, err := s.query(ctx, addr, "sample_infohashes", map[string]any{"target": string(target[:])})
+	if err != nil {
+		return sampleReply{addr: addr, err: err}
+	}
+
+	result := sampleReply{addr: addr, nodes: s.replyNodes(reply)}
+	if interval, ok := getInt(reply, "interval"); ok {
+		result.interval = time.Duration(min(max(interval, 0), int(sampleInterval/time.Second))) * time.Second
+	}
+	if samples, ok := getBytes(reply, "samples"); ok {
+		for i := 0; i+20 <= len(samples); i += 20 {
+			result.samples = append(result.samples, [20]byte(samples[i:i+20]))
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,49 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCrawler(t *testing.T) {
+	servers := newTestNetwork(t, 10)
+
+	expected := make(map[[20]byte]bool)
+	for i := range 5 {
+		infoHash := [20]byte(RandomNodeID())
+		expected[infoHash] = true
+
+		if err := servers[i].Announce(context.Background(), infoHash, 7000, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := NewCrawler(context.Background(), servers[9])
+	infoHashChan, err := c.StartCrawler()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(10 * time.Second)
+	for len(expected) > 0 {
+		select {
+		case infoHash := <-infoHashChan:
+			if !expected[infoHash] {
+				t.Fatalf("unexpected info hash %x", infoHash)
+			}
+			delete(expected, infoHash)
+		case <-timeout:
+			t.Fatalf("%d info hashes were not sampled", len(expected))
+		}
+	}
+
+	c.StopCrawler()
+
+	// Every node that was sampled answered with our interval, so none of them is due again
+	for addr, next := range c.visits {
+		if !next.IsZero() && time.Until(next) < sampleInterval-time.Minute {
+			t.Errorf("node %s is sampled again at %s", addr, next)
+		}
+	}
+}
@@ -2,102 +2,353 @@ package dht
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net/netip"
+	"path/filepath"
+	"sync"
 	"time"
 
+	"github.com/JoelVCrasta/clover/config"
 	"github.com/JoelVCrasta/clover/peer"
-	"github.com/anacrolix/dht/v2"
 )
 
+/*
+DHT searches for the peers of a torrent on the IPv4 DHT and, if the host supports it,
+on the IPv6 DHT (BEP 32). The two address families have their own node and routing table,
+and can be stopped on their own.
+*/
 type DHT struct {
-	server   *dht.Server
+	v4       *family
+	v6       *family // nil without IPv6
 	infoHash [20]byte
+	nodes    []string
 	ctx      context.Context
 	cancel   context.CancelFunc
 }
 
-func NewDHT(ctx context.Context, infoHash [20]byte) (*DHT, error) {
-	config := dht.NewDefaultServerConfig()
+// family is the DHT node of one address family and the loop announcing the info hash on it.
+type family struct {
+	server   *Server
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+}
+
+/*
+NewDHT creates a DHT node which searches for the peers of the info hash.
+It listens on the UDP port config.Config.DHTPort, or config.Config.Port if it is not set,
+for both IPv4 and IPv6. The IPv6 DHT is left out if the host has no IPv6.
+The nodes, such as the ones from the torrent's nodes key, are used to join the DHT
+along with the nodes saved by the previous run.
+*/
+func NewDHT(ctx context.Context, infoHash [20]byte, nodes []string) (*DHT, error) {
+	port := config.Config.DHTPort
+	if port == 0 {
+		port = config.Config.Port
+	}
 
-	server, err := dht.NewServer(config)
+	server, err := NewServer(fmt.Sprintf(":%d", port))
 	if err != nil {
 		return nil, fmt.Errorf("[dht] failed to create DHT server: %w", err)
 	}
 
+	server6, err := NewServer6(fmt.Sprintf("[::]:%d", port))
+	if err != nil {
+		log.Printf("[dht] IPv6 DHT disabled: %v", err)
+		server6 = nil
+	}
+
+	return newDHT(ctx, server, server6, infoHash, nodes), nil
+}
+
+func newDHT(ctx context.Context, server, server6 *Server, infoHash [20]byte, nodes []string) *DHT {
 	ctx, cancel := context.WithCancel(ctx)
 
-	return &DHT{
-		server:   server,
+	d := &DHT{
+		v4:       newFamily(ctx, server),
 		infoHash: infoHash,
+		nodes:    nodes,
 		ctx:      ctx,
 		cancel:   cancel,
-	}, nil
+	}
+
+	if server6 != nil {
+		d.v6 = newFamily(ctx, server6)
+		server.SetSibling(server6)
+		server6.SetSibling(server)
+	}
+
+	return d
+}
+
+func newFamily(ctx context.Context, server *Server) *family {
+	ctx, cancel := context.WithCancel(ctx)
+	return &family{server: server, ctx: ctx, cancel: cancel}
 }
 
 /*
-Start starts the DHT bootstrapping process and begins announcing the info hash.
-It returns a channel that will receive discovered peers.
-It will periodically announce the info hash every 5 minutes.
+Start starts the DHT bootstrapping process and begins announcing the info hash on every address family.
+It returns a channel that will receive the discovered peers of both families,
+which is closed once both are stopped. It will periodically announce the info hash every 5 minutes.
 */
 func (d *DHT) StartDHT() (<-chan peer.Peer, error) {
 	peerChan := make(chan peer.Peer, 500)
 
+	var wg sync.WaitGroup
+	for _, f := range d.families() {
+		wg.Add(1)
+		f.wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer f.wg.Done()
+			d.run(f, peerChan)
+		}()
+	}
+
 	go func() {
-		defer close(peerChan)
+		wg.Wait()
+		close(peerChan)
+	}()
 
-		if _, err := d.server.Bootstrap(); err != nil {
-			log.Printf("[dht] bootstrap failed: %v", err)
-		}
+	return peerChan, nil
+}
 
-		// announce immediately first
-		d.announceOnce(peerChan)
+// run joins the DHT of the family and announces the info hash until the family is stopped.
+func (d *DHT) run(f *family, peerChan chan<- peer.Peer) {
+	d.bootstrap(f)
 
-		ticker := time.NewTicker(5 * time.Minute)
-		defer ticker.Stop()
+	// announce immediately first
+	d.announceOnce(f, peerChan)
 
-		for {
-			select {
-			case <-d.ctx.Done():
-				return
-			case <-ticker.C:
-				d.announceOnce(peerChan)
-			}
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.ctx.Done():
+			return
+		case <-ticker.C:
+			d.announceOnce(f, peerChan)
 		}
-	}()
+	}
+}
 
-	return peerChan, nil
+/*
+Bootstrap joins the DHT like StartDHT, without announcing the info hash.
+It is used to store and look up items without a torrent.
+*/
+func (d *DHT) Bootstrap() error {
+	joined := false
+	for _, f := range d.families() {
+		d.bootstrap(f)
+		joined = joined || f.server.NumNodes() > 0
+	}
+
+	if !joined {
+		return ErrNoNodes
+	}
+	return nil
 }
 
-// announceOnce performs a single announce to the DHT and sends discovered peers to the channel.
-func (d *DHT) announceOnce(peerChan chan<- peer.Peer) {
-	announce, err := d.server.AnnounceTraversal(d.infoHash)
+/*
+bootstrap joins the DHT of the family through the saved nodes and the torrent's nodes.
+The configured bootstrap nodes are only used when those do not fill a bucket.
+*/
+func (d *DHT) bootstrap(f *family) {
+	var addrs []string
+
+	saved, err := loadNodes(nodesPath(f.server.IPv6()))
 	if err != nil {
-		log.Printf("[dht] announce failed: %v", err)
-		return
+		log.Printf("[dht] failed to load saved nodes: %v", err)
+	}
+	for _, n := range saved {
+		addrs = append(addrs, n.Addr.String())
 	}
-	defer announce.Close()
+	addrs = append(addrs, d.nodes...)
 
-	for peerValues := range announce.Peers {
-		for _, p := range peerValues.Peers {
-			p_peer := peer.Peer{
-				IpAddr: p.IP,
-				Port:   uint16(p.Port),
-			}
-			if p_peer.IpAddr == nil || p_peer.IpAddr.IsUnspecified() {
-				continue // skip invalid IPs
-			}
+	if len(addrs) > 0 {
+		f.server.Bootstrap(f.ctx, addrs)
+	}
+
+	if f.server.NumNodes() < K && len(config.Config.DHTBootstrapNodes) > 0 {
+		f.server.Bootstrap(f.ctx, config.Config.DHTBootstrapNodes)
+	}
 
+	if f.server.NumNodes() == 0 && f.ctx.Err() == nil {
+		log.Printf("[dht] %s bootstrap failed: %v", f.name(), ErrNoNodes)
+	}
+}
+
+// announceOnce performs a single announce to the DHT of the family and sends discovered peers to the channel.
+func (d *DHT) announceOnce(f *family, peerChan chan<- peer.Peer) {
+	err := f.server.Announce(f.ctx, d.infoHash, config.Config.Port, func(peers []peer.Peer) {
+		for _, p := range peers {
 			select {
-			case peerChan <- p_peer:
-			case <-d.ctx.Done():
+			case peerChan <- p:
+			case <-f.ctx.Done():
 				return
 			}
 		}
+	})
+	if err != nil && f.ctx.Err() == nil {
+		log.Printf("[dht] %s announce failed: %v", f.name(), err)
+	}
+}
+
+// Get looks up the item stored under the target on every address family, see Server.Get.
+func (d *DHT) Get(target NodeID, salt []byte) (*Item, error) {
+	var found *Item
+	err := ErrNoNodes
+
+	for _, f := range d.running() {
+		item, ferr := f.server.Get(f.ctx, target, salt)
+		if ferr != nil {
+			if errors.Is(err, ErrNoNodes) {
+				err = ferr
+			}
+			continue
+		}
+
+		if found == nil || item.Seq > found.Seq {
+			found = item
+		}
+		if !item.Mutable() {
+			break
+		}
+	}
+
+	if found != nil {
+		return found, nil
+	}
+	return nil, err
+}
+
+// Put stores the item on the nodes closest to its target on every address family, see Server.Put.
+func (d *DHT) Put(item *Item, cas *int64) (int, error) {
+	stored := 0
+	err := ErrNoNodes
+
+	for _, f := range d.running() {
+		n, ferr := f.server.Put(f.ctx, item, cas)
+		if ferr != nil {
+			err = ferr
+			continue
+		}
+		stored += n
+	}
+
+	if stored == 0 {
+		return 0, err
+	}
+	return stored, nil
+}
+
+/*
+AddNode pings the DHT node at the address, such as the one a peer sent in its PORT message,
+and reports whether it was added to the routing table of its address family.
+*/
+func (d *DHT) AddNode(addr netip.AddrPort) (bool, error) {
+	f := d.v4
+	if addr.Addr().Unmap().Is6() {
+		f = d.v6
+	}
+	if f == nil || f.ctx.Err() != nil {
+		return false, fmt.Errorf("no running dht for %s", addr)
 	}
+
+	return f.server.AddNode(f.ctx, addr)
+}
+
+// Port returns the UDP port the DHT node listens on.
+func (d *DHT) Port() uint16 {
+	return uint16(d.v4.server.Addr().Port)
 }
 
+// Server returns the IPv4 DHT node used for the lookups.
+func (d *DHT) Server() *Server {
+	return d.v4.server
+}
+
+// Server6 returns the IPv6 DHT node used for the lookups, or nil without IPv6.
+func (d *DHT) Server6() *Server {
+	if d.v6 == nil {
+		return nil
+	}
+	return d.v6.server
+}
+
+// StopIPv4 stops the IPv4 DHT like StopDHT, while the IPv6 DHT keeps running.
+func (d *DHT) StopIPv4() {
+	d.v4.stop()
+}
+
+// StopIPv6 stops the IPv6 DHT like StopDHT, while the IPv4 DHT keeps running.
+func (d *DHT) StopIPv6() {
+	if d.v6 != nil {
+		d.v6.stop()
+	}
+}
+
+// StopDHT stops announcing, saves the good nodes of the routing tables for the next run and closes the DHT nodes.
 func (d *DHT) StopDHT() {
+	d.StopIPv4()
+	d.StopIPv6()
 	d.cancel()
-	d.server.Close()
+}
+
+// families returns the address families of the DHT.
+func (d *DHT) families() []*family {
+	if d.v6 == nil {
+		return []*family{d.v4}
+	}
+	return []*family{d.v4, d.v6}
+}
+
+// running returns the address families that were not stopped.
+func (d *DHT) running() []*family {
+	var running []*family
+	for _, f := range d.families() {
+		if f.ctx.Err() == nil {
+			running = append(running, f)
+		}
+	}
+	return running
+}
+
+// stop stops the announce loop of the family, saves the good nodes and closes the node.
+func (f *family) stop() {
+	f.stopOnce.Do(func() {
+		f.cancel()
+		f.wg.Wait()
+
+		if sibling := f.server.sibling.Load(); sibling != nil {
+			sibling.SetSibling(nil)
+		}
+
+		if nodes := f.server.table.goodNodes(); len(nodes) > 0 {
+			if err := saveNodes(nodesPath(f.server.IPv6()), nodes); err != nil {
+				log.Printf("[dht] failed to save nodes: %v", err)
+			}
+		}
+
+		f.server.Close()
+	})
+}
+
+func (f *family) name() string {
+	if f.server.IPv6() {
+		return "IPv6"
+	}
+	return "IPv4"
+}
+
+// nodesPath returns the path of the saved nodes of the address family in the data directory.
+func nodesPath(ipv6 bool) string {
+	if ipv6 {
+		return filepath.Join(config.Config.DataDirectory, nodesFile6)
+	}
+	return filepath.Join(config.Config.DataDirectory, nodesFile)
 }
@@ -0,0 +1,331 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/JoelVCrasta/clover/config"
+	"github.com/JoelVCrasta/clover/peer"
+)
+
+// newTestNetwork starts n DHT nodes on loopback, all bootstrapped from the first one.
+func newTestNetwork(t *testing.T, n int) []*Server {
+	return startTestNetwork(t, n, func() (*Server, error) { return NewServer("127.0.0.1:0") })
+}
+
+// newTestNetwork6 starts n IPv6 DHT nodes on loopback, or skips the test without IPv6.
+func newTestNetwork6(t *testing.T, n int) []*Server {
+	if s, err := NewServer6("[::1]:0"); err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	} else {
+		s.Close()
+	}
+
+	return startTestNetwork(t, n, func() (*Server, error) { return NewServer6("[::1]:0") })
+}
+
+func startTestNetwork(t *testing.T, n int, newServer func() (*Server, error)) []*Server {
+	t.Helper()
+
+	savedTimeout := queryTimeout
+	queryTimeout = 500 * time.Millisecond
+	t.Cleanup(func() { queryTimeout = savedTimeout })
+
+	servers := make([]*Server, n)
+	for i := range servers {
+		s, err := newServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(s.Close)
+		servers[i] = s
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, s := range servers[1:] {
+		if err := s.Bootstrap(ctx, []string{servers[0].Addr().String()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return servers
+}
+
+func TestFindNode(t *testing.T) {
+	servers := newTestNetwork(t, 20)
+	target := RandomNodeID()
+
+	var expected []NodeID
+	for _, s := range servers[1:] {
+		expected = append(expected, s.ID())
+	}
+	slices.SortFunc(expected, func(a, b NodeID) int { return compareDistance(target, a, b) })
+
+	nodes := servers[0].FindNode(context.Background(), target)
+	if len(nodes) != K {
+		t.Fatalf("expected %d nodes, got %d", K, len(nodes))
+	}
+	for i, n := range nodes {
+		if n.ID != expected[i] {
+			t.Errorf("node %d is %s, expected %s", i, n.ID, expected[i])
+		}
+	}
+}
+
+func TestAnnounceGetPeers(t *testing.T) {
+	servers := newTestNetwork(t, 12)
+	infoHash := [20]byte(RandomNodeID())
+
+	if err := servers[3].Announce(context.Background(), infoHash, 7000, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var found []peer.Peer
+	err := servers[9].GetPeers(context.Background(), infoHash, func(peers []peer.Peer) {
+		found = append(found, peers...)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(found) == 0 || found[0].String() != "127.0.0.1:7000" {
+		t.Errorf("unexpected peers %v", found)
+	}
+}
+
+func TestAddNode(t *testing.T) {
+	servers := newTestNetwork(t, 1)
+
+	s, err := NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	added, err := s.AddNode(context.Background(), servers[0].Addr().AddrPort())
+	if err != nil || !added {
+		t.Fatalf("node was not added: %v", err)
+	}
+	if s.NumNodes() != 1 {
+		t.Errorf("expected 1 node, got %d", s.NumNodes())
+	}
+
+	// Nothing listens on the port
+	if added, err := s.AddNode(context.Background(), netip.MustParseAddrPort("127.0.0.1:1")); added || err == nil {
+		t.Error("unreachable node was added")
+	}
+}
+
+func TestAnnounceBadToken(t *testing.T) {
+	servers := newTestNetwork(t, 2)
+
+	_, err := servers[1].query(context.Background(), servers[0].Addr().AddrPort(), "announce_peer", map[string]any{
+		"info_hash": string(make([]byte, 20)),
+		"port":      7000,
+		"token":     "forged",
+	})
+
+	var krpcErr *KRPCError
+	if !errors.As(err, &krpcErr) || krpcErr.Code != ErrorProtocol {
+		t.Fatalf("expected a protocol error, got %v", err)
+	}
+}
+
+// withDHTConfig points the data directory to a temporary directory and sets the bootstrap nodes.
+func withDHTConfig(t *testing.T, bootstrapNodes []string) {
+	t.Helper()
+
+	saved := config.Config
+	config.Config.DataDirectory = t.TempDir()
+	config.Config.DHTBootstrapNodes = bootstrapNodes
+	t.Cleanup(func() { config.Config = saved })
+}
+
+func TestStartDHT(t *testing.T) {
+	servers := newTestNetwork(t, 8)
+	infoHash := [20]byte(RandomNodeID())
+	withDHTConfig(t, nil)
+
+	if err := servers[5].Announce(context.Background(), infoHash, 7000, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The torrent's nodes are enough to join the DHT
+	d := newDHT(context.Background(), s, nil, infoHash, []string{servers[0].Addr().String()})
+
+	peerChan, err := d.StartDHT()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case p := <-peerChan:
+		if p.AddrPort() != netip.MustParseAddrPort("127.0.0.1:7000") {
+			t.Errorf("unexpected peer %s", p)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no peers received from the DHT")
+	}
+
+	d.StopDHT()
+
+	saved, err := loadNodes(nodesPath(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) == 0 {
+		t.Error("no nodes were saved")
+	}
+}
+
+func TestBootstrapSavedNodes(t *testing.T) {
+	servers := newTestNetwork(t, 4)
+	withDHTConfig(t, []string{"127.0.0.1:1"})
+
+	if err := saveNodes(nodesPath(false), servers[0].Nodes()); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := newDHT(context.Background(), s, nil, [20]byte{}, nil)
+	defer d.StopDHT()
+
+	d.Bootstrap()
+	if s.NumNodes() != len(servers) {
+		t.Errorf("expected %d nodes from the saved nodes, got %d", len(servers), s.NumNodes())
+	}
+}
+
+func TestStartDHTDualStack(t *testing.T) {
+	servers6 := newTestNetwork6(t, 4)
+	servers := newTestNetwork(t, 4)
+	infoHash := [20]byte(RandomNodeID())
+	withDHTConfig(t, nil)
+
+	if err := servers[1].Announce(context.Background(), infoHash, 7000, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := servers6[1].Announce(context.Background(), infoHash, 7001, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s6, err := NewServer6("[::1]:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each family only joins through the nodes of its own family
+	d := newDHT(context.Background(), s, s6, infoHash, []string{servers[0].Addr().String(), servers6[0].Addr().String()})
+
+	peerChan, err := d.StartDHT()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[netip.AddrPort]bool{
+		netip.MustParseAddrPort("127.0.0.1:7000"): true,
+		netip.MustParseAddrPort("[::1]:7001"):     true,
+	}
+	timeout := time.After(10 * time.Second)
+	for len(expected) > 0 {
+		select {
+		case p := <-peerChan:
+			delete(expected, p.AddrPort())
+		case <-timeout:
+			t.Fatalf("peers %v were not received", expected)
+		}
+	}
+
+	// Stopping one family leaves the other one running
+	d.StopIPv6()
+	if _, err := s6.Ping(context.Background(), servers6[0].Addr().AddrPort()); !errors.Is(err, ErrClosed) {
+		t.Errorf("IPv6 node is still running: %v", err)
+	}
+	if _, err := s.Ping(context.Background(), servers[0].Addr().AddrPort()); err != nil {
+		t.Errorf("IPv4 node stopped: %v", err)
+	}
+
+	// The channel is closed once both families stopped
+	d.StopDHT()
+	for range peerChan {
+	}
+
+	saved, err := loadNodes(nodesPath(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) == 0 || !saved[0].Addr.Addr().Is6() {
+		t.Errorf("unexpected saved IPv6 nodes %v", saved)
+	}
+}
+
+func TestWantNodes6(t *testing.T) {
+	servers6 := newTestNetwork6(t, 3)
+	servers := newTestNetwork(t, 2)
+	servers[0].SetSibling(servers6[0])
+
+	reply, err := servers[1].query(context.Background(), servers[0].Addr().AddrPort(), "find_node", map[string]any{
+		"target": string(make([]byte, 20)),
+		"want":   []any{"n4", "n6"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compact, _ := getBytes(reply, "nodes6")
+	nodes, err := decodeNodes6(compact)
+	if err != nil || len(nodes) != len(servers6)-1 {
+		t.Errorf("expected %d IPv6 nodes, got %v (%v)", len(servers6)-1, nodes, err)
+	}
+	if _, ok := getBytes(reply, "nodes"); !ok {
+		t.Error("IPv4 nodes are missing")
+	}
+}
+
+func TestKRPCRoundTrip(t *testing.T) {
+	m := &message{
+		TransactionId: "aa",
+		Type:          typeQuery,
+		Method:        "find_node",
+		Args:          map[string]any{"id": string(make([]byte, 20)), "target": string(make([]byte, 20))},
+	}
+
+	buf, err := m.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := decodeMessage(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.TransactionId != "aa" || decoded.Method != "find_node" {
+		t.Errorf("unexpected message %+v", decoded)
+	}
+	if _, ok := getId(decoded.Args, "target"); !ok {
+		t.Error("target was not decoded")
+	}
+
+	if _, err := decodeMessage([]byte("d1:t2:aa1:y1:qe")); err == nil {
+		t.Error("expected an error for a query without a method")
+	}
+}
@@ -0,0 +1,189 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"fmt"
+	"strconv"
+
+	"github.com/JoelVCrasta/clover/metainfo"
+)
+
+const (
+	// maxValueSize is the largest bencoded value a node stores (BEP 44).
+	maxValueSize = 1000
+
+	// maxSaltSize is the largest salt of a mutable item (BEP 44).
+	maxSaltSize = 64
+)
+
+/*
+Item is a value stored in the DHT (BEP 44). The value is anything the metainfo encoder accepts.
+Immutable items are addressed by the SHA-1 of their bencoded value. Mutable items have the
+ed25519 public key K, and are addressed by the SHA-1 of the key and the salt, so the owner
+of the key can update them with a higher sequence number.
+*/
+type Item struct {
+	V    any
+	K    ed25519.PublicKey // nil for immutable items
+	Salt []byte
+	Seq  int64
+	Sig  []byte
+}
+
+// NewImmutableItem returns the immutable item of the value.
+func NewImmutableItem(v any) (*Item, error) {
+	item := &Item{V: v}
+	if _, err := item.encodedValue(); err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
+// NewMutableItem returns the mutable item of the value with the sequence number and salt, signed with the key.
+func NewMutableItem(key ed25519.PrivateKey, v any, salt []byte, seq int64) (*Item, error) {
+	if len(salt) > maxSaltSize {
+		return nil, fmt.Errorf("salt is longer than %d bytes", maxSaltSize)
+	}
+
+	item := &Item{
+		V:    v,
+		K:    key.Public().(ed25519.PublicKey),
+		Salt: salt,
+		Seq:  seq,
+	}
+
+	encoded, err := item.encodedValue()
+	if err != nil {
+		return nil, err
+	}
+	item.Sig = ed25519.Sign(key, signatureBuffer(salt, seq, encoded))
+
+	return item, nil
+}
+
+// ImmutableTarget returns the target the value is stored under as an immutable item.
+func ImmutableTarget(v any) (NodeID, error) {
+	encoded, err := metainfo.BencodeMarshall(v)
+	if err != nil {
+		return NodeID{}, err
+	}
+
+	return sha1.Sum(encoded), nil
+}
+
+// MutableTarget returns the target the mutable items of the public key and salt are stored under.
+func MutableTarget(key ed25519.PublicKey, salt []byte) NodeID {
+	return sha1.Sum(append(append([]byte(nil), key...), salt...))
+}
+
+// Mutable reports whether the item is a mutable item.
+func (it *Item) Mutable() bool {
+	return it.K != nil
+}
+
+// Target returns the target the item is stored under.
+func (it *Item) Target() NodeID {
+	if it.Mutable() {
+		return MutableTarget(it.K, it.Salt)
+	}
+
+	target, _ := ImmutableTarget(it.V)
+	return target
+}
+
+// encodedValue bencodes the value and checks its size.
+func (it *Item) encodedValue() ([]byte, error) {
+	encoded, err := metainfo.BencodeMarshall(it.V)
+	if err != nil {
+		return nil, err
+	}
+	if len(encoded) > maxValueSize {
+		return nil, fmt.Errorf("value is larger than %d bytes", maxValueSize)
+	}
+
+	return encoded, nil
+}
+
+/*
+verify checks that the item belongs to the target and, for mutable items, that the signature is valid.
+It returns the KRPC error a put of the item is answered with.
+*/
+func (it *Item) verify(target NodeID) *KRPCError {
+	encoded, err := it.encodedValue()
+	if err != nil {
+		return &KRPCError{Code: ErrorValueTooBig, Message: "message (v field) too big"}
+	}
+
+	if !it.Mutable() {
+		if NodeID(sha1.Sum(encoded)) != target {
+			return &KRPCError{Code: ErrorProtocol, Message: "value does not match the target"}
+		}
+		return nil
+	}
+
+	if len(it.Salt) > maxSaltSize {
+		return &KRPCError{Code: ErrorSaltTooBig, Message: "salt (salt field) too big"}
+	}
+	if len(it.K) != ed25519.PublicKeySize || MutableTarget(it.K, it.Salt) != target {
+		return &KRPCError{Code: ErrorProtocol, Message: "key does not match the target"}
+	}
+	if len(it.Sig) != ed25519.SignatureSize || !ed25519.Verify(it.K, signatureBuffer(it.Salt, it.Seq, encoded), it.Sig) {
+		return &KRPCError{Code: ErrorInvalidSig, Message: "invalid signature"}
+	}
+
+	return nil
+}
+
+// signatureBuffer returns the bytes signed for a mutable item, "4:salt<salt>3:seqi<seq>e1:v<value>" (BEP 44).
+func signatureBuffer(salt []byte, seq int64, encodedValue []byte) []byte {
+	var buf bytes.Buffer
+	if len(salt) > 0 {
+		buf.WriteString("4:salt")
+		buf.WriteString(strconv.Itoa(len(salt)))
+		buf.WriteByte(':')
+		buf.Write(salt)
+	}
+	buf.WriteString("3:seqi")
+	buf.WriteString(strconv.FormatInt(seq, 10))
+	buf.WriteString("e1:v")
+	buf.Write(encodedValue)
+
+	return buf.Bytes()
+}
+
+// args returns the arguments of the put query for the item.
+func (it *Item) args() map[string]any {
+	args := map[string]any{"v": it.V}
+	if it.Mutable() {
+		args["k"] = []byte(it.K)
+		args["sig"] = it.Sig
+		args["seq"] = int(it.Seq)
+		if len(it.Salt) > 0 {
+			args["salt"] = it.Salt
+		}
+	}
+
+	return args
+}
+
+// itemFromDict decodes the item in the arguments of a put query or the values of a get response.
+func itemFromDict(dict map[string]any, salt []byte) (*Item, bool) {
+	v, ok := dict["v"]
+	if !ok {
+		return nil, false
+	}
+
+	item := &Item{V: v}
+	if k, ok := getBytes(dict, "k"); ok {
+		item.K = ed25519.PublicKey(k)
+		item.Sig, _ = getBytes(dict, "sig")
+		seq, _ := getInt(dict, "seq")
+		item.Seq = int64(seq)
+		item.Salt = salt
+	}
+
+	return item, true
+}
@@ -0,0 +1,105 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"testing"
+)
+
+func TestPutGetImmutable(t *testing.T) {
+	servers := newTestNetwork(t, 10)
+
+	item, err := NewImmutableItem("Hello World!")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The test vector of BEP 44
+	if target := item.Target(); target.String() != "e5f96f6f38320f0f33959cb4d3d656452117aadb" {
+		t.Errorf("unexpected target %s", target)
+	}
+
+	stored, err := servers[2].Put(context.Background(), item, nil)
+	if err != nil || stored == 0 {
+		t.Fatalf("item was not stored: %v", err)
+	}
+
+	found, err := servers[7].Get(context.Background(), item.Target(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := found.V.([]byte); !ok || string(v) != "Hello World!" {
+		t.Errorf("unexpected value %v", found.V)
+	}
+
+	if _, err := servers[7].Get(context.Background(), RandomNodeID(), nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestPutGetMutable(t *testing.T) {
+	servers := newTestNetwork(t, 10)
+	_, key, _ := ed25519.GenerateKey(nil)
+	salt := []byte("latest")
+
+	for seq := int64(1); seq <= 2; seq++ {
+		item, err := NewMutableItem(key, map[string]any{"seq": int(seq)}, salt, seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := servers[1].Put(context.Background(), item, nil); err != nil {
+			t.Fatalf("put of seq %d failed: %v", seq, err)
+		}
+	}
+
+	target := MutableTarget(key.Public().(ed25519.PublicKey), salt)
+	found, err := servers[8].Get(context.Background(), target, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Seq != 2 || !bytes.Equal(found.K, key.Public().(ed25519.PublicKey)) {
+		t.Errorf("unexpected item %+v", found)
+	}
+
+	// A lower sequence number is rejected
+	old, _ := NewMutableItem(key, "old", salt, 1)
+	var krpcErr *KRPCError
+	if _, err := servers[1].Put(context.Background(), old, nil); !errors.As(err, &krpcErr) || krpcErr.Code != ErrorSeqTooLow {
+		t.Errorf("expected a sequence number error, got %v", err)
+	}
+
+	// So is a put which expects another sequence number to be stored
+	next, _ := NewMutableItem(key, "next", salt, 3)
+	cas := int64(1)
+	if _, err := servers[1].Put(context.Background(), next, &cas); !errors.As(err, &krpcErr) || krpcErr.Code != ErrorCASMismatch {
+		t.Errorf("expected a CAS mismatch, got %v", err)
+	}
+
+	cas = 2
+	if _, err := servers[1].Put(context.Background(), next, &cas); err != nil {
+		t.Errorf("put with the current sequence number failed: %v", err)
+	}
+}
+
+func TestItemVerify(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+
+	item, err := NewMutableItem(key, "value", nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if krpcErr := item.verify(item.Target()); krpcErr != nil {
+		t.Fatal(krpcErr)
+	}
+
+	item.Seq = 2
+	if krpcErr := item.verify(item.Target()); krpcErr == nil || krpcErr.Code != ErrorInvalidSig {
+		t.Errorf("expected an invalid signature, got %v", krpcErr)
+	}
+
+	if _, err := NewImmutableItem(string(make([]byte, maxValueSize))); err == nil {
+		t.Error("expected an error for a value that is too big")
+	}
+}
@@ -0,0 +1,253 @@
+package dht
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+
+	"github.com/JoelVCrasta/clover/metainfo"
+)
+
+// KRPC message types (BEP 5)
+const (
+	typeQuery    = "q"
+	typeResponse = "r"
+	typeError    = "e"
+)
+
+// KRPC error codes (BEP 5)
+const (
+	ErrorGeneric       = 201
+	ErrorServer        = 202
+	ErrorProtocol      = 203
+	ErrorMethodUnknown = 204
+)
+
+// Error codes of the put query (BEP 44)
+const (
+	ErrorValueTooBig = 205
+	ErrorInvalidSig  = 206
+	ErrorSaltTooBig  = 207
+	ErrorCASMismatch = 301
+	ErrorSeqTooLow   = 302
+)
+
+// compactNodeLen is the length of an IPv4 node in the compact node info format.
+const compactNodeLen = 20 + net.IPv4len + 2
+
+// compactNode6Len is the length of an IPv6 node in the compact node info format of nodes6 (BEP 32).
+const compactNode6Len = 20 + net.IPv6len + 2
+
+// KRPCError is returned when a node answers a query with an error message.
+type KRPCError struct {
+	Code    int
+	Message string
+}
+
+func (e *KRPCError) Error() string {
+	return fmt.Sprintf("krpc error %d: %s", e.Code, e.Message)
+}
+
+// message is a single KRPC query, response or error.
+type message struct {
+	TransactionId string
+	Type          string
+	Method        string         // the name of the query
+	Args          map[string]any // the arguments of a query
+	Reply         map[string]any // the values of a response
+	Error         *KRPCError
+
+	from netip.AddrPort // the sender of a received message
+}
+
+// encode bencodes the message.
+func (m *message) encode() ([]byte, error) {
+	dict := map[string]any{
+		"t": m.TransactionId,
+		"y": m.Type,
+	}
+
+	switch m.Type {
+	case typeQuery:
+		dict["q"] = m.Method
+		dict["a"] = m.Args
+	case typeResponse:
+		dict["r"] = m.Reply
+	case typeError:
+		dict["e"] = []any{m.Error.Code, m.Error.Message}
+	default:
+		return nil, fmt.Errorf("unknown message type %q", m.Type)
+	}
+
+	return metainfo.BencodeMarshall(dict)
+}
+
+// decodeMessage decodes a bencoded KRPC message.
+func decodeMessage(buf []byte) (*message, error) {
+	decoded, err := metainfo.BencodeUnmarshall(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	dict, ok := decoded.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("message is not a dictionary")
+	}
+
+	transactionId, ok := dict["t"].([]byte)
+	if !ok {
+		return nil, fmt.Errorf("missing transaction id")
+	}
+	messageType, ok := dict["y"].([]byte)
+	if !ok {
+		return nil, fmt.Errorf("missing message type")
+	}
+
+	m := &message{
+		TransactionId: string(transactionId),
+		Type:          string(messageType),
+	}
+
+	switch m.Type {
+	case typeQuery:
+		method, ok := dict["q"].([]byte)
+		if !ok {
+			return nil, fmt.Errorf("missing query method")
+		}
+		args, ok := dict["a"].(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("missing query arguments")
+		}
+		m.Method = string(method)
+		m.Args = args
+
+	case typeResponse:
+		reply, ok := dict["r"].(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("missing response values")
+		}
+		m.Reply = reply
+
+	case typeError:
+		m.Error = &KRPCError{Code: ErrorGeneric}
+		if e, ok := dict["e"].([]any); ok && len(e) == 2 {
+			if code, ok := e[0].(int); ok {
+				m.Error.Code = code
+			}
+			if msg, ok := e[1].([]byte); ok {
+				m.Error.Message = string(msg)
+			}
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown message type %q", m.Type)
+	}
+
+	return m, nil
+}
+
+// getBytes returns the string value of the key in a decoded dictionary.
+func getBytes(dict map[string]any, key string) ([]byte, bool) {
+	value, ok := dict[key].([]byte)
+	return value, ok
+}
+
+// getInt returns the integer value of the key in a decoded dictionary.
+func getInt(dict map[string]any, key string) (int, bool) {
+	value, ok := dict[key].(int)
+	return value, ok
+}
+
+// getId returns the 20-byte node ID or info hash stored under the key.
+func getId(dict map[string]any, key string) (NodeID, bool) {
+	value, ok := getBytes(dict, key)
+	if !ok || len(value) != 20 {
+		return NodeID{}, false
+	}
+	return NodeID(value), true
+}
+
+// encodeNodes encodes the IPv4 nodes in the compact node info format, 26 bytes per node.
+func encodeNodes(nodes []Node) []byte {
+	buf := make([]byte, 0, compactNodeLen*len(nodes))
+	for _, n := range nodes {
+		if !n.Addr.Addr().Is4() {
+			continue
+		}
+
+		ip := n.Addr.Addr().As4()
+		buf = append(buf, n.ID[:]...)
+		buf = append(buf, ip[:]...)
+		buf = binary.BigEndian.AppendUint16(buf, n.Addr.Port())
+	}
+
+	return buf
+}
+
+// decodeNodes decodes IPv4 nodes in the compact node info format, skipping entries with an invalid address.
+func decodeNodes(buf []byte) ([]Node, error) {
+	if len(buf)%compactNodeLen != 0 {
+		return nil, fmt.Errorf("invalid compact nodes length %d", len(buf))
+	}
+
+	nodes := make([]Node, 0, len(buf)/compactNodeLen)
+	for i := 0; i < len(buf); i += compactNodeLen {
+		addr := netip.AddrPortFrom(
+			netip.AddrFrom4([4]byte(buf[i+20:i+24])),
+			binary.BigEndian.Uint16(buf[i+24:]),
+		)
+		if !validAddr(addr) {
+			continue
+		}
+
+		nodes = append(nodes, Node{ID: NodeID(buf[i : i+20]), Addr: addr})
+	}
+
+	return nodes, nil
+}
+
+// encodeNodes6 encodes the IPv6 nodes in the compact node info format of nodes6, 38 bytes per node.
+func encodeNodes6(nodes []Node) []byte {
+	buf := make([]byte, 0, compactNode6Len*len(nodes))
+	for _, n := range nodes {
+		if !n.Addr.Addr().Is6() || n.Addr.Addr().Is4In6() {
+			continue
+		}
+
+		ip := n.Addr.Addr().As16()
+		buf = append(buf, n.ID[:]...)
+		buf = append(buf, ip[:]...)
+		buf = binary.BigEndian.AppendUint16(buf, n.Addr.Port())
+	}
+
+	return buf
+}
+
+// decodeNodes6 decodes IPv6 nodes in the compact node info format of nodes6, skipping entries with an invalid address.
+func decodeNodes6(buf []byte) ([]Node, error) {
+	if len(buf)%compactNode6Len != 0 {
+		return nil, fmt.Errorf("invalid compact nodes6 length %d", len(buf))
+	}
+
+	nodes := make([]Node, 0, len(buf)/compactNode6Len)
+	for i := 0; i < len(buf); i += compactNode6Len {
+		addr := netip.AddrPortFrom(
+			netip.AddrFrom16([16]byte(buf[i+20:i+36])),
+			binary.BigEndian.Uint16(buf[i+36:]),
+		)
+		if !validAddr(addr) || addr.Addr().Is4In6() {
+			continue
+		}
+
+		nodes = append(nodes, Node{ID: NodeID(buf[i : i+20]), Addr: addr})
+	}
+
+	return nodes, nil
+}
+
+// validAddr reports whether a node or peer can be reached at the address.
+func validAddr(addr netip.AddrPort) bool {
+	ip := addr.Addr()
+	return ip.IsValid() && !ip.IsUnspecified() && !ip.IsMulticast() && addr.Port() != 0
+}
@@ -0,0 +1,166 @@
+package dht
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+
+	"github.com/JoelVCrasta/clover/peer"
+)
+
+// alpha is the number of queries a lookup keeps in flight (BEP 5).
+const alpha = 3
+
+// lookupResult is a node that responded during a lookup, with the token it handed out for get_peers.
+type lookupResult struct {
+	node  Node
+	token []byte
+}
+
+// lookupReply is the outcome of a single query of a lookup.
+type lookupReply struct {
+	node   Node
+	nodes  []Node
+	values []peer.Peer
+	token  []byte
+	reply  map[string]any // the values of the response
+	err    error
+}
+
+/*
+lookup iteratively queries the nodes closest to the target with find_node, get_peers or get,
+starting from the routing table and moving closer with the nodes every response contains.
+It stops when the K closest nodes it knows of have all been queried, and returns those that responded.
+Every response is passed to onReply as it arrives.
+*/
+func (s *Server) lookup(ctx context.Context, target NodeID, method string, onReply func(lookupReply)) []lookupResult {
+	var candidates []Node
+	seen := make(map[netip.AddrPort]bool)
+	queried := make(map[netip.AddrPort]bool)
+	failed := make(map[netip.AddrPort]bool)
+
+	addCandidates := func(nodes []Node) {
+		for _, n := range nodes {
+			if n.ID == s.id || seen[n.Addr] {
+				continue
+			}
+			seen[n.Addr] = true
+			candidates = append(candidates, n)
+		}
+		sortByDistance(target, candidates)
+	}
+	addCandidates(s.table.closest(target, K))
+
+	var results []lookupResult
+	replies := make(chan lookupReply)
+	inFlight := 0
+
+	for {
+		// Query the closest of the K nearest candidates that were not queried yet
+		considered := 0
+		for _, n := range candidates {
+			if considered == K || inFlight == alpha {
+				break
+			}
+			if failed[n.Addr] {
+				continue
+			}
+			considered++
+			if queried[n.Addr] {
+				continue
+			}
+
+			queried[n.Addr] = true
+			inFlight++
+			go func(n Node) {
+				replies <- s.lookupQuery(ctx, n, target, method)
+			}(n)
+		}
+
+		if inFlight == 0 {
+			break
+		}
+
+		// Every query returns once the context is done, so the loop always drains
+		reply := <-replies
+		inFlight--
+
+		if reply.err != nil {
+			failed[reply.node.Addr] = true
+			continue
+		}
+
+		results = append(results, lookupResult{node: reply.node, token: reply.token})
+		if onReply != nil {
+			onReply(reply)
+		}
+		if ctx.Err() == nil {
+			addCandidates(reply.nodes)
+		}
+	}
+
+	slices.SortFunc(results, func(a, b lookupResult) int {
+		return compareDistance(target, a.node.ID, b.node.ID)
+	})
+
+	return results[:min(K, len(results))]
+}
+
+// lookupQuery sends a single find_node, get_peers or get query of a lookup and decodes the response.
+func (s *Server) lookupQuery(ctx context.Context, n Node, target NodeID, method string) lookupReply {
+	args := map[string]any{"target": string(target[:])}
+	if method == "get_peers" {
+		args = map[string]any{"info_hash": string(target[:])}
+	}
+
+	reply, err := s.query(ctx, n.Addr, method, args)
+	if err != nil {
+		return lookupReply{node: n, err: err}
+	}
+
+	result := lookupReply{node: n, reply: reply}
+	if id, ok := getId(reply, "id"); ok {
+		result.node.ID = id
+	}
+
+	result.nodes = s.replyNodes(reply)
+	if token, ok := getBytes(reply, "token"); ok {
+		result.token = token
+	}
+	if values, ok := reply["values"].([]any); ok {
+		for _, value := range values {
+			compact, ok := value.([]byte)
+			if !ok || (len(compact) != 6 && len(compact) != 18) {
+				continue
+			}
+
+			peers, _ := peer.DecodeCompact(compact, len(compact)-2)
+			for _, p := range peers {
+				if validAddr(p.AddrPort()) {
+					result.values = append(result.values, p)
+				}
+			}
+		}
+	}
+
+	return result
+}
+
+// sortByDistance sorts the nodes by their distance to the target, closest first.
+func sortByDistance(target NodeID, nodes []Node) {
+	slices.SortFunc(nodes, func(a, b Node) int {
+		return compareDistance(target, a.ID, b.ID)
+	})
+}
+
+// compareDistance compares the distances of a and b to the target like cmp.Compare.
+func compareDistance(target, a, b NodeID) int {
+	switch {
+	case target.closer(a, b):
+		return -1
+	case target.closer(b, a):
+		return 1
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,68 @@
+package dht
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"math/bits"
+	"net/netip"
+)
+
+// NodeID identifies a node in the DHT, info hashes live in the same 160-bit keyspace.
+type NodeID [20]byte
+
+// Node is a DHT node and the UDP address it can be reached at.
+type Node struct {
+	ID   NodeID
+	Addr netip.AddrPort
+}
+
+// RandomNodeID generates a random node ID.
+func RandomNodeID() NodeID {
+	var id NodeID
+	rand.Read(id[:])
+	return id
+}
+
+func (id NodeID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// prefixLen returns the number of leading bits the two IDs have in common.
+func (id NodeID) prefixLen(other NodeID) int {
+	for i := range id {
+		if x := id[i] ^ other[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return len(id) * 8
+}
+
+// closer reports whether a is closer to the ID than b.
+func (id NodeID) closer(a, b NodeID) bool {
+	for i := range id {
+		da, db := a[i]^id[i], b[i]^id[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+// randomIdInBucket returns a random ID that shares exactly prefixLen leading bits with the ID.
+func (id NodeID) randomIdInBucket(prefixLen int) NodeID {
+	random := RandomNodeID()
+	if prefixLen >= len(id)*8 {
+		return id
+	}
+
+	for i := range prefixLen {
+		mask := byte(0x80) >> (i % 8)
+		random[i/8] = random[i/8]&^mask | id[i/8]&mask
+	}
+
+	// The next bit has to differ, so the ID falls into the bucket
+	mask := byte(0x80) >> (prefixLen % 8)
+	random[prefixLen/8] = random[prefixLen/8]&^mask | ^id[prefixLen/8]&mask
+
+	return random
+}
@@ -0,0 +1,78 @@
+package dht
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/JoelVCrasta/clover/metainfo"
+)
+
+// nodesFile and nodesFile6 are the files in the data directory the good nodes of the IPv4 and IPv6 routing tables are saved to.
+const (
+	nodesFile  = "dht_nodes.dat"
+	nodesFile6 = "dht_nodes6.dat"
+)
+
+// saveNodes writes the nodes to the file as a bencoded dictionary of compact node info, with nodes6 for the IPv6 nodes.
+func saveNodes(path string, nodes []Node) error {
+	buf, err := metainfo.BencodeMarshall(map[string]any{
+		"nodes":  encodeNodes(nodes),
+		"nodes6": encodeNodes6(nodes),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so an interrupted save does not lose the previous nodes
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadNodes reads the nodes saved by saveNodes. A missing file is not an error.
+func loadNodes(path string) ([]Node, error) {
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	decoded, err := metainfo.BencodeUnmarshall(buf)
+	if err != nil {
+		return nil, fmt.Errorf("invalid nodes file: %v", err)
+	}
+
+	dict, ok := decoded.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("invalid nodes file format")
+	}
+
+	compact, _ := getBytes(dict, "nodes")
+	nodes, err := decodeNodes(compact)
+	if err != nil {
+		return nil, err
+	}
+
+	compact6, _ := getBytes(dict, "nodes6")
+	nodes6, err := decodeNodes6(compact6)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(nodes, nodes6...), nil
+}
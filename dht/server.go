@@ -0,0 +1,765 @@
+package dht
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/JoelVCrasta/clover/peer"
+)
+
+// refreshInterval is how long a bucket can go without changes before it is refreshed with a lookup (BEP 5).
+const refreshInterval = 15 * time.Minute
+
+// queryTimeout is how long to wait for the response to a query.
+var queryTimeout = 2 * time.Second
+
+var (
+	// ErrTimeout is returned when a node did not respond to a query in time.
+	ErrTimeout = errors.New("dht query timed out")
+
+	// ErrClosed is returned for queries on a closed server.
+	ErrClosed = errors.New("dht server closed")
+
+	// ErrNoNodes is returned when there is no node to send a query to.
+	ErrNoNodes = errors.New("no dht nodes")
+
+	// ErrNotFound is returned when none of the nodes close to the target stores an item.
+	ErrNotFound = errors.New("dht item not found")
+)
+
+// transaction is a query waiting for the response of the node it was sent to.
+type transaction struct {
+	addr  netip.AddrPort
+	reply chan *message
+}
+
+/*
+Server is a DHT node (BEP 5). It answers the ping, find_node, get_peers and announce_peer queries
+of other nodes, as well as the get and put queries of the data storage (BEP 44)
+and the sample_infohashes queries of crawlers (BEP 51),
+and sends its own queries over the same UDP socket.
+
+A server speaks a single address family. The IPv6 DHT (BEP 32) is a separate server
+with its own routing table, see NewServer6.
+*/
+type Server struct {
+	id      NodeID
+	network string // udp4 or udp6
+	conn    *net.UDPConn
+	sibling atomic.Pointer[Server] // the server of the other address family, for the want argument
+	table   *routingTable
+	peers   *peerStore
+	items   *itemStore
+	tokens  *tokenManager
+
+	mu        sync.Mutex
+	pending   map[string]*transaction
+	txCounter uint16
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// NewServer creates an IPv4 DHT node with a random ID listening on the UDP address, such as ":6881".
+func NewServer(addr string) (*Server, error) {
+	return newServer("udp4", addr)
+}
+
+// NewServer6 creates an IPv6 DHT node (BEP 32) with a random ID listening on the UDP address, such as "[::]:6881".
+func NewServer6(addr string) (*Server, error) {
+	return newServer("udp6", addr)
+}
+
+func newServer(network, addr string) (*Server, error) {
+	udpAddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP(network, udpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	id := RandomNodeID()
+	s := &Server{
+		id:      id,
+		network: network,
+		conn:    conn,
+		table:   newRoutingTable(id),
+		peers:   newPeerStore(),
+		items:   newItemStore(),
+		tokens:  newTokenManager(),
+		pending: make(map[string]*transaction),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+
+	s.wg.Add(2)
+	go s.serve()
+	go s.maintain()
+
+	return s, nil
+}
+
+// ID returns the node ID of the server.
+func (s *Server) ID() NodeID {
+	return s.id
+}
+
+// Addr returns the UDP address the server listens on.
+func (s *Server) Addr() *net.UDPAddr {
+	return s.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// IPv6 reports whether the server is a node of the IPv6 DHT.
+func (s *Server) IPv6() bool {
+	return s.network == "udp6"
+}
+
+/*
+SetSibling links the server to the server of the other address family, so it can answer
+queries that want the nodes of both families (BEP 32).
+*/
+func (s *Server) SetSibling(other *Server) {
+	s.sibling.Store(other)
+}
+
+// NumNodes returns the number of nodes in the routing table.
+func (s *Server) NumNodes() int {
+	return s.table.len()
+}
+
+// Nodes returns the nodes in the routing table.
+func (s *Server) Nodes() []Node {
+	return s.table.nodes()
+}
+
+// Close closes the socket and waits for the server to shut down. Pending queries fail with ErrClosed.
+func (s *Server) Close() {
+	s.closeOnce.Do(func() {
+		s.cancel()
+		s.conn.Close()
+		s.wg.Wait()
+	})
+}
+
+/*
+Bootstrap pings the nodes at the addresses, such as "router.bittorrent.com:6881",
+and then looks up our own ID to fill the routing table with the nodes close to us.
+*/
+func (s *Server) Bootstrap(ctx context.Context, addrs []string) error {
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+
+			udpAddr, err := net.ResolveUDPAddr(s.network, addr)
+			if err != nil {
+				return
+			}
+			s.Ping(ctx, udpAddr.AddrPort())
+		}(addr)
+	}
+	wg.Wait()
+
+	if s.table.len() == 0 {
+		return ErrNoNodes
+	}
+
+	s.FindNode(ctx, s.id)
+	return nil
+}
+
+// Ping sends a ping query to the address and returns the ID of the node that responded.
+func (s *Server) Ping(ctx context.Context, addr netip.AddrPort) (NodeID, error) {
+	reply, err := s.query(ctx, addr, "ping", map[string]any{})
+	if err != nil {
+		return NodeID{}, err
+	}
+
+	id, _ := getId(reply, "id")
+	return id, nil
+}
+
+/*
+AddNode pings the node at the address, such as the one a peer sent in its PORT message,
+and reports whether it responded and was added to the routing table.
+A node is not added when its bucket is full of good nodes.
+*/
+func (s *Server) AddNode(ctx context.Context, addr netip.AddrPort) (bool, error) {
+	addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+	if !validAddr(addr) || addr.Addr().Is6() != s.IPv6() {
+		return false, fmt.Errorf("invalid dht node address %s", addr)
+	}
+
+	id, err := s.Ping(ctx, addr)
+	if err != nil {
+		return false, err
+	}
+
+	return s.table.contains(id), nil
+}
+
+// FindNode iteratively looks up the K nodes closest to the target.
+func (s *Server) FindNode(ctx context.Context, target NodeID) []Node {
+	var nodes []Node
+	for _, result := range s.lookup(ctx, target, "find_node", nil) {
+		nodes = append(nodes, result.node)
+	}
+
+	return nodes
+}
+
+/*
+GetPeers iteratively looks up the nodes closest to the info hash and calls onPeers
+with the peers every node returns, which can contain duplicates.
+*/
+func (s *Server) GetPeers(ctx context.Context, infoHash [20]byte, onPeers func([]peer.Peer)) error {
+	if len(s.lookup(ctx, NodeID(infoHash), "get_peers", peersReply(onPeers))) == 0 {
+		return ErrNoNodes
+	}
+
+	return nil
+}
+
+/*
+Announce looks up the peers of the info hash like GetPeers, and then announces that we are
+a peer on the given port to the K closest nodes that handed out a token.
+*/
+func (s *Server) Announce(ctx context.Context, infoHash [20]byte, port uint16, onPeers func([]peer.Peer)) error {
+	results := s.lookup(ctx, NodeID(infoHash), "get_peers", peersReply(onPeers))
+	if len(results) == 0 {
+		return ErrNoNodes
+	}
+
+	var wg sync.WaitGroup
+	for _, result := range results {
+		if result.token == nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(result lookupResult) {
+			defer wg.Done()
+
+			s.query(ctx, result.node.Addr, "announce_peer", map[string]any{
+				"info_hash":    string(infoHash[:]),
+				"port":         int(port),
+				"token":        result.token,
+				"implied_port": 0,
+			})
+		}(result)
+	}
+	wg.Wait()
+
+	return nil
+}
+
+// peersReply returns the lookup callback that passes the peers of the get_peers responses to onPeers.
+func peersReply(onPeers func([]peer.Peer)) func(lookupReply) {
+	return func(reply lookupReply) {
+		if len(reply.values) > 0 && onPeers != nil {
+			onPeers(reply.values)
+		}
+	}
+}
+
+/*
+Get looks up the item stored under the target (BEP 44). The salt is required to verify
+the mutable items stored under the target, and the one with the highest sequence number is returned.
+Items that do not match the target or have an invalid signature are ignored.
+*/
+func (s *Server) Get(ctx context.Context, target NodeID, salt []byte) (*Item, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var found *Item
+	results := s.lookup(ctx, target, "get", func(reply lookupReply) {
+		item, ok := itemFromDict(reply.reply, salt)
+		if !ok || item.verify(target) != nil {
+			return
+		}
+
+		if found == nil || item.Seq > found.Seq {
+			found = item
+		}
+
+		// An immutable item can not change, so the first one is enough
+		if !item.Mutable() {
+			cancel()
+		}
+	})
+
+	if found != nil {
+		return found, nil
+	}
+	if len(results) == 0 {
+		return nil, ErrNoNodes
+	}
+	return nil, ErrNotFound
+}
+
+/*
+Put stores the item on the K nodes closest to its target that handed out a token, and returns
+how many of them stored it (BEP 44). If cas is set, the nodes only replace a mutable item whose
+sequence number is cas. When no node stored the item, the error of the last node is returned,
+such as a *KRPCError with the code ErrorCASMismatch or ErrorSeqTooLow.
+*/
+func (s *Server) Put(ctx context.Context, item *Item, cas *int64) (int, error) {
+	target := item.Target()
+	if krpcErr := item.verify(target); krpcErr != nil {
+		return 0, krpcErr
+	}
+
+	results := s.lookup(ctx, target, "get", nil)
+	if len(results) == 0 {
+		return 0, ErrNoNodes
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		stored  int
+		lastErr error = ErrNoNodes
+	)
+	for _, result := range results {
+		if result.token == nil {
+			continue
+		}
+
+		args := item.args()
+		args["token"] = result.token
+		if cas != nil {
+			args["cas"] = int(*cas)
+		}
+
+		wg.Add(1)
+		go func(addr netip.AddrPort) {
+			defer wg.Done()
+
+			_, err := s.query(ctx, addr, "put", args)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				lastErr = err
+				return
+			}
+			stored++
+		}(result.node.Addr)
+	}
+	wg.Wait()
+
+	if stored == 0 {
+		return 0, lastErr
+	}
+	return stored, nil
+}
+
+/*
+addNode adds a node that responded to us to the routing table and reports whether it is in the table.
+If its bucket is full of questionable nodes, the oldest one is pinged in the background
+and replaced by the new node if it does not respond.
+*/
+func (s *Server) addNode(n Node) bool {
+	added, stale := s.table.add(n)
+	if stale == nil || s.ctx.Err() != nil {
+		return added
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		if _, err := s.Ping(s.ctx, stale.Addr); errors.Is(err, ErrTimeout) {
+			s.table.replace(stale.ID, n)
+		}
+	}()
+
+	return false
+}
+
+/*
+query sends a query to the node at the address and waits for its response.
+Nodes that respond are added to the routing table, nodes that time out are marked as failed.
+*/
+func (s *Server) query(ctx context.Context, addr netip.AddrPort, method string, args map[string]any) (map[string]any, error) {
+	if s.ctx.Err() != nil {
+		return nil, ErrClosed
+	}
+
+	args["id"] = string(s.id[:])
+	addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+
+	transactionId, replyChan := s.newTransaction(addr)
+	defer s.endTransaction(transactionId)
+
+	m := &message{
+		TransactionId: transactionId,
+		Type:          typeQuery,
+		Method:        method,
+		Args:          args,
+	}
+	if err := s.send(m, addr); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(queryTimeout)
+	defer timer.Stop()
+
+	select {
+	case reply := <-replyChan:
+		if reply.Type == typeError {
+			return nil, reply.Error
+		}
+
+		id, ok := getId(reply.Reply, "id")
+		if !ok {
+			return nil, fmt.Errorf("response without a node id")
+		}
+		s.addNode(Node{ID: id, Addr: addr})
+
+		return reply.Reply, nil
+
+	case <-timer.C:
+		s.table.markFailed(addr)
+		return nil, ErrTimeout
+
+	case <-ctx.Done():
+		return nil, ctx.Err()
+
+	case <-s.ctx.Done():
+		return nil, ErrClosed
+	}
+}
+
+// newTransaction registers a transaction ID for a query and returns the channel its response is delivered on.
+func (s *Server) newTransaction(addr netip.AddrPort) (string, chan *message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		s.txCounter++
+		transactionId := string(binary.BigEndian.AppendUint16(nil, s.txCounter))
+		if _, exists := s.pending[transactionId]; exists {
+			continue
+		}
+
+		tx := &transaction{addr: addr, reply: make(chan *message, 1)}
+		s.pending[transactionId] = tx
+		return transactionId, tx.reply
+	}
+}
+
+func (s *Server) endTransaction(transactionId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.pending, transactionId)
+}
+
+// send encodes the message and writes it to the address.
+func (s *Server) send(m *message, addr netip.AddrPort) error {
+	buf, err := m.encode()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.conn.WriteToUDPAddrPort(buf, addr)
+	return err
+}
+
+// serve reads the incoming messages until the socket is closed.
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := s.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+
+		addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+
+		// The decoded strings point into the buffer, so every packet gets its own copy
+		m, err := decodeMessage(append([]byte(nil), buf[:n]...))
+		if err != nil {
+			continue
+		}
+		m.from = addr
+
+		if m.Type == typeQuery {
+			s.handleQuery(m)
+			continue
+		}
+
+		s.mu.Lock()
+		tx, ok := s.pending[m.TransactionId]
+		s.mu.Unlock()
+
+		// Responses are only accepted from the node the query was sent to
+		if ok && tx.addr == m.from {
+			select {
+			case tx.reply <- m:
+			default:
+			}
+		}
+	}
+}
+
+// handleQuery answers a query from another node.
+func (s *Server) handleQuery(m *message) {
+	id, ok := getId(m.Args, "id")
+	if !ok {
+		s.sendError(m, &KRPCError{Code: ErrorProtocol, Message: "missing node id"})
+		return
+	}
+
+	reply, krpcErr := s.answer(m)
+	if krpcErr != nil {
+		s.sendError(m, krpcErr)
+		return
+	}
+
+	reply["id"] = string(s.id[:])
+	s.send(&message{TransactionId: m.TransactionId, Type: typeResponse, Reply: reply}, m.from)
+
+	// Nodes that query us are alive, unless they are read-only (BEP 43)
+	if ro, _ := getInt(m.Args, "ro"); ro != 1 {
+		s.addNode(Node{ID: id, Addr: m.from})
+	}
+}
+
+// answer returns the response values for a query, or the error to send back.
+func (s *Server) answer(m *message) (map[string]any, *KRPCError) {
+	switch m.Method {
+	case "ping":
+		return map[string]any{}, nil
+
+	case "find_node":
+		target, ok := getId(m.Args, "target")
+		if !ok {
+			return nil, &KRPCError{Code: ErrorProtocol, Message: "missing target"}
+		}
+		reply := map[string]any{}
+		s.addClosestNodes(reply, target, m.Args)
+		return reply, nil
+
+	case "get_peers":
+		infoHash, ok := getId(m.Args, "info_hash")
+		if !ok {
+			return nil, &KRPCError{Code: ErrorProtocol, Message: "missing info_hash"}
+		}
+
+		reply := map[string]any{"token": s.tokens.token(m.from.Addr())}
+		s.addClosestNodes(reply, infoHash, m.Args)
+
+		if values := s.peers.get(infoHash, m.from.Addr().Is6()); len(values) > 0 {
+			list := make([]any, 0, len(values))
+			for _, p := range values {
+				list = append(list, p.EncodeCompact())
+			}
+			reply["values"] = list
+		}
+		return reply, nil
+
+	case "announce_peer":
+		infoHash, ok := getId(m.Args, "info_hash")
+		if !ok {
+			return nil, &KRPCError{Code: ErrorProtocol, Message: "missing info_hash"}
+		}
+
+		token, _ := getBytes(m.Args, "token")
+		if !s.tokens.valid(token, m.from.Addr()) {
+			return nil, &KRPCError{Code: ErrorProtocol, Message: "bad token"}
+		}
+
+		port := m.from.Port()
+		if impliedPort, _ := getInt(m.Args, "implied_port"); impliedPort == 0 {
+			argPort, ok := getInt(m.Args, "port")
+			if !ok || argPort <= 0 || argPort > 65535 {
+				return nil, &KRPCError{Code: ErrorProtocol, Message: "invalid port"}
+			}
+			port = uint16(argPort)
+		}
+
+		s.peers.add(infoHash, netip.AddrPortFrom(m.from.Addr(), port))
+		return map[string]any{}, nil
+
+	case "sample_infohashes":
+		target, ok := getId(m.Args, "target")
+		if !ok {
+			return nil, &KRPCError{Code: ErrorProtocol, Message: "missing target"}
+		}
+
+		infoHashes, num := s.peers.sample(maxSamples)
+		samples := make([]byte, 0, 20*len(infoHashes))
+		for _, infoHash := range infoHashes {
+			samples = append(samples, infoHash[:]...)
+		}
+
+		reply := map[string]any{
+			"interval": int(sampleInterval / time.Second),
+			"num":      num,
+			"samples":  samples,
+		}
+		s.addClosestNodes(reply, target, m.Args)
+		return reply, nil
+
+	case "get":
+		target, ok := getId(m.Args, "target")
+		if !ok {
+			return nil, &KRPCError{Code: ErrorProtocol, Message: "missing target"}
+		}
+
+		reply := map[string]any{"token": s.tokens.token(m.from.Addr())}
+		s.addClosestNodes(reply, target, m.Args)
+
+		item := s.items.get(target)
+		if item == nil {
+			return reply, nil
+		}
+
+		// The value of a mutable item is left out if the querying node already has its sequence number
+		if item.Mutable() {
+			reply["seq"] = int(item.Seq)
+			if seq, ok := getInt(m.Args, "seq"); ok && int64(seq) >= item.Seq {
+				return reply, nil
+			}
+			reply["k"] = []byte(item.K)
+			reply["sig"] = item.Sig
+		}
+		reply["v"] = item.V
+		return reply, nil
+
+	case "put":
+		token, _ := getBytes(m.Args, "token")
+		if !s.tokens.valid(token, m.from.Addr()) {
+			return nil, &KRPCError{Code: ErrorProtocol, Message: "bad token"}
+		}
+
+		salt, _ := getBytes(m.Args, "salt")
+		item, ok := itemFromDict(m.Args, salt)
+		if !ok {
+			return nil, &KRPCError{Code: ErrorProtocol, Message: "missing v"}
+		}
+
+		target := item.Target()
+		if krpcErr := item.verify(target); krpcErr != nil {
+			return nil, krpcErr
+		}
+
+		var cas *int64
+		if value, ok := getInt(m.Args, "cas"); ok {
+			casSeq := int64(value)
+			cas = &casSeq
+		}
+
+		if krpcErr := s.items.put(target, item, cas); krpcErr != nil {
+			return nil, krpcErr
+		}
+		return map[string]any{}, nil
+
+	default:
+		return nil, &KRPCError{Code: ErrorMethodUnknown, Message: "method unknown"}
+	}
+}
+
+/*
+addClosestNodes adds the K nodes closest to the target to the response, under nodes for IPv4 and nodes6 for IPv6.
+The families are the ones listed in the want argument, or the family of the server by default (BEP 32).
+The nodes of the other family come from the sibling server, if there is one.
+*/
+func (s *Server) addClosestNodes(reply map[string]any, target NodeID, args map[string]any) {
+	want4, want6 := !s.IPv6(), s.IPv6()
+	if want, ok := args["want"].([]any); ok {
+		want4, want6 = false, false
+		for _, w := range want {
+			switch family, _ := w.([]byte); string(family) {
+			case "n4":
+				want4 = true
+			case "n6":
+				want6 = true
+			}
+		}
+	}
+
+	if server := s.familyServer(false); want4 && server != nil {
+		reply["nodes"] = encodeNodes(server.table.closest(target, K))
+	}
+	if server := s.familyServer(true); want6 && server != nil {
+		reply["nodes6"] = encodeNodes6(server.table.closest(target, K))
+	}
+}
+
+// familyServer returns the server of the address family, which is either this server or its sibling.
+func (s *Server) familyServer(ipv6 bool) *Server {
+	if s.IPv6() == ipv6 {
+		return s
+	}
+	return s.sibling.Load()
+}
+
+// replyNodes decodes the nodes of our own address family in a response.
+func (s *Server) replyNodes(reply map[string]any) []Node {
+	if s.IPv6() {
+		compact, _ := getBytes(reply, "nodes6")
+		nodes, _ := decodeNodes6(compact)
+		return nodes
+	}
+
+	compact, _ := getBytes(reply, "nodes")
+	nodes, _ := decodeNodes(compact)
+	return nodes
+}
+
+// sendError answers the query with an error message.
+func (s *Server) sendError(m *message, krpcErr *KRPCError) {
+	s.send(&message{TransactionId: m.TransactionId, Type: typeError, Error: krpcErr}, m.from)
+}
+
+// maintain expires stored peers and refreshes the buckets that did not change for refreshInterval.
+func (s *Server) maintain() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.ctx.Done():
+			return
+		}
+
+		s.peers.expire()
+		s.items.expire()
+
+		if s.table.len() == 0 {
+			continue
+		}
+
+		for _, bucket := range s.table.staleBuckets(refreshInterval) {
+			ctx, cancel := context.WithTimeout(s.ctx, time.Minute)
+			s.FindNode(ctx, s.id.randomIdInBucket(bucket))
+			cancel()
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	mrand "math/rand/v2"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/JoelVCrasta/clover/peer"
+)
+
+const (
+	// peerTTL is how long an announced peer is stored without announcing again.
+	peerTTL = 30 * time.Minute
+
+	// maxStoredPeers bounds the peers stored per torrent, and maxStoredTorrents the torrents.
+	maxStoredPeers    = 1000
+	maxStoredTorrents = 10000
+
+	// maxValues is the number of peers returned by a single get_peers response.
+	maxValues = 50
+
+	// itemTTL is how long an item is stored without being put again (BEP 44).
+	itemTTL = 2 * time.Hour
+
+	// maxStoredItems bounds the items put to us.
+	maxStoredItems = 10000
+
+	// tokenRotation is how often the token secret changes, tokens stay valid for two rotations (BEP 5).
+	tokenRotation = 5 * time.Minute
+)
+
+// peerStore keeps the peers announced to us with announce_peer.
+type peerStore struct {
+	torrents map[NodeID]map[netip.AddrPort]time.Time
+	mu       sync.Mutex
+}
+
+func newPeerStore() *peerStore {
+	return &peerStore{torrents: make(map[NodeID]map[netip.AddrPort]time.Time)}
+}
+
+// add stores the peer of the torrent, unless the store is full.
+func (ps *peerStore) add(infoHash NodeID, addr netip.AddrPort) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	peers, ok := ps.torrents[infoHash]
+	if !ok {
+		if len(ps.torrents) >= maxStoredTorrents {
+			return
+		}
+		peers = make(map[netip.AddrPort]time.Time)
+		ps.torrents[infoHash] = peers
+	}
+
+	if _, ok := peers[addr]; !ok && len(peers) >= maxStoredPeers {
+		return
+	}
+	peers[addr] = time.Now()
+}
+
+// get returns up to maxValues random peers of the torrent whose address family matches.
+func (ps *peerStore) get(infoHash NodeID, ipv6 bool) []peer.Peer {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	var values []peer.Peer
+	for addr := range ps.torrents[infoHash] {
+		if len(values) >= maxValues {
+			break
+		}
+		if addr.Addr().Is6() != ipv6 {
+			continue
+		}
+		values = append(values, peer.NewPeer(addr.Addr().AsSlice(), addr.Port()))
+	}
+
+	return values
+}
+
+// sample returns up to n random info hashes of the stored torrents and the number of stored torrents.
+func (ps *peerStore) sample(n int) ([]NodeID, int) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	infoHashes := make([]NodeID, 0, len(ps.torrents))
+	for infoHash := range ps.torrents {
+		infoHashes = append(infoHashes, infoHash)
+	}
+	mrand.Shuffle(len(infoHashes), func(i, j int) {
+		infoHashes[i], infoHashes[j] = infoHashes[j], infoHashes[i]
+	})
+
+	return infoHashes[:min(n, len(infoHashes))], len(infoHashes)
+}
+
+// expire drops the peers that did not announce again within peerTTL.
+func (ps *peerStore) expire() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	deadline := time.Now().Add(-peerTTL)
+	for infoHash, peers := range ps.torrents {
+		for addr, announcedAt := range peers {
+			if announcedAt.Before(deadline) {
+				delete(peers, addr)
+			}
+		}
+		if len(peers) == 0 {
+			delete(ps.torrents, infoHash)
+		}
+	}
+}
+
+// storedItem is an item put to us with the time it was put.
+type storedItem struct {
+	item     *Item
+	storedAt time.Time
+}
+
+// itemStore keeps the items put to us with the put query (BEP 44).
+type itemStore struct {
+	items map[NodeID]*storedItem
+	mu    sync.Mutex
+}
+
+func newItemStore() *itemStore {
+	return &itemStore{items: make(map[NodeID]*storedItem)}
+}
+
+/*
+put stores the verified item under the target. A mutable item only replaces the stored one
+if its sequence number is higher, or equal with the same signature, which just refreshes it.
+If cas is set, it must be the sequence number of the stored item.
+*/
+func (is *itemStore) put(target NodeID, item *Item, cas *int64) *KRPCError {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	existing, ok := is.items[target]
+	if !ok && len(is.items) >= maxStoredItems {
+		return &KRPCError{Code: ErrorServer, Message: "storage full"}
+	}
+
+	if ok && item.Mutable() {
+		if cas != nil && *cas != existing.item.Seq {
+			return &KRPCError{Code: ErrorCASMismatch, Message: "CAS mismatch, re-read value and try again"}
+		}
+		if item.Seq < existing.item.Seq || (item.Seq == existing.item.Seq && !bytes.Equal(item.Sig, existing.item.Sig)) {
+			return &KRPCError{Code: ErrorSeqTooLow, Message: "sequence number less than current"}
+		}
+	}
+
+	is.items[target] = &storedItem{item: item, storedAt: time.Now()}
+	return nil
+}
+
+// get returns the item stored under the target, or nil.
+func (is *itemStore) get(target NodeID) *Item {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	if stored, ok := is.items[target]; ok {
+		return stored.item
+	}
+	return nil
+}
+
+// expire drops the items that were not put again within itemTTL.
+func (is *itemStore) expire() {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	deadline := time.Now().Add(-itemTTL)
+	for target, stored := range is.items {
+		if stored.storedAt.Before(deadline) {
+			delete(is.items, target)
+		}
+	}
+}
+
+/*
+tokenManager hands out the tokens required by announce_peer and put.
+A token is the hash of the querying IP and a secret which rotates every tokenRotation,
+and tokens of the current and the previous secret are accepted.
+*/
+type tokenManager struct {
+	secret     [16]byte
+	prevSecret [16]byte
+	rotatedAt  time.Time
+	mu         sync.Mutex
+}
+
+func newTokenManager() *tokenManager {
+	tm := &tokenManager{rotatedAt: time.Now()}
+	rand.Read(tm.secret[:])
+	tm.prevSecret = tm.secret
+
+	return tm
+}
+
+// token returns the current token for the IP.
+func (tm *tokenManager) token(ip netip.Addr) []byte {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	tm.rotate()
+	return tokenFor(tm.secret, ip)
+}
+
+// valid reports whether the token was handed out to the IP recently.
+func (tm *tokenManager) valid(token []byte, ip netip.Addr) bool {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	tm.rotate()
+	return subtle.ConstantTimeCompare(token, tokenFor(tm.secret, ip)) == 1 ||
+		subtle.ConstantTimeCompare(token, tokenFor(tm.prevSecret, ip)) == 1
+}
+
+// rotate replaces the secret once it is older than tokenRotation.
+func (tm *tokenManager) rotate() {
+	if time.Since(tm.rotatedAt) < tokenRotation {
+		return
+	}
+
+	tm.prevSecret = tm.secret
+	rand.Read(tm.secret[:])
+	tm.rotatedAt = time.Now()
+}
+
+func tokenFor(secret [16]byte, ip netip.Addr) []byte {
+	h := sha1.New()
+	h.Write(secret[:])
+	h.Write(ip.AsSlice())
+
+	return h.Sum(nil)[:8]
+}
@@ -0,0 +1,248 @@
+package dht
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// K is the size of a bucket and the number of closest nodes a lookup converges on (BEP 5).
+	K = 8
+
+	// maxFailures is the number of unanswered queries after which a node is considered bad.
+	maxFailures = 2
+
+	// questionableAfter is how long a node stays good without being heard from (BEP 5).
+	questionableAfter = 15 * time.Minute
+)
+
+// tableNode is a node in the routing table with its health.
+type tableNode struct {
+	Node
+	lastSeen time.Time
+	failures int
+}
+
+// good reports whether the node responded recently and did not fail since.
+func (n *tableNode) good() bool {
+	return n.failures == 0 && time.Since(n.lastSeen) < questionableAfter
+}
+
+/*
+routingTable keeps up to K nodes per bucket, where bucket i holds the nodes that share
+exactly i leading bits with our own ID. Buckets close to our ID are rarely full,
+so this is equivalent to splitting the bucket our own ID falls in.
+*/
+type routingTable struct {
+	self        NodeID
+	buckets     [160][]*tableNode
+	lastChanged [160]time.Time
+	mu          sync.Mutex
+}
+
+func newRoutingTable(self NodeID) *routingTable {
+	t := &routingTable{self: self}
+
+	now := time.Now()
+	for i := range t.lastChanged {
+		t.lastChanged[i] = now
+	}
+
+	return t
+}
+
+/*
+add inserts the node or refreshes it if it is already known, and reports whether it is in the table.
+If its bucket is full, a bad node is replaced. Otherwise the least recently seen questionable node
+is returned, which the caller can ping and replace if it does not respond.
+*/
+func (t *routingTable) add(n Node) (bool, *Node) {
+	if n.ID == t.self || !validAddr(n.Addr) {
+		return false, nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	i := t.self.prefixLen(n.ID)
+	bucket := t.buckets[i]
+
+	for _, existing := range bucket {
+		if existing.ID == n.ID {
+			existing.Addr = n.Addr
+			existing.lastSeen = time.Now()
+			existing.failures = 0
+			t.lastChanged[i] = time.Now()
+			return true, nil
+		}
+	}
+
+	// Another node ID claiming the same address replaces nothing
+	for _, existing := range bucket {
+		if existing.Addr == n.Addr {
+			return false, nil
+		}
+	}
+
+	entry := &tableNode{Node: n, lastSeen: time.Now()}
+	if len(bucket) < K {
+		t.buckets[i] = append(bucket, entry)
+		t.lastChanged[i] = time.Now()
+		return true, nil
+	}
+
+	var oldest *tableNode
+	for j, existing := range bucket {
+		if existing.failures >= maxFailures {
+			bucket[j] = entry
+			t.lastChanged[i] = time.Now()
+			return true, nil
+		}
+		if !existing.good() && (oldest == nil || existing.lastSeen.Before(oldest.lastSeen)) {
+			oldest = existing
+		}
+	}
+
+	if oldest == nil {
+		return false, nil
+	}
+
+	stale := oldest.Node
+	return false, &stale
+}
+
+// replace swaps the old node for the new one if the old node is still in the table.
+func (t *routingTable) replace(old NodeID, n Node) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	i := t.self.prefixLen(old)
+	for j, existing := range t.buckets[i] {
+		if existing.ID == old {
+			t.buckets[i][j] = &tableNode{Node: n, lastSeen: time.Now()}
+			t.lastChanged[i] = time.Now()
+			return true
+		}
+	}
+
+	return false
+}
+
+// markFailed records an unanswered query to the node at the address.
+func (t *routingTable) markFailed(addr netip.AddrPort) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, bucket := range t.buckets {
+		for _, existing := range bucket {
+			if existing.Addr == addr {
+				existing.failures++
+				return
+			}
+		}
+	}
+}
+
+// closest returns up to n nodes that are not bad, ordered by their distance to the target.
+func (t *routingTable) closest(target NodeID, n int) []Node {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var nodes []Node
+	for _, bucket := range t.buckets {
+		for _, existing := range bucket {
+			if existing.failures < maxFailures {
+				nodes = append(nodes, existing.Node)
+			}
+		}
+	}
+
+	sortByDistance(target, nodes)
+	return nodes[:min(n, len(nodes))]
+}
+
+// contains reports whether the node with the ID is in the table.
+func (t *routingTable) contains(id NodeID) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, existing := range t.buckets[t.self.prefixLen(id)] {
+		if existing.ID == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nodes returns every node in the table.
+func (t *routingTable) nodes() []Node {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var nodes []Node
+	for _, bucket := range t.buckets {
+		for _, existing := range bucket {
+			nodes = append(nodes, existing.Node)
+		}
+	}
+
+	return nodes
+}
+
+// goodNodes returns the nodes in the table that responded recently.
+func (t *routingTable) goodNodes() []Node {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var nodes []Node
+	for _, bucket := range t.buckets {
+		for _, existing := range bucket {
+			if existing.good() {
+				nodes = append(nodes, existing.Node)
+			}
+		}
+	}
+
+	return nodes
+}
+
+// len returns the number of nodes in the table.
+func (t *routingTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	count := 0
+	for _, bucket := range t.buckets {
+		count += len(bucket)
+	}
+
+	return count
+}
+
+/*
+staleBuckets returns the indexes of the buckets that did not change for the given duration,
+up to the deepest non-empty bucket, as there is nothing to find beyond it.
+*/
+func (t *routingTable) staleBuckets(age time.Duration) []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	deepest := 0
+	for i, bucket := range t.buckets {
+		if len(bucket) > 0 {
+			deepest = i
+		}
+	}
+
+	var stale []int
+	for i := 0; i <= deepest; i++ {
+		if time.Since(t.lastChanged[i]) >= age {
+			stale = append(stale, i)
+			t.lastChanged[i] = time.Now()
+		}
+	}
+
+	return stale
+}
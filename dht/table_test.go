@@ -0,0 +1,90 @@
+package dht
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func testNode(id NodeID, port uint16) Node {
+	return Node{ID: id, Addr: netip.AddrPortFrom(netip.MustParseAddr("10.0.0.1"), port)}
+}
+
+func TestRoutingTableFullBucket(t *testing.T) {
+	var self NodeID
+	table := newRoutingTable(self)
+
+	// Every ID with the first bit set falls into bucket 0
+	for i := range K {
+		id := RandomNodeID()
+		id[0] |= 0x80
+		if added, _ := table.add(testNode(id, uint16(1000+i))); !added {
+			t.Fatalf("node %d was not added", i)
+		}
+	}
+
+	id := RandomNodeID()
+	id[0] |= 0x80
+	newcomer := testNode(id, 2000)
+
+	if added, stale := table.add(newcomer); added || stale != nil {
+		t.Fatalf("full bucket of good nodes accepted a new node, stale %v", stale)
+	}
+
+	// Once a node turns questionable, it is offered for replacement
+	table.buckets[0][3].lastSeen = time.Now().Add(-time.Hour)
+	_, stale := table.add(newcomer)
+	if stale == nil || stale.ID != table.buckets[0][3].ID {
+		t.Fatalf("expected the questionable node to be returned, got %v", stale)
+	}
+
+	// Bad nodes are replaced right away
+	for range maxFailures {
+		table.markFailed(table.buckets[0][5].Addr)
+	}
+	if added, _ := table.add(newcomer); !added || table.buckets[0][5].ID != newcomer.ID {
+		t.Error("bad node was not replaced")
+	}
+	if table.len() != K {
+		t.Errorf("expected %d nodes, got %d", K, table.len())
+	}
+}
+
+func TestRoutingTableClosest(t *testing.T) {
+	self := RandomNodeID()
+	table := newRoutingTable(self)
+
+	for i := range 100 {
+		table.add(testNode(RandomNodeID(), uint16(1000+i)))
+	}
+
+	target := RandomNodeID()
+	closest := table.closest(target, K)
+	if len(closest) != K {
+		t.Fatalf("expected %d nodes, got %d", K, len(closest))
+	}
+
+	for _, n := range table.nodes() {
+		if target.closer(n.ID, closest[K-1].ID) && !containsNode(closest, n.ID) {
+			t.Errorf("node %s is closer than the returned nodes", n.ID)
+		}
+	}
+}
+
+func TestRandomIdInBucket(t *testing.T) {
+	self := RandomNodeID()
+	for _, prefixLen := range []int{0, 1, 7, 8, 63, 159} {
+		if got := self.prefixLen(self.randomIdInBucket(prefixLen)); got != prefixLen {
+			t.Errorf("expected prefix length %d, got %d", prefixLen, got)
+		}
+	}
+}
+
+func containsNode(nodes []Node, id NodeID) bool {
+	for _, n := range nodes {
+		if n.ID == id {
+			return true
+		}
+	}
+	return false
+}
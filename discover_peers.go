@@ -2,37 +2,269 @@ package torrent
 
 import (
 	"context"
+	"log"
+	"sync"
 
+	"github.com/JoelVCrasta/clover/config"
 	"github.com/JoelVCrasta/clover/dht"
+	"github.com/JoelVCrasta/clover/lsd"
+	"github.com/JoelVCrasta/clover/metainfo"
 	"github.com/JoelVCrasta/clover/peer"
+	"github.com/JoelVCrasta/clover/pex"
 	"github.com/JoelVCrasta/clover/tracker"
 )
 
-// StartPeerDiscovery is used start the trackers and dht to seach for peers
-// and merge them into a single channel
-func StartPeerDiscovery(ctx context.Context, announceList []string, infoHash [20]byte, peerId [20]byte) (<-chan peer.Peer, error) {
-	tm := tracker.NewTrackerManager(ctx, announceList, infoHash, peerId)
-	d, err := dht.NewDHT(ctx, infoHash)
-	if err != nil {
-		return nil, err
+// The names of the built-in peer sources, which tag the peers they discover.
+const (
+	SourceTracker = "tracker"
+	SourceDHT     = "dht"
+	SourcePEX     = "pex"
+	SourceLSD     = "lsd"
+)
+
+// PeerDiscovery holds the running peer sources of a torrent and the merged stream of their peers.
+type PeerDiscovery struct {
+	Peers <-chan peer.Peer
+
+	merger    *peer.Merger
+	tm        *tracker.TrackerManager
+	d         *dht.DHT
+	px        *pex.PeerExchange
+	ls        *lsd.Service
+	ctx       context.Context
+	shared    chan struct{} // closed once the metadata is known, which starts the peer exchange and the local service discovery
+	shareOnce sync.Once
+	stopped   bool
+	stopOnce  sync.Once
+	mu        sync.Mutex
+}
+
+// StartPeerDiscovery is used start the trackers, dht, peer exchange and local service discovery of the torrent
+// to seach for peers and merge them into a single channel, with the peers on the local network first.
+// The sources of the embedder, such as a static list of peers, are started along with them.
+// The trackers are sent the statistics of the stats provider, which may be nil until the download starts.
+// Private torrents do not use the peer exchange and the local service discovery, so for a magnet link they
+// only start once MetadataFetched says the torrent is not private.
+// The trackers and the dht can be turned off in the config, to only use the given sources.
+func StartPeerDiscovery(ctx context.Context, tr *metainfo.Torrent, peerId [20]byte, stats tracker.StatsProvider, sources ...peer.PeerSource) (_ *PeerDiscovery, err error) {
+	merger := peer.NewMerger()
+	pd := &PeerDiscovery{
+		merger: merger,
+		ctx:    ctx,
+		shared: make(chan struct{}),
 	}
 
-	tC, err := tm.StartTracker()
-	if err != nil {
-		return nil, err
+	// Nothing is left running when the discovery fails to start
+	defer func() {
+		if err != nil {
+			pd.teardown()
+		}
+	}()
+
+	if config.Config.UseTrackers {
+		pd.tm = tracker.NewTrackerManager(ctx, tr.AnnounceList, tr.InfoHash, peerId)
+		pd.tm.SetStatsProvider(stats)
+		if err := merger.Register(peer.NewSource(SourceTracker, pd.tm.StartTracker, pd.tm.StopTracker), false); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Config.UseDHT {
+		pd.d, err = dht.NewDHT(ctx, tr.InfoHash, tr.Nodes)
+		if err != nil {
+			return nil, err
+		}
+		if err := merger.Register(peer.NewSource(SourceDHT, pd.d.StartDHT, pd.d.StopDHT), false); err != nil {
+			return nil, err
+		}
+	}
+
+	// Without the metadata, the torrent may still turn out to be private
+	metadataKnown := tr.InfoBytes != nil
+	if !metadataKnown || !tr.Info.Private {
+		startPEX := func() (<-chan peer.Peer, error) {
+			return pd.afterMetadata(func() <-chan peer.Peer {
+				if pd.px == nil {
+					return nil
+				}
+				return pd.px.Peers()
+			}), nil
+		}
+		if err := merger.Register(peer.NewSource(SourcePEX, startPEX, nil), false); err != nil {
+			return nil, err
+		}
+
+		if config.Config.LocalServiceDiscovery {
+			startLSD := func() (<-chan peer.Peer, error) {
+				return pd.afterMetadata(func() <-chan peer.Peer {
+					if pd.ls == nil {
+						return nil
+					}
+					return pd.ls.Add(tr.InfoHash)
+				}), nil
+			}
+			if err := merger.Register(peer.NewSource(SourceLSD, startLSD, pd.closeLSD), true); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, source := range sources {
+		if err := merger.Register(source, false); err != nil {
+			return nil, err
+		}
+	}
+
+	if metadataKnown {
+		pd.MetadataFetched(tr)
 	}
-	dhtC, err := d.StartDHT()
+
+	peers, err := merger.Start(ctx)
 	if err != nil {
 		return nil, err
 	}
-
-	pC := peer.MergeStream(ctx, tC, dhtC)
+	pd.Peers = peers
 
 	go func() {
 		<-ctx.Done()
-		tm.StopTracker()
-		d.StopDHT()
+		pd.Stop()
 	}()
 
-	return pC, nil
+	return pd, nil
+}
+
+/*
+MetadataFetched starts the peer exchange and the local service discovery once the verified metadata of a magnet link
+says the torrent is not private. A torrent file is known from the start, so its discovery calls it right away.
+*/
+func (pd *PeerDiscovery) MetadataFetched(tr *metainfo.Torrent) {
+	pd.shareOnce.Do(func() {
+		pd.mu.Lock()
+		if !tr.Info.Private && !pd.stopped {
+			pd.px = pex.NewPeerExchange(pd.ctx, len(tr.PiecesHash))
+
+			if config.Config.LocalServiceDiscovery {
+				// The local network is a bonus, so the download goes on without it
+				ls, err := lsd.NewService(pd.ctx, config.Config.Port)
+				if err != nil {
+					log.Printf("%v", err)
+				} else {
+					pd.ls = ls
+				}
+			}
+		}
+		pd.mu.Unlock()
+
+		close(pd.shared)
+	})
+}
+
+// afterMetadata returns the peers of the stream get returns once the metadata is known, or none if it returns nil.
+func (pd *PeerDiscovery) afterMetadata(get func() <-chan peer.Peer) <-chan peer.Peer {
+	peerChan := make(chan peer.Peer)
+
+	go func() {
+		defer close(peerChan)
+
+		select {
+		case <-pd.shared:
+		case <-pd.ctx.Done():
+			return
+		}
+
+		pd.mu.Lock()
+		source := get()
+		pd.mu.Unlock()
+		if source == nil {
+			return
+		}
+
+		for {
+			select {
+			case p, ok := <-source:
+				if !ok {
+					return
+				}
+				select {
+				case peerChan <- p:
+				case <-pd.ctx.Done():
+					return
+				}
+			case <-pd.ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return peerChan
+}
+
+// closeLSD closes the local service discovery, if it was started.
+func (pd *PeerDiscovery) closeLSD() {
+	pd.mu.Lock()
+	ls := pd.ls
+	pd.mu.Unlock()
+
+	if ls != nil {
+		ls.Close()
+	}
+}
+
+// teardown stops the peer sources of a discovery that failed to start, whether or not the merger started them.
+func (pd *PeerDiscovery) teardown() {
+	pd.mu.Lock()
+	pd.stopped = true
+	pd.mu.Unlock()
+
+	if pd.tm != nil {
+		pd.tm.StopTracker()
+	}
+	if pd.d != nil {
+		pd.d.StopDHT()
+	}
+	pd.closeLSD()
+}
+
+// SetStatsProvider sets the statistics sent to the trackers, for discovery started before the download,
+// such as while the metadata of a magnet link is downloaded.
+func (pd *PeerDiscovery) SetStatsProvider(stats tracker.StatsProvider) {
+	if pd.tm != nil {
+		pd.tm.SetStatsProvider(stats)
+	}
+}
+
+// Completed tells the trackers that the download finished, so they are sent the completed event right away.
+func (pd *PeerDiscovery) Completed() {
+	if pd.tm != nil {
+		pd.tm.Completed()
+	}
+}
+
+// Counts returns the number of peers each source discovered so far, by the name of the source.
+func (pd *PeerDiscovery) Counts() map[string]int {
+	return pd.merger.Counts()
+}
+
+// DHT returns the DHT node of the torrent, which learns new nodes from the PORT messages of the peers,
+// or nil if the DHT is turned off.
+func (pd *PeerDiscovery) DHT() *dht.DHT {
+	return pd.d
+}
+
+// PeerExchange returns the peer exchange of the torrent, or nil for private torrents and before the metadata is known.
+func (pd *PeerDiscovery) PeerExchange() *pex.PeerExchange {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	return pd.px
+}
+
+// Stop stops the peer sources. It blocks until the trackers have been told that we stopped.
+func (pd *PeerDiscovery) Stop() {
+	pd.stopOnce.Do(func() {
+		pd.mu.Lock()
+		pd.stopped = true
+		pd.mu.Unlock()
+
+		pd.merger.Stop()
+	})
 }
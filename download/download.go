@@ -8,6 +8,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"net/netip"
 	"os"
 	"slices"
 	"strings"
@@ -19,8 +20,10 @@ import (
 
 	"github.com/JoelVCrasta/clover/client"
 	"github.com/JoelVCrasta/clover/config"
+	"github.com/JoelVCrasta/clover/dht"
 	"github.com/JoelVCrasta/clover/message"
 	"github.com/JoelVCrasta/clover/metainfo"
+	"github.com/JoelVCrasta/clover/tracker"
 )
 
 const (
@@ -30,11 +33,19 @@ const (
 
 type DownloadManager struct {
 	client           *client.Client
+	dht              *dht.DHT
+	sources          SourceCounter
+	onComplete       func()
 	torrent          metainfo.Torrent
 	todoPieces       []int
 	downloadedPieces []bool
+	downloadedBytes  int64 // every received block, including the ones of failed pieces
+	verifiedBytes    int64 // bytes of the pieces written to disk
 
-	stats *Stats
+	stats     *Stats
+	connected map[string]int // the peers that connected, by the name of their source
+	active    map[*client.ActivePeer]struct{}
+	failures  map[string]int // the failed pieces and requests, by the client of the peer
 
 	mu     sync.Mutex
 	ctx    context.Context
@@ -62,9 +73,32 @@ type Stats struct {
 	Total       int
 	PeerCount   int32
 	TimeElapsed time.Duration
+	Sources     []SourceStats
+	Blocked     uint64 // the peers blocked by the IP filter
+	Pool        client.PoolStats
+	Clients     []ClientStats
 }
 
-func NewDownloadManager(ctx context.Context, torrent metainfo.Torrent, client *client.Client) *DownloadManager {
+// ClientStats are the connected peers running a client and how often they failed.
+type ClientStats struct {
+	Name     string
+	Peers    int
+	Failures int
+}
+
+// SourceStats are the peers a peer source discovered and how many of them connected.
+type SourceStats struct {
+	Name       string
+	Discovered int
+	Connected  int
+}
+
+// SourceCounter reports the number of peers each peer source discovered, by the name of the source.
+type SourceCounter interface {
+	Counts() map[string]int
+}
+
+func NewDownloadManager(ctx context.Context, torrent metainfo.Torrent) *DownloadManager {
 	ctx, cancel := context.WithCancel(ctx)
 
 	todoPieces := make([]int, len(torrent.PiecesHash))
@@ -73,10 +107,12 @@ func NewDownloadManager(ctx context.Context, torrent metainfo.Torrent, client *c
 	}
 
 	return &DownloadManager{
-		client:           client,
 		torrent:          torrent,
 		todoPieces:       todoPieces,
 		downloadedPieces: make([]bool, len(torrent.PiecesHash)),
+		connected:        make(map[string]int),
+		active:           make(map[*client.ActivePeer]struct{}),
+		failures:         make(map[string]int),
 		mu:               sync.Mutex{},
 		ctx:              ctx,
 		cancel:           cancel,
@@ -89,11 +125,28 @@ func NewDownloadManager(ctx context.Context, torrent metainfo.Torrent, client *c
 	}
 }
 
+// SetDHT sets the DHT that learns the nodes the peers send in their PORT messages.
+func (dm *DownloadManager) SetDHT(d *dht.DHT) {
+	dm.dht = d
+}
+
+// SetSourceCounter sets the peer sources whose discovered peers are shown in the stats.
+func (dm *DownloadManager) SetSourceCounter(sc SourceCounter) {
+	dm.sources = sc
+}
+
+// SetOnComplete sets the function called once every piece is written, such as to send the trackers the completed event.
+func (dm *DownloadManager) SetOnComplete(fn func()) {
+	dm.onComplete = fn
+}
+
 /*
-StartDownload begins the download process by distributing work to active peers.
+StartDownload begins the download process by distributing work to the active peers of the client.
 The completed pieces are written to disk using the PieceWriter.
 */
-func (dm *DownloadManager) StartDownload(apC <-chan *client.ActivePeer) {
+func (dm *DownloadManager) StartDownload(c *client.Client, apC <-chan *client.ActivePeer) {
+	dm.client = c
+
 	completedPieces := make(chan *completedPiece, 50)
 	var wg sync.WaitGroup
 
@@ -173,9 +226,13 @@ loop:
 
 			dm.mu.Lock()
 			dm.stats.Done++
+			dm.verifiedBytes += int64(cp.length)
 			if dm.stats.Done == dm.stats.Total {
 				completed = true
 				dm.mu.Unlock()
+				if dm.onComplete != nil {
+					dm.onComplete()
+				}
 				dm.cancel()
 			} else {
 				dm.mu.Unlock()
@@ -235,8 +292,20 @@ func (dm *DownloadManager) peerDownload(ap *client.ActivePeer, cp chan *complete
 	defer func() {
 		atomic.AddInt32(&dm.stats.PeerCount, -1)
 		ap.Disconnect()
+
+		dm.mu.Lock()
+		delete(dm.active, ap)
+		dm.mu.Unlock()
 	}()
 
+	// The peer has no pieces until its bitfield, have or have all messages say otherwise
+	ap.Bitfield = make(client.Bitfield, (dm.stats.Total+7)/8)
+
+	dm.mu.Lock()
+	dm.connected[ap.Peer.Source]++
+	dm.active[ap] = struct{}{}
+	dm.mu.Unlock()
+
 	_ = ap.SendInterested()
 
 	for {
@@ -306,10 +375,15 @@ func (dm *DownloadManager) peerDownload(ap *client.ActivePeer, cp chan *complete
 
 				if err.Error() != "peer choked" {
 					ap.FailedCount++
+
+					dm.mu.Lock()
+					dm.failures[ap.GetClient().String()]++
+					dm.mu.Unlock()
 				}
 
-				// If the peer has failed too many times, disconnect
+				// If the peer has failed too many times, disconnect and never connect to it again
 				if ap.FailedCount >= config.Config.MaxFailedRetries {
+					dm.client.BanPeer(ap.Peer)
 					return
 				}
 				continue
@@ -344,7 +418,7 @@ func (wp *workPiece) downloadPiece(ap *client.ActivePeer, dm *DownloadManager) e
 		}
 		dm.mu.Unlock()
 
-		for !ap.IsChoked() && wp.backlog < MAX_BACKLOG && wp.requestedBytes < wp.length {
+		for !ap.IsChoked() && wp.backlog < maxBacklog(ap) && wp.requestedBytes < wp.length {
 			blockSize := MAX_BLOCK_SIZE
 			remaining := wp.length - wp.requestedBytes
 			if remaining < blockSize {
@@ -374,6 +448,14 @@ func (wp *workPiece) downloadPiece(ap *client.ActivePeer, dm *DownloadManager) e
 	return nil
 }
 
+// maxBacklog returns the number of requests to keep in flight to the peer, at most the reqq of its extended handshake.
+func maxBacklog(ap *client.ActivePeer) int {
+	if eh := ap.GetExtendedHandshake(); eh != nil && eh.Reqq > 0 {
+		return min(MAX_BACKLOG, eh.Reqq)
+	}
+	return MAX_BACKLOG
+}
+
 /*
 calculatePieceLength calculates the length of a piece based on its index.
 It returns the specifies piece length, if its the last piece, it returns the remaining length.
@@ -431,6 +513,14 @@ func (dm *DownloadManager) handleMessage(ap *client.ActivePeer, wp *workPiece) e
 		}
 		ap.Bitfield = bf
 
+	case message.HaveAllId:
+		for i := range dm.stats.Total {
+			ap.Bitfield.Set(i)
+		}
+
+	case message.HaveNoneId:
+		clear(ap.Bitfield)
+
 	case message.PieceId:
 		if wp == nil {
 			return nil
@@ -441,22 +531,143 @@ func (dm *DownloadManager) handleMessage(ap *client.ActivePeer, wp *workPiece) e
 		}
 		copy(wp.buf[offset:], block)
 		wp.downloadedBytes += len(block)
+		atomic.AddInt64(&dm.downloadedBytes, int64(len(block)))
 		if wp.backlog > 0 {
 			wp.backlog--
 		}
 
 	case message.PortId:
-		return nil
+		port, err := msg.DecodePort()
+		if err != nil {
+			return err
+		}
+		dm.addDHTNode(ap, port)
+
+	case message.ExtendedId:
+		// The extended handshake and the messages of the registered extensions are up to the client
+		return dm.client.HandleExtended(ap, msg)
 	}
 
 	return nil
 }
 
+/*
+addDHTNode pings the DHT node of the peer in the background and adds it to the routing table if it responds.
+Only the first PORT message of a connection is followed, so a peer cannot start a ping for every message it sends.
+*/
+func (dm *DownloadManager) addDHTNode(ap *client.ActivePeer, port uint16) {
+	if dm.dht == nil || port == 0 || !ap.ReceivedPort() {
+		return
+	}
+
+	go dm.dht.AddNode(netip.AddrPortFrom(ap.Peer.AddrPort().Addr(), port))
+}
+
 func (dm *DownloadManager) Stats() *Stats {
+	dm.mu.Lock()
+	defer dm.mu.Unlock()
+
 	return &Stats{
 		Done:      dm.stats.Done,
 		Total:     dm.stats.Total,
 		PeerCount: atomic.LoadInt32(&dm.stats.PeerCount),
+		Sources:   dm.sourceStats(),
+		Blocked:   dm.blockedPeers(),
+		Pool:      dm.poolStats(),
+		Clients:   dm.clientStats(),
+	}
+}
+
+// clientStats returns the connected peers and failures of every client, most peers first.
+// The caller must hold dm.mu.
+func (dm *DownloadManager) clientStats() []ClientStats {
+	byName := make(map[string]*ClientStats)
+	get := func(name string) *ClientStats {
+		if _, ok := byName[name]; !ok {
+			byName[name] = &ClientStats{Name: name}
+		}
+		return byName[name]
+	}
+
+	for ap := range dm.active {
+		get(ap.GetClient().String()).Peers++
+	}
+	for name, count := range dm.failures {
+		get(name).Failures = count
+	}
+
+	stats := make([]ClientStats, 0, len(byName))
+	for _, cs := range byName {
+		stats = append(stats, *cs)
+	}
+	slices.SortFunc(stats, func(a, b ClientStats) int {
+		if a.Peers != b.Peers {
+			return b.Peers - a.Peers
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return stats
+}
+
+// poolStats returns the number of peers in each state of the client's pool.
+func (dm *DownloadManager) poolStats() client.PoolStats {
+	if dm.client == nil {
+		return client.PoolStats{}
+	}
+	return dm.client.Pool().Stats()
+}
+
+// blockedPeers returns the number of peers the IP filter of the client blocked.
+func (dm *DownloadManager) blockedPeers() uint64 {
+	if dm.client == nil {
+		return 0
+	}
+	return dm.client.BlockedPeers()
+}
+
+// sourceStats returns the discovered and connected peers of every peer source, sorted by name.
+// The caller must hold dm.mu.
+func (dm *DownloadManager) sourceStats() []SourceStats {
+	byName := make(map[string]*SourceStats)
+	get := func(name string) *SourceStats {
+		if name == "" {
+			name = "unknown"
+		}
+		if _, ok := byName[name]; !ok {
+			byName[name] = &SourceStats{Name: name}
+		}
+		return byName[name]
+	}
+
+	if dm.sources != nil {
+		for name, count := range dm.sources.Counts() {
+			get(name).Discovered = count
+		}
+	}
+	for name, count := range dm.connected {
+		get(name).Connected += count
+	}
+
+	stats := make([]SourceStats, 0, len(byName))
+	for _, ss := range byName {
+		stats = append(stats, *ss)
+	}
+	slices.SortFunc(stats, func(a, b SourceStats) int { return strings.Compare(a.Name, b.Name) })
+
+	return stats
+}
+
+// AnnounceStats reports the byte counters of the download to the trackers.
+func (dm *DownloadManager) AnnounceStats() tracker.AnnounceStats {
+	dm.mu.Lock()
+	left := int64(dm.torrent.Info.Length) - dm.verifiedBytes
+	dm.mu.Unlock()
+
+	return tracker.AnnounceStats{
+		Downloaded: uint64(atomic.LoadInt64(&dm.downloadedBytes)),
+		Left:       uint64(max(left, 0)),
+		Uploaded:   0, // clover is leech-only
 	}
 }
 
@@ -478,6 +689,33 @@ func (dm *DownloadManager) renderProgress() {
 		dm.stats.Done, dm.stats.Total, atomic.LoadInt32(&dm.stats.PeerCount),
 		dm.stats.TimeElapsed))
 
+	if sources := dm.sourceStats(); len(sources) > 0 {
+		parts := make([]string, len(sources))
+		for i, ss := range sources {
+			parts[i] = fmt.Sprintf("%s %d/%d", ss.Name, ss.Connected, ss.Discovered)
+		}
+		b.WriteString(fmt.Sprintf("Sources (connected/discovered): %s\n\n", strings.Join(parts, " | ")))
+	}
+	if clients := dm.clientStats(); len(clients) > 0 {
+		parts := make([]string, 0, len(clients))
+		for _, cs := range clients {
+			if cs.Peers > 0 {
+				parts = append(parts, fmt.Sprintf("%s %d", cs.Name, cs.Peers))
+			}
+		}
+		if len(parts) > 0 {
+			b.WriteString(fmt.Sprintf("Clients: %s\n\n", strings.Join(parts, " | ")))
+		}
+	}
+
+	pool := dm.poolStats()
+	b.WriteString(fmt.Sprintf("Pool: %d candidates | %d connecting | %d failed | %d banned\n\n",
+		pool.Candidates, pool.Connecting, pool.Failed, pool.Banned))
+
+	if blocked := dm.blockedPeers(); blocked > 0 {
+		b.WriteString(fmt.Sprintf("Blocked by the IP filter: %d\n\n", blocked))
+	}
+
 	width, _, err := term.GetSize(int(os.Stdout.Fd()))
 	if err != nil {
 		width = 32
@@ -502,6 +740,6 @@ func (dm *DownloadManager) renderProgress() {
 	if progress < 1.0 {
 		b.WriteString("\n\nUse Ctrl+C to stop.")
 	}
-	
+
 	fmt.Print(b.String())
-}
\ No newline at end of file
+}
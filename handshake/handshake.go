@@ -1,6 +1,8 @@
 package handshake
 
 import (
+	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"time"
@@ -8,6 +10,14 @@ import (
 	"github.com/JoelVCrasta/clover/config"
 )
 
+const (
+	// reservedDHT is the bit of the last reserved byte that signals DHT support (BEP 5).
+	reservedDHT = 0x01
+
+	// reservedExtensions is the bit of the sixth reserved byte that signals the extension protocol (BEP 10).
+	reservedExtensions = 0x10
+)
+
 type Handshake struct {
 	Pstrlen  byte
 	Pstr     string
@@ -18,19 +28,17 @@ type Handshake struct {
 
 /*
 NewHandshake establishes a TCP connection to a peer and performs the BitTorrent handshake.
+IPv4 (including IPv4-mapped) addresses are dialed over tcp4 and IPv6 addresses over tcp6.
 It sends a handshake request containing the info hash and peer ID, and waits for a response.
 It returns the connection, the handshake response, and any error encountered.
 */
 func SendHandshake(infoHash, peerId [20]byte, peerIp net.IP, peerPort uint16) (net.Conn, *Handshake, error) {
-	request := getHandshakePayload(infoHash, peerId)
-	peerAddress := net.JoinHostPort(peerIp.String(), strconv.Itoa(int(peerPort)))
-
-	conn, err := net.DialTimeout("tcp", peerAddress, config.Config.PeerHandshakeTimeout)
+	conn, err := Dial(peerIp, peerPort)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	_, err = conn.Write(request)
+	_, err = conn.Write(Payload(infoHash, peerId))
 	if err != nil {
 		conn.Close()
 		return nil, nil, err
@@ -39,7 +47,7 @@ func SendHandshake(infoHash, peerId [20]byte, peerIp net.IP, peerPort uint16) (n
 	conn.SetDeadline(time.Now().Add(time.Second * 10))
 
 	buf := make([]byte, 68)
-	_, err = conn.Read(buf)
+	_, err = io.ReadFull(conn, buf)
 	if err != nil {
 		conn.Close()
 		return nil, nil, err
@@ -50,13 +58,52 @@ func SendHandshake(infoHash, peerId [20]byte, peerIp net.IP, peerPort uint16) (n
 	return conn, &h, nil
 }
 
-// getHandshakePayload constructs the handshake payload.
-func getHandshakePayload(infoHash, peerId [20]byte) []byte {
+// Dial opens a TCP connection to the peer, over tcp4 for IPv4 and IPv4-mapped addresses and over tcp6 otherwise.
+func Dial(peerIp net.IP, peerPort uint16) (net.Conn, error) {
+	network := "tcp6"
+	if ip4 := peerIp.To4(); ip4 != nil {
+		network = "tcp4"
+		peerIp = ip4
+	}
+	peerAddress := net.JoinHostPort(peerIp.String(), strconv.Itoa(int(peerPort)))
+
+	return net.DialTimeout(network, peerAddress, config.Config.PeerHandshakeTimeout)
+}
+
+/*
+ReadHandshake reads the handshake of a peer that connected to us, which comes first on an incoming connection.
+It fails if the peer does not speak the BitTorrent protocol. The info hash tells which torrent it wants.
+*/
+func ReadHandshake(conn net.Conn) (*Handshake, error) {
+	buf := make([]byte, 68)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+
+	var h Handshake
+	h.decodeHandshakeResponse(buf)
+	if h.Pstrlen != 19 || h.Pstr != "BitTorrent protocol" {
+		return nil, fmt.Errorf("[handshake] unknown protocol %q", buf[1:20])
+	}
+
+	return &h, nil
+}
+
+// WriteHandshake sends our handshake, in reply to the handshake of a peer that connected to us.
+func WriteHandshake(conn net.Conn, infoHash, peerId [20]byte) error {
+	_, err := conn.Write(Payload(infoHash, peerId))
+	return err
+}
+
+// Payload constructs our handshake payload, which is also the initial payload of an encrypted handshake.
+func Payload(infoHash, peerId [20]byte) []byte {
 	handshake := make([]byte, 68)
 
 	handshake[0] = 19
 	copy(handshake[1:], "BitTorrent protocol")
 	copy(handshake[20:], make([]byte, 8))
+	handshake[25] |= reservedExtensions
+	handshake[27] |= reservedDHT
 	copy(handshake[28:], infoHash[:])
 	copy(handshake[48:], peerId[:])
 
@@ -71,3 +118,13 @@ func (h *Handshake) decodeHandshakeResponse(buf []byte) {
 	copy(h.InfoHash[:], buf[28:48])
 	copy(h.PeerId[:], buf[48:68])
 }
+
+// SupportsDHT reports whether the peer set the DHT bit of the reserved bytes, so it accepts our PORT message.
+func (h *Handshake) SupportsDHT() bool {
+	return h.Reserved[7]&reservedDHT != 0
+}
+
+// SupportsExtensions reports whether the peer set the extension protocol bit of the reserved bytes (BEP 10).
+func (h *Handshake) SupportsExtensions() bool {
+	return h.Reserved[5]&reservedExtensions != 0
+}
@@ -0,0 +1,52 @@
+package handshake_test
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/JoelVCrasta/clover/handshake"
+)
+
+func TestSendHandshakeIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+	defer ln.Close()
+
+	infoHash := [20]byte{1, 2, 3}
+	remoteId := [20]byte{'-', 'T', 'R'}
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		buf := make([]byte, 68)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		// Echo the handshake back with our own peer ID
+		copy(buf[48:], remoteId[:])
+		conn.Write(buf)
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	conn, res, err := handshake.SendHandshake(infoHash, [20]byte{'-', 'C', 'V'}, addr.IP, uint16(addr.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if res.InfoHash != infoHash || res.PeerId != remoteId {
+		t.Errorf("unexpected handshake response %+v", res)
+	}
+
+	// The echoed reserved bytes are our own, which advertise the DHT and the extension protocol
+	if !res.SupportsDHT() || !res.SupportsExtensions() {
+		t.Errorf("unexpected reserved bytes %x", res.Reserved)
+	}
+}
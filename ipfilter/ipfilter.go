@@ -0,0 +1,290 @@
+package ipfilter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// maxAccessLevel is the highest access level of an eMule ipfilter.dat entry that still blocks the range.
+const maxAccessLevel = 127
+
+// Range is an inclusive range of blocked addresses of the same family.
+type Range struct {
+	First netip.Addr
+	Last  netip.Addr
+}
+
+func (r Range) contains(addr netip.Addr) bool {
+	return r.First.Compare(addr) <= 0 && addr.Compare(r.Last) <= 0
+}
+
+/*
+Filter blocks the addresses of a set of ranges, loaded from eMule ipfilter.dat, PeerGuardian P2P
+and CIDR lists. The ranges are kept sorted and merged per address family, so a lookup is a binary search.
+*/
+type Filter struct {
+	paths   []string
+	v4      []Range
+	v6      []Range
+	blocked atomic.Uint64
+	mu      sync.RWMutex
+}
+
+// New creates a filter of the given ranges.
+func New(ranges []Range) *Filter {
+	f := &Filter{}
+	f.v4, f.v6 = mergeRanges(ranges)
+	return f
+}
+
+// Load creates a filter of the ranges in the files, which are read again by Reload.
+func Load(paths ...string) (*Filter, error) {
+	f := &Filter{paths: paths}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reads the files of the filter again. The previous ranges stay in place if a file fails to load.
+func (f *Filter) Reload() error {
+	var ranges []Range
+	for _, path := range f.paths {
+		fileRanges, err := parseFile(path)
+		if err != nil {
+			return err
+		}
+		ranges = append(ranges, fileRanges...)
+	}
+
+	v4, v6 := mergeRanges(ranges)
+
+	f.mu.Lock()
+	f.v4, f.v6 = v4, v6
+	f.mu.Unlock()
+
+	return nil
+}
+
+// Contains reports whether the address is in a blocked range.
+func (f *Filter) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	ranges := f.v4
+	if addr.Is6() {
+		ranges = f.v6
+	}
+
+	// The first range that does not end before the address is the only one that can contain it
+	i, _ := slices.BinarySearchFunc(ranges, addr, func(r Range, addr netip.Addr) int {
+		return r.Last.Compare(addr)
+	})
+	return i < len(ranges) && ranges[i].contains(addr)
+}
+
+// Allow reports whether a connection to or from the address is allowed, counting the blocked ones.
+func (f *Filter) Allow(addr netip.Addr) bool {
+	if f.Contains(addr) {
+		f.blocked.Add(1)
+		return false
+	}
+	return true
+}
+
+// Blocked returns the number of connections the filter blocked.
+func (f *Filter) Blocked() uint64 {
+	return f.blocked.Load()
+}
+
+// Len returns the number of ranges after merging the overlapping ones.
+func (f *Filter) Len() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return len(f.v4) + len(f.v6)
+}
+
+func parseFile(path string) ([]Range, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("[ipfilter] failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	ranges, err := Parse(file)
+	if err != nil {
+		return nil, fmt.Errorf("[ipfilter] %s:%w", path, err)
+	}
+	return ranges, nil
+}
+
+/*
+Parse reads a list of blocked ranges, one per line, in any of the formats:
+
+	001.009.096.105 - 001.009.096.105 , 000 , Description    (eMule ipfilter.dat)
+	Description:1.9.96.105-1.9.96.105                        (PeerGuardian P2P)
+	10.0.0.0/8, 2001:db8::/32 or 192.0.2.1                   (CIDR and single addresses)
+
+Empty lines and lines starting with # or // are ignored, and so are ipfilter.dat entries
+with an access level above 127. An invalid line fails the whole list.
+*/
+func Parse(r io.Reader) ([]Range, error) {
+	var ranges []Range
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") || strings.HasPrefix(text, "//") {
+			continue
+		}
+
+		rng, ok, err := parseLine(text)
+		if err != nil {
+			return nil, fmt.Errorf("%d: %w", line, err)
+		}
+		if ok {
+			ranges = append(ranges, rng)
+		}
+	}
+
+	return ranges, scanner.Err()
+}
+
+// parseLine parses a line of a list, ok is false for an entry that does not block.
+func parseLine(text string) (rng Range, ok bool, err error) {
+	if prefix, err := netip.ParsePrefix(text); err == nil {
+		prefix = prefix.Masked()
+		return Range{First: prefix.Addr(), Last: lastAddr(prefix)}, true, nil
+	}
+	if addr, err := netip.ParseAddr(text); err == nil {
+		return Range{First: addr, Last: addr}, true, nil
+	}
+
+	// P2P: description:range, where the description can contain colons and commas too
+	if i := strings.LastIndex(text, ":"); i >= 0 {
+		if rng, err := parseRange(text[i+1:]); err == nil {
+			return rng, true, nil
+		}
+	}
+
+	// eMule: range , access level , description
+	fields := strings.SplitN(text, ",", 3)
+	if len(fields) > 1 {
+		level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if err != nil {
+			return Range{}, false, fmt.Errorf("invalid access level in %q", text)
+		}
+		if level > maxAccessLevel {
+			return Range{}, false, nil
+		}
+	}
+	rng, err = parseRange(fields[0])
+	if err != nil {
+		return Range{}, false, err
+	}
+	return rng, true, nil
+}
+
+// parseRange parses a first-last range of IPv4 addresses, whose octets can have leading zeros.
+func parseRange(text string) (Range, error) {
+	first, last, found := strings.Cut(text, "-")
+	if !found {
+		return Range{}, fmt.Errorf("invalid range %q", strings.TrimSpace(text))
+	}
+
+	firstAddr, err := parseIPv4(first)
+	if err != nil {
+		return Range{}, err
+	}
+	lastAddr, err := parseIPv4(last)
+	if err != nil {
+		return Range{}, err
+	}
+	if lastAddr.Less(firstAddr) {
+		return Range{}, fmt.Errorf("invalid range %q", strings.TrimSpace(text))
+	}
+
+	return Range{First: firstAddr, Last: lastAddr}, nil
+}
+
+func parseIPv4(text string) (netip.Addr, error) {
+	text = strings.TrimSpace(text)
+
+	octets := strings.Split(text, ".")
+	if len(octets) != 4 {
+		return netip.Addr{}, fmt.Errorf("invalid IPv4 address %q", text)
+	}
+
+	var ip [4]byte
+	for i, octet := range octets {
+		n, err := strconv.ParseUint(octet, 10, 8)
+		if err != nil {
+			return netip.Addr{}, fmt.Errorf("invalid IPv4 address %q", text)
+		}
+		ip[i] = byte(n)
+	}
+
+	return netip.AddrFrom4(ip), nil
+}
+
+// lastAddr returns the last address of the masked prefix.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	ip := prefix.Addr().AsSlice()
+	for bit := prefix.Bits(); bit < len(ip)*8; bit++ {
+		ip[bit/8] |= 0x80 >> (bit % 8)
+	}
+
+	addr, _ := netip.AddrFromSlice(ip)
+	return addr
+}
+
+// mergeRanges sorts the ranges by family and merges the overlapping and adjacent ones.
+func mergeRanges(ranges []Range) (v4 []Range, v6 []Range) {
+	for _, r := range ranges {
+		r = Range{First: r.First.Unmap(), Last: r.Last.Unmap()}
+		if !r.First.IsValid() || r.First.Is4() != r.Last.Is4() || r.Last.Less(r.First) {
+			continue
+		}
+
+		if r.First.Is4() {
+			v4 = append(v4, r)
+		} else {
+			v6 = append(v6, r)
+		}
+	}
+
+	return merge(v4), merge(v6)
+}
+
+func merge(ranges []Range) []Range {
+	slices.SortFunc(ranges, func(a, b Range) int {
+		return a.First.Compare(b.First)
+	})
+
+	var merged []Range
+	for _, r := range ranges {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			next := last.Last.Next()
+			if r.First.Compare(last.Last) <= 0 || (next.IsValid() && r.First == next) {
+				if last.Last.Less(r.Last) {
+					last.Last = r.Last
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+
+	return merged
+}
@@ -0,0 +1,105 @@
+package ipfilter
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testList = `# comment
+001.009.096.105 - 001.009.096.110 , 000 , eMule entry
+002.000.000.000 - 002.000.000.255 , 200 , allowed by its access level
+Some Corp, Inc: HQ:3.0.0.0-3.0.0.255
+10.0.0.0/8
+10.255.255.255/32
+2001:db8::/32
+192.0.2.7
+`
+
+func TestParse(t *testing.T) {
+	ranges, err := Parse(strings.NewReader(testList))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 6 {
+		t.Fatalf("expected 6 ranges, got %v", ranges)
+	}
+
+	if _, err := Parse(strings.NewReader("1.2.3.4 - 1.2.3.x , 000 , broken")); err == nil || !strings.HasPrefix(err.Error(), "1:") {
+		t.Errorf("expected an error on line 1, got %v", err)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	ranges, err := Parse(strings.NewReader(testList))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := New(ranges)
+
+	// 10.255.255.255/32 is merged into 10.0.0.0/8
+	if f.Len() != 5 {
+		t.Errorf("expected 5 merged ranges, got %d", f.Len())
+	}
+
+	tests := map[string]bool{
+		"1.9.96.104":         false,
+		"1.9.96.105":         true,
+		"1.9.96.110":         true,
+		"1.9.96.111":         false,
+		"2.0.0.1":            false,
+		"3.0.0.128":          true,
+		"10.20.30.40":        true,
+		"::ffff:10.20.30.40": true,
+		"11.0.0.0":           false,
+		"192.0.2.7":          true,
+		"2001:db8:1::1":      true,
+		"2001:db9::1":        false,
+	}
+	for addr, blocked := range tests {
+		if f.Contains(netip.MustParseAddr(addr)) != blocked {
+			t.Errorf("%s: expected blocked %v", addr, blocked)
+		}
+	}
+
+	f.Allow(netip.MustParseAddr("10.0.0.1"))
+	f.Allow(netip.MustParseAddr("11.0.0.1"))
+	if f.Blocked() != 1 {
+		t.Errorf("expected 1 blocked connection, got %d", f.Blocked())
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.p2p")
+	if err := os.WriteFile(path, []byte("first:1.1.1.0-1.1.1.255\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, []byte("second:2.2.2.0-2.2.2.255\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if f.Contains(netip.MustParseAddr("1.1.1.1")) || !f.Contains(netip.MustParseAddr("2.2.2.2")) {
+		t.Error("reload did not replace the ranges")
+	}
+
+	// A broken list keeps the previous ranges
+	if err := os.WriteFile(path, []byte("broken\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reload(); err == nil {
+		t.Error("expected an error for a broken list")
+	}
+	if !f.Contains(netip.MustParseAddr("2.2.2.2")) {
+		t.Error("broken list dropped the ranges")
+	}
+}
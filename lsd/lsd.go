@@ -0,0 +1,373 @@
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JoelVCrasta/clover/peer"
+)
+
+const (
+	// Group4 and Group6 are the multicast groups of the local service discovery (BEP 14).
+	Group4 = "239.192.152.143:6771"
+	Group6 = "[ff15::efc0:988f]:6771"
+
+	// announceInterval is how often every torrent is announced.
+	announceInterval = 5 * time.Minute
+
+	// minAnnounceInterval is the least time between two announces we send, and between
+	// two announces of the same torrent we accept from a host.
+	minAnnounceInterval = time.Minute
+
+	// maxInfoHashes is the number of info hashes in a single announce, which keeps it in one packet.
+	maxInfoHashes = 20
+
+	// maxSeen bounds the received announces remembered for rate limiting.
+	maxSeen = 10000
+)
+
+// torrent is an active torrent with the stream its local peers are sent to.
+type torrent struct {
+	peerChan     chan peer.Peer
+	lastAnnounce time.Time
+}
+
+// seenKey is a torrent announced by a host, for rate limiting the received announces.
+type seenKey struct {
+	addr     netip.Addr
+	infoHash [20]byte
+}
+
+// groupConn is the socket that joined the multicast group of an address family.
+type groupConn struct {
+	conn  *net.UDPConn
+	group *net.UDPAddr
+	host  string // the Host header of the announces sent to the group
+}
+
+/*
+Service finds the peers of the active torrents on the local network (BEP 14). It sends BT-SEARCH
+announces of the torrents to the IPv4 and IPv6 multicast groups and listens for the announces
+of other clients. Announces are sent at most once a minute, and the announces of other clients
+are limited to one per torrent and host per minute. Our own announces are recognized by their cookie.
+*/
+type Service struct {
+	port   uint16
+	cookie string
+	conns  []*groupConn
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*torrent
+	seen     map[seenKey]time.Time
+	lastSent time.Time
+	wake     chan struct{}
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+/*
+NewService joins the multicast groups and starts announcing the torrents that are added,
+with the TCP port peers can connect to us on. It only fails if neither group can be joined.
+*/
+func NewService(ctx context.Context, port uint16) (*Service, error) {
+	s := newService(ctx, port)
+
+	var lastErr error
+	for _, g := range []struct{ network, addr string }{{"udp4", Group4}, {"udp6", Group6}} {
+		group, err := net.ResolveUDPAddr(g.network, g.addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		conn, err := net.ListenMulticastUDP(g.network, nil, group)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		s.conns = append(s.conns, &groupConn{conn: conn, group: group, host: g.addr})
+	}
+
+	if len(s.conns) == 0 {
+		s.cancel()
+		return nil, fmt.Errorf("[lsd] failed to join the multicast groups: %v", lastErr)
+	}
+
+	for _, gc := range s.conns {
+		s.wg.Add(1)
+		go s.serve(gc)
+	}
+
+	s.wg.Add(1)
+	go s.announceLoop()
+
+	return s, nil
+}
+
+func newService(ctx context.Context, port uint16) *Service {
+	ctx, cancel := context.WithCancel(ctx)
+
+	cookie := make([]byte, 8)
+	rand.Read(cookie)
+
+	return &Service{
+		port:     port,
+		cookie:   hex.EncodeToString(cookie),
+		torrents: make(map[[20]byte]*torrent),
+		seen:     make(map[seenKey]time.Time),
+		wake:     make(chan struct{}, 1),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+/*
+Add starts announcing the torrent and returns the stream of its peers found on the local network.
+The stream is closed when the torrent is removed or the service is closed.
+*/
+func (s *Service) Add(infoHash [20]byte) <-chan peer.Peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.torrents[infoHash]
+	if !ok {
+		t = &torrent{peerChan: make(chan peer.Peer, 100)}
+		if s.ctx.Err() != nil {
+			close(t.peerChan)
+			return t.peerChan
+		}
+		s.torrents[infoHash] = t
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+
+	return t.peerChan
+}
+
+// Remove stops announcing the torrent and closes the stream of its peers.
+func (s *Service) Remove(infoHash [20]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t, ok := s.torrents[infoHash]; ok {
+		close(t.peerChan)
+		delete(s.torrents, infoHash)
+	}
+}
+
+// Close leaves the multicast groups and closes the streams of the torrents.
+func (s *Service) Close() {
+	s.closeOnce.Do(func() {
+		s.cancel()
+		for _, gc := range s.conns {
+			gc.conn.Close()
+		}
+		s.wg.Wait()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for infoHash, t := range s.torrents {
+			close(t.peerChan)
+			delete(s.torrents, infoHash)
+		}
+	})
+}
+
+// announceLoop announces the torrents that are due every minute, or right away when a torrent is added.
+func (s *Service) announceLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(minAnnounceInterval)
+	defer ticker.Stop()
+
+	for {
+		s.announce()
+
+		select {
+		case <-ticker.C:
+			s.expireSeen()
+		case <-s.wake:
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// announce sends a single announce with the torrents that were not announced for announceInterval.
+func (s *Service) announce() {
+	s.mu.Lock()
+	if time.Since(s.lastSent) < minAnnounceInterval {
+		s.mu.Unlock()
+		return
+	}
+
+	var infoHashes [][20]byte
+	for infoHash, t := range s.torrents {
+		if len(infoHashes) == maxInfoHashes {
+			break
+		}
+		if time.Since(t.lastAnnounce) >= announceInterval {
+			t.lastAnnounce = time.Now()
+			infoHashes = append(infoHashes, infoHash)
+		}
+	}
+	if len(infoHashes) > 0 {
+		s.lastSent = time.Now()
+	}
+	s.mu.Unlock()
+
+	if len(infoHashes) == 0 {
+		return
+	}
+
+	for _, gc := range s.conns {
+		gc.conn.WriteToUDP(formatAnnounce(gc.host, s.port, infoHashes, s.cookie), gc.group)
+	}
+}
+
+// serve reads the announces sent to the group until the socket is closed.
+func (s *Service) serve(gc *groupConn) {
+	defer s.wg.Done()
+
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := gc.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+
+		s.handlePacket(buf[:n], addr.Addr().Unmap())
+	}
+}
+
+// handlePacket sends the peer of an announce from another client to the streams of the announced torrents.
+func (s *Service) handlePacket(buf []byte, from netip.Addr) {
+	a, err := parseAnnounce(buf)
+	if err != nil || a.cookie == s.cookie {
+		return
+	}
+
+	p := peer.NewPeer(from.AsSlice(), a.port)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, infoHash := range a.infoHashes {
+		t, ok := s.torrents[infoHash]
+		if !ok {
+			continue
+		}
+
+		key := seenKey{addr: from, infoHash: infoHash}
+		if lastSeen, ok := s.seen[key]; ok && time.Since(lastSeen) < minAnnounceInterval {
+			continue
+		}
+		if len(s.seen) < maxSeen {
+			s.seen[key] = time.Now()
+		}
+
+		select {
+		case t.peerChan <- p:
+		default:
+		}
+	}
+}
+
+// expireSeen forgets the received announces that no longer limit new ones.
+func (s *Service) expireSeen() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, lastSeen := range s.seen {
+		if time.Since(lastSeen) >= minAnnounceInterval {
+			delete(s.seen, key)
+		}
+	}
+}
+
+// announce is a decoded BT-SEARCH message.
+type announce struct {
+	port       uint16
+	infoHashes [][20]byte
+	cookie     string
+}
+
+// formatAnnounce encodes a BT-SEARCH message for the group (BEP 14).
+func formatAnnounce(host string, port uint16, infoHashes [][20]byte, cookie string) []byte {
+	var b bytes.Buffer
+
+	b.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(&b, "Host: %s\r\n", host)
+	fmt.Fprintf(&b, "Port: %d\r\n", port)
+	for _, infoHash := range infoHashes {
+		fmt.Fprintf(&b, "Infohash: %x\r\n", infoHash)
+	}
+	fmt.Fprintf(&b, "cookie: %s\r\n", cookie)
+	b.WriteString("\r\n\r\n")
+
+	return b.Bytes()
+}
+
+// parseAnnounce decodes a BT-SEARCH message. Header names are case insensitive.
+func parseAnnounce(buf []byte) (*announce, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+
+	if !scanner.Scan() || !strings.HasPrefix(scanner.Text(), "BT-SEARCH * HTTP/1.") {
+		return nil, fmt.Errorf("not a BT-SEARCH message")
+	}
+
+	var a announce
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		switch http.CanonicalHeaderKey(strings.TrimSpace(name)) {
+		case "Port":
+			port, err := strconv.ParseUint(value, 10, 16)
+			if err != nil || port == 0 {
+				return nil, fmt.Errorf("invalid port %q", value)
+			}
+			a.port = uint16(port)
+
+		case "Infohash":
+			decoded, err := hex.DecodeString(value)
+			if err != nil || len(decoded) != 20 {
+				continue
+			}
+			a.infoHashes = append(a.infoHashes, [20]byte(decoded))
+
+		case "Cookie":
+			a.cookie = value
+		}
+	}
+
+	if a.port == 0 || len(a.infoHashes) == 0 {
+		return nil, fmt.Errorf("announce without a port or info hash")
+	}
+
+	return &a, nil
+}
@@ -0,0 +1,102 @@
+package lsd
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnnounceRoundTrip(t *testing.T) {
+	infoHashes := [][20]byte{{1, 2, 3}, {4, 5, 6}}
+	buf := formatAnnounce(Group4, 6881, infoHashes, "abc")
+
+	if !strings.HasPrefix(string(buf), "BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\n") {
+		t.Errorf("unexpected announce %q", buf)
+	}
+
+	a, err := parseAnnounce(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.port != 6881 || a.cookie != "abc" || len(a.infoHashes) != 2 || a.infoHashes[1] != infoHashes[1] {
+		t.Errorf("unexpected announce %+v", a)
+	}
+
+	// Header names are case insensitive and the cookie is optional
+	a, err = parseAnnounce([]byte("BT-SEARCH * HTTP/1.1\r\nport: 7000\r\nINFOHASH: 0102030000000000000000000000000000000000\r\n\r\n\r\n"))
+	if err != nil || a.port != 7000 || a.infoHashes[0] != infoHashes[0] {
+		t.Errorf("unexpected announce %+v (%v)", a, err)
+	}
+
+	if _, err := parseAnnounce([]byte("M-SEARCH * HTTP/1.1\r\n\r\n")); err == nil {
+		t.Error("expected an error for a message that is not a BT-SEARCH")
+	}
+}
+
+func TestHandlePacket(t *testing.T) {
+	s := newService(context.Background(), 6881)
+	infoHash := [20]byte{1}
+	peerChan := s.Add(infoHash)
+	from := netip.MustParseAddr("192.168.1.20")
+
+	// Our own announce comes back through the multicast loopback
+	s.handlePacket(formatAnnounce(Group4, 6881, [][20]byte{infoHash}, s.cookie), from)
+	select {
+	case p := <-peerChan:
+		t.Fatalf("received our own announce as %s", p)
+	default:
+	}
+
+	other := formatAnnounce(Group4, 7000, [][20]byte{infoHash, {2}}, "other")
+	s.handlePacket(other, from)
+	select {
+	case p := <-peerChan:
+		if p.String() != "192.168.1.20:7000" {
+			t.Errorf("unexpected peer %s", p)
+		}
+	default:
+		t.Fatal("no peer received")
+	}
+
+	// The same host announcing again within a minute is ignored
+	s.handlePacket(other, from)
+	select {
+	case p := <-peerChan:
+		t.Errorf("peer %s received from a repeated announce", p)
+	default:
+	}
+
+	s.Remove(infoHash)
+	if _, ok := <-peerChan; ok {
+		t.Error("stream was not closed")
+	}
+}
+
+func TestMulticast(t *testing.T) {
+	a, err := NewService(context.Background(), 7001)
+	if err != nil {
+		t.Skipf("multicast not available: %v", err)
+	}
+	defer a.Close()
+
+	b, err := NewService(context.Background(), 7002)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	infoHash := [20]byte{9}
+	peerChan := b.Add(infoHash)
+	a.Add(infoHash)
+
+	select {
+	case p := <-peerChan:
+		if p.Port != 7001 {
+			t.Errorf("unexpected peer %s", p)
+		}
+	case <-time.After(2 * time.Second):
+		t.Skip("no multicast announce received, the network may not route multicast")
+	}
+}
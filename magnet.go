@@ -0,0 +1,89 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/JoelVCrasta/clover/download"
+	"github.com/JoelVCrasta/clover/metadata"
+	"github.com/JoelVCrasta/clover/metainfo"
+	"github.com/JoelVCrasta/clover/peer"
+)
+
+// SourceMagnet is the name of the peer source of the x.pe peers of a magnet link.
+const SourceMagnet = "magnet"
+
+/*
+StartMagnet downloads the torrent of the magnet link to the output path. The info dictionary is first
+downloaded from the peers the trackers, the DHT and the other sources find (BEP 9), and the download
+starts once it matches the info hash, with the peers found so far.
+*/
+func StartMagnet(uri string, outputPath string, sources ...peer.PeerSource) error {
+	m, err := metainfo.ParseMagnet(uri)
+	if err != nil {
+		return err
+	}
+	tr := m.Torrent(outputPath)
+
+	var peers []peer.Peer
+	for _, addr := range m.Peers {
+		p, err := peer.ParsePeer(addr)
+		if err != nil {
+			log.Printf("[magnet] %v", err)
+			continue
+		}
+		peers = append(peers, p)
+	}
+	if len(peers) > 0 {
+		sources = append(sources, peer.StaticSource(SourceMagnet, peers))
+	}
+
+	peerId, err := peer.GeneratePeerID()
+	if err != nil {
+		return err
+	}
+
+	// this is the global context for stopping the torrent
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	filter, err := loadIPFilter(ctx)
+	if err != nil {
+		return err
+	}
+	startListener()
+
+	fmt.Println("Searching for peers...")
+	pd, err := StartPeerDiscovery(ctx, tr, peerId, nil, sources...)
+	if err != nil {
+		return err
+	}
+	defer pd.Stop()
+
+	fmt.Println("Fetching metadata...")
+	fetchCtx, cancel := context.WithCancel(ctx)
+	x := metadata.NewExchange(tr.InfoHash, nil)
+
+	// The peer exchange waits for the metadata, as the torrent may be private
+	c := newClient(fetchCtx, pd, tr.InfoHash, peerId, filter)
+	c.RegisterExtension(x)
+	info, err := metadata.Fetch(fetchCtx, c, c.StartClient(), x)
+
+	// The peers of the metadata are disconnected, and are connected to again for the download
+	cancel()
+	if err != nil {
+		return fmt.Errorf("[magnet] stopped before the metadata was fetched: %v", err)
+	}
+	if err := tr.SetMetadata(info); err != nil {
+		return err
+	}
+	pd.MetadataFetched(tr)
+	fmt.Printf("Fetched metadata of %s\n", tr.Info.Name)
+
+	dm := download.NewDownloadManager(ctx, *tr)
+	runDownload(ctx, tr, peerId, dm, pd, filter, c.Pool().Peers())
+	return nil
+}
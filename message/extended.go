@@ -0,0 +1,106 @@
+package message
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/JoelVCrasta/clover/metainfo"
+)
+
+// ExtendedHandshakeId is the extended message ID of the extended handshake (BEP 10).
+const ExtendedHandshakeId = 0
+
+// NewExtendedMessage creates an extended message with the extended message ID and payload (BEP 10).
+func NewExtendedMessage(extendedId byte, payload []byte) *Message {
+	return NewMessage(ExtendedId, append([]byte{extendedId}, payload...))
+}
+
+// DecodeExtended decodes an extended message from the peer and returns its extended message ID and payload.
+func (m *Message) DecodeExtended() (byte, []byte, error) {
+	if len(m.Payload) < 1 {
+		return 0, nil, fmt.Errorf("invalid Extended payload length: %d", len(m.Payload))
+	}
+
+	return m.Payload[0], m.Payload[1:], nil
+}
+
+// ExtendedHandshake is the extended handshake of a peer (BEP 10).
+type ExtendedHandshake struct {
+	M            map[string]int // the extensions the peer supports with the IDs to send their messages with
+	V            string         // the client name and version of the peer
+	P            uint16         // the TCP port the peer listens on
+	Reqq         int            // the number of outstanding requests the peer allows
+	YourIp       netip.Addr     // our address as the peer sees it
+	MetadataSize int            // the size of the info dictionary for ut_metadata (BEP 9)
+}
+
+// Encode bencodes the extended handshake, leaving out the fields that are not set.
+func (eh *ExtendedHandshake) Encode() ([]byte, error) {
+	m := make(map[string]any, len(eh.M))
+	for name, id := range eh.M {
+		m[name] = id
+	}
+
+	dict := map[string]any{"m": m}
+	if eh.V != "" {
+		dict["v"] = eh.V
+	}
+	if eh.P != 0 {
+		dict["p"] = int(eh.P)
+	}
+	if eh.Reqq > 0 {
+		dict["reqq"] = eh.Reqq
+	}
+	if eh.YourIp.IsValid() {
+		dict["yourip"] = eh.YourIp.AsSlice()
+	}
+	if eh.MetadataSize > 0 {
+		dict["metadata_size"] = eh.MetadataSize
+	}
+
+	return metainfo.BencodeMarshall(dict)
+}
+
+/*
+DecodeExtendedHandshake decodes the payload of an extended handshake. Only the extensions with
+an ID are kept in M, as an ID of 0 disables the extension. Fields with invalid values are left unset.
+*/
+func DecodeExtendedHandshake(payload []byte) (*ExtendedHandshake, error) {
+	decoded, err := metainfo.BencodeUnmarshall(payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid extended handshake: %v", err)
+	}
+
+	dict, ok := decoded.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("invalid extended handshake format")
+	}
+
+	eh := &ExtendedHandshake{M: make(map[string]int)}
+	m, _ := dict["m"].(map[string]any)
+	for name, value := range m {
+		if id, ok := value.(int); ok && id > 0 && id < 256 {
+			eh.M[name] = id
+		}
+	}
+
+	if v, ok := dict["v"].([]byte); ok {
+		eh.V = string(v)
+	}
+	if p, ok := dict["p"].(int); ok && p > 0 && p <= 65535 {
+		eh.P = uint16(p)
+	}
+	if reqq, ok := dict["reqq"].(int); ok && reqq > 0 {
+		eh.Reqq = reqq
+	}
+	if yourIp, ok := dict["yourip"].([]byte); ok {
+		if addr, ok := netip.AddrFromSlice(yourIp); ok && (len(yourIp) == 4 || len(yourIp) == 16) {
+			eh.YourIp = addr.Unmap()
+		}
+	}
+	if size, ok := dict["metadata_size"].(int); ok && size > 0 {
+		eh.MetadataSize = size
+	}
+
+	return eh, nil
+}
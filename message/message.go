@@ -1,7 +1,6 @@
 package message
 
 import (
-	"bufio"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -22,7 +21,9 @@ const (
 	CancelId
 	PortId
 
-	Extended = 20
+	HaveAllId  MessageId = 14 // the peer has every piece (BEP 6)
+	HaveNoneId MessageId = 15 // the peer has no piece (BEP 6)
+	ExtendedId MessageId = 20
 )
 
 // lengthPrefix is the length of the message prefix for each message type
@@ -35,6 +36,8 @@ var lengthPrefix = map[MessageId]int{
 	RequestId:       13,
 	CancelId:        13,
 	PortId:          3,
+	HaveAllId:       1,
+	HaveNoneId:      1,
 }
 
 // payloadSize is the size of the payload for each message type
@@ -47,8 +50,14 @@ var payloadSize = map[MessageId]int{
 	RequestId:       12,
 	CancelId:        12,
 	PortId:          2,
+	HaveAllId:       0,
+	HaveNoneId:      0,
 }
 
+// maxLength is the largest message read from a peer, the bitfield of a torrent with 2^23 pieces.
+// A piece message of a 16 KiB block and an extended message with a metadata piece are much smaller.
+const maxLength = 1<<20 + 1
+
 // KeepAlive is to send to peer to keep the connection alive
 var KeepAlive = []byte{0, 0, 0, 0}
 
@@ -73,30 +82,8 @@ It checks the length of the message, if the length is 0, it returns a KeepAlive
 If the length is greater than 0, then it is decoded into a Message struct.
 */
 func ReadMessage(conn net.Conn) (*Message, error) {
-	reader := bufio.NewReader(conn)
-	lengthBuf := make([]byte, 4)
-
-	if _, err := io.ReadFull(reader, lengthBuf); err != nil {
-		return nil, err
-	}
-
-	length := binary.BigEndian.Uint32(lengthBuf)
-	if length == 0 {
-		return nil, nil // KeepAlive message
-	}
-
-	msg := make([]byte, length)
-	if _, err := io.ReadFull(reader, msg); err != nil {
-		return nil, err
-	}
-
-	fullMessage := make([]byte, 4+length)
-	copy(fullMessage, lengthBuf)
-	copy(fullMessage[4:], msg)
-
-	var m Message
-	m.decodeMessage(fullMessage)
-	return &m, nil
+	// A buffered reader would swallow the messages sent right after this one, such as a PORT after the bitfield
+	return ReadPieceMessage(conn)
 }
 
 func ReadPieceMessage(reader io.Reader) (*Message, error) {
@@ -111,6 +98,10 @@ func ReadPieceMessage(reader io.Reader) (*Message, error) {
 		return nil, nil // KeepAlive message
 	}
 
+	if length > maxLength {
+		return nil, fmt.Errorf("message too long: %d bytes", length)
+	}
+
 	msg := make([]byte, length)
 	if _, err := io.ReadFull(reader, msg); err != nil {
 		return nil, err
@@ -149,12 +140,15 @@ func (m *Message) decodeMessage(buf []byte) {
 	m.MessageId = MessageId(buf[4])
 
 	var size int
-	if m.MessageId == PieceId || m.MessageId == BitfieldId {
+	if m.MessageId == PieceId || m.MessageId == BitfieldId || m.MessageId == ExtendedId {
 		size = m.LengthPrefix - 1
 	} else {
 		size = payloadSize[m.MessageId]
 	}
 
+	// A message shorter than its type requires keeps what it has, so the decoders reject it
+	size = min(size, len(buf)-5)
+
 	if size > 0 {
 		m.Payload = make([]byte, size)
 		copy(m.Payload, buf[5:5+size])
@@ -205,3 +199,12 @@ func (m *Message) DecodePiece(expectedIndex, bufLength int) (int, []byte, error)
 
 	return offset, block, nil
 }
+
+// DecodePort decodes a Port message from the peer and returns the UDP port of its DHT node.
+func (m *Message) DecodePort() (uint16, error) {
+	if len(m.Payload) != payloadSize[PortId] {
+		return 0, fmt.Errorf("invalid Port payload length: %d", len(m.Payload))
+	}
+
+	return binary.BigEndian.Uint16(m.Payload), nil
+}
@@ -0,0 +1,28 @@
+package message
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestReadPieceMessageTooLong(t *testing.T) {
+	buf := make([]byte, 5)
+	binary.BigEndian.PutUint32(buf, maxLength+1)
+	buf[4] = byte(PieceId)
+
+	if _, err := ReadPieceMessage(bytes.NewReader(buf)); err == nil {
+		t.Fatal("expected an error for a message longer than the largest valid message")
+	}
+}
+
+func TestReadPieceMessage(t *testing.T) {
+	block := make([]byte, 16*1024+8)
+	m, err := ReadPieceMessage(bytes.NewReader(NewMessage(PieceId, block).EncodeMessage()))
+	if err != nil {
+		t.Fatalf("failed to read the piece message: %v", err)
+	}
+	if m.MessageId != PieceId || len(m.Payload) != len(block) {
+		t.Fatalf("expected a piece message with a %d byte payload, got id %d with %d bytes", len(block), m.MessageId, len(m.Payload))
+	}
+}
@@ -0,0 +1,59 @@
+package metadata
+
+import (
+	"context"
+	"time"
+
+	"github.com/JoelVCrasta/clover/client"
+	"github.com/JoelVCrasta/clover/message"
+)
+
+/*
+Fetch downloads the info dictionary of a magnet link from the peers the client connects to, which must have
+the exchange registered as an extension. Only the extended messages of the peers are handled, as there is
+nothing to download before the metadata is known. It returns the verified info dictionary, or the error of the context.
+*/
+func Fetch(ctx context.Context, c *client.Client, apC <-chan *client.ActivePeer, x *Exchange) ([]byte, error) {
+	ticker := time.NewTicker(requestTimeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-x.Done():
+			return x.Info(), nil
+		case ap, ok := <-apC:
+			if !ok {
+				apC = nil
+				continue
+			}
+			go readMessages(c, ap)
+		case now := <-ticker.C:
+			x.Retry(now)
+		}
+	}
+}
+
+// readMessages passes the extended messages of the peer to the client until the peer disconnects or goes idle.
+func readMessages(c *client.Client, ap *client.ActivePeer) {
+	defer ap.Disconnect()
+
+	for {
+		// Replaces the deadline of the handshake
+		if err := ap.Conn.SetReadDeadline(time.Now().Add(idleTimeout)); err != nil {
+			return
+		}
+		msg, err := message.ReadMessage(ap.Conn)
+		if err != nil {
+			return
+		}
+		if msg == nil || msg.MessageId != message.ExtendedId {
+			continue
+		}
+
+		if err := c.HandleExtended(ap, msg); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package metadata
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/JoelVCrasta/clover/client"
+	"github.com/JoelVCrasta/clover/metainfo"
+)
+
+const (
+	// ExtensionName is the name of the metadata exchange in the extended handshake (BEP 10).
+	ExtensionName = "ut_metadata"
+
+	// PieceSize is the size of every piece of the info dictionary but the last one (BEP 9).
+	PieceSize = 16 * 1024
+
+	// MaxSize is the largest info dictionary we download.
+	MaxSize = 16 * 1024 * 1024
+
+	// maxRequests is the number of pieces requested from a peer at once.
+	maxRequests = 4
+
+	// requestTimeout is how long a requested piece is waited for before it is requested from another peer.
+	requestTimeout = 20 * time.Second
+
+	// idleTimeout is how long a peer may stay silent before it is disconnected, longer than the two minutes between keep-alives.
+	idleTimeout = 3 * time.Minute
+)
+
+// The message types of ut_metadata (BEP 9)
+const (
+	MsgRequest = 0
+	MsgData    = 1
+	MsgReject  = 2
+)
+
+// Message is a ut_metadata message. The data of a data message follows its bencoded dictionary.
+type Message struct {
+	Type      int
+	Piece     int
+	TotalSize int    // the size of the info dictionary, only in data messages
+	Data      []byte // the piece, only in data messages
+}
+
+// Encode encodes the message as the payload of its extended message.
+func (m *Message) Encode() ([]byte, error) {
+	dict := map[string]any{
+		"msg_type": m.Type,
+		"piece":    m.Piece,
+	}
+	if m.Type == MsgData {
+		dict["total_size"] = m.TotalSize
+	}
+
+	buf, err := metainfo.BencodeMarshall(dict)
+	if err != nil {
+		return nil, fmt.Errorf("[metadata] %v", err)
+	}
+
+	return append(buf, m.Data...), nil
+}
+
+// DecodeMessage decodes the payload of a ut_metadata message.
+func DecodeMessage(payload []byte) (*Message, error) {
+	decoded, n, err := metainfo.BencodeUnmarshallPrefix(payload)
+	if err != nil {
+		return nil, fmt.Errorf("[metadata] %v", err)
+	}
+
+	dict, ok := decoded.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("[metadata] message is not a dictionary")
+	}
+
+	msgType, ok := dict["msg_type"].(int)
+	if !ok {
+		return nil, fmt.Errorf("[metadata] missing msg_type")
+	}
+	piece, ok := dict["piece"].(int)
+	if !ok || piece < 0 {
+		return nil, fmt.Errorf("[metadata] missing piece")
+	}
+
+	m := &Message{Type: msgType, Piece: piece}
+	if msgType == MsgData {
+		if m.TotalSize, ok = dict["total_size"].(int); !ok {
+			return nil, fmt.Errorf("[metadata] missing total_size")
+		}
+		m.Data = payload[n:]
+	}
+
+	return m, nil
+}
+
+// numPieces returns the number of pieces of an info dictionary of the size.
+func numPieces(size int) int {
+	return (size + PieceSize - 1) / PieceSize
+}
+
+/*
+Exchange is the metadata exchange of a torrent (BEP 9), registered with the client as an extension.
+With the info dictionary it serves its pieces to the peers. Without it, as for a magnet link, it downloads
+the pieces from the peers that have it, and once they are all in, verifies them against the info hash.
+*/
+type Exchange struct {
+	infoHash    [20]byte
+	info        []byte
+	size        int
+	pieces      [][]byte
+	requested   map[int]*client.ActivePeer // the pieces in flight with the peer they were requested from
+	requestedAt map[int]time.Time
+	peers       map[*client.ActivePeer]int // the peers that have the metadata, with their pieces in flight
+	done        chan struct{}
+	mu          sync.Mutex
+}
+
+// NewExchange creates the metadata exchange of the torrent with the info hash. The info dictionary is nil if it must be downloaded.
+func NewExchange(infoHash [20]byte, info []byte) *Exchange {
+	x := &Exchange{
+		infoHash:    infoHash,
+		info:        info,
+		size:        len(info),
+		requested:   make(map[int]*client.ActivePeer),
+		requestedAt: make(map[int]time.Time),
+		peers:       make(map[*client.ActivePeer]int),
+		done:        make(chan struct{}),
+	}
+	if info != nil {
+		close(x.done)
+	}
+
+	return x
+}
+
+// Done returns a channel that is closed once the info dictionary is known.
+func (x *Exchange) Done() <-chan struct{} {
+	return x.done
+}
+
+// Info returns the verified info dictionary, or nil until it is downloaded.
+func (x *Exchange) Info() []byte {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.info
+}
+
+// Name returns the name of the metadata exchange in the extended handshake, so it can be registered with the client.
+func (x *Exchange) Name() string {
+	return ExtensionName
+}
+
+// PeerConnected does nothing, as the size of the metadata comes with the extended handshake.
+func (x *Exchange) PeerConnected(ap *client.ActivePeer) {}
+
+// Handshake starts downloading the metadata from the peer if we miss it and the peer has it.
+func (x *Exchange) Handshake(ap *client.ActivePeer) {
+	eh := ap.GetExtendedHandshake()
+	if eh == nil || eh.MetadataSize <= 0 || eh.MetadataSize > MaxSize {
+		return
+	}
+
+	x.mu.Lock()
+	if x.info != nil {
+		x.mu.Unlock()
+		return
+	}
+
+	// The first size we are told of is trusted, and the peers that disagree are not asked
+	if x.size == 0 {
+		x.size = eh.MetadataSize
+		x.pieces = make([][]byte, numPieces(x.size))
+	}
+	if eh.MetadataSize != x.size {
+		x.mu.Unlock()
+		return
+	}
+
+	x.peers[ap] = 0
+	requests := x.assign(time.Now())
+	x.mu.Unlock()
+
+	x.send(requests)
+}
+
+// Message handles a ut_metadata message from the peer.
+func (x *Exchange) Message(ap *client.ActivePeer, payload []byte) error {
+	msg, err := DecodeMessage(payload)
+	if err != nil {
+		return err
+	}
+
+	switch msg.Type {
+	case MsgRequest:
+		return x.serve(ap, msg.Piece)
+	case MsgData:
+		return x.receive(ap, msg)
+	case MsgReject:
+		x.drop(ap)
+	}
+
+	// Unknown message types are ignored (BEP 9)
+	return nil
+}
+
+// PeerDisconnected requests the pieces in flight with the peer from the other peers.
+func (x *Exchange) PeerDisconnected(ap *client.ActivePeer) {
+	x.drop(ap)
+}
+
+// serve sends the piece of the info dictionary to the peer, or rejects the request if we do not have it.
+func (x *Exchange) serve(ap *client.ActivePeer, piece int) error {
+	x.mu.Lock()
+	info := x.info
+	x.mu.Unlock()
+
+	reply := &Message{Type: MsgReject, Piece: piece}
+	if info != nil && piece < numPieces(len(info)) {
+		end := min((piece+1)*PieceSize, len(info))
+		reply = &Message{Type: MsgData, Piece: piece, TotalSize: len(info), Data: info[piece*PieceSize : end]}
+	}
+
+	payload, err := reply.Encode()
+	if err != nil {
+		return err
+	}
+	return ap.SendExtension(ExtensionName, payload)
+}
+
+// receive stores a piece the peer sent, and verifies the info dictionary once every piece is in.
+func (x *Exchange) receive(ap *client.ActivePeer, msg *Message) error {
+	x.mu.Lock()
+
+	if x.info != nil || x.requested[msg.Piece] != ap {
+		// Unrequested or late, such as after a timeout
+		x.mu.Unlock()
+		return nil
+	}
+	if msg.TotalSize != x.size || len(msg.Data) != x.pieceLength(msg.Piece) {
+		x.mu.Unlock()
+		return fmt.Errorf("[metadata] invalid piece %d from %s", msg.Piece, ap.Peer)
+	}
+
+	x.release(msg.Piece)
+	x.pieces[msg.Piece] = msg.Data
+
+	if x.complete() {
+		info := make([]byte, 0, x.size)
+		for _, piece := range x.pieces {
+			info = append(info, piece...)
+		}
+
+		if sha1.Sum(info) == x.infoHash {
+			x.info = info
+			x.requested = make(map[int]*client.ActivePeer)
+			x.mu.Unlock()
+			close(x.done)
+			return nil
+		}
+
+		// A peer sent a bad piece, and there is no telling which one, so everything is downloaded again
+		x.pieces = make([][]byte, len(x.pieces))
+	}
+
+	requests := x.assign(time.Now())
+	x.mu.Unlock()
+
+	x.send(requests)
+	return nil
+}
+
+// drop stops downloading from the peer and requests its pieces in flight from the other peers.
+func (x *Exchange) drop(ap *client.ActivePeer) {
+	x.mu.Lock()
+	delete(x.peers, ap)
+	for piece, from := range x.requested {
+		if from == ap {
+			x.release(piece)
+		}
+	}
+	requests := x.assign(time.Now())
+	x.mu.Unlock()
+
+	x.send(requests)
+}
+
+// Retry requests the pieces that have been in flight for longer than the request timeout from other peers.
+func (x *Exchange) Retry(now time.Time) {
+	x.mu.Lock()
+	for piece, at := range x.requestedAt {
+		if now.Sub(at) > requestTimeout {
+			x.release(piece)
+		}
+	}
+	requests := x.assign(now)
+	x.mu.Unlock()
+
+	x.send(requests)
+}
+
+// request is a piece to request from a peer.
+type request struct {
+	ap    *client.ActivePeer
+	piece int
+}
+
+/*
+assign hands out the missing pieces that are not in flight to the peers with free request slots,
+and returns the requests to send. The caller must hold x.mu.
+*/
+func (x *Exchange) assign(now time.Time) []request {
+	if x.info != nil {
+		return nil
+	}
+
+	var requests []request
+	for piece := range x.pieces {
+		if x.pieces[piece] != nil || x.requested[piece] != nil {
+			continue
+		}
+
+		var target *client.ActivePeer
+		for ap, inFlight := range x.peers {
+			if inFlight < maxRequests && (target == nil || inFlight < x.peers[target]) {
+				target = ap
+			}
+		}
+		if target == nil {
+			break
+		}
+
+		x.peers[target]++
+		x.requested[piece] = target
+		x.requestedAt[piece] = now
+		requests = append(requests, request{ap: target, piece: piece})
+	}
+
+	return requests
+}
+
+// send sends the requests. A peer that cannot be sent to is dropped once its connection closes.
+func (x *Exchange) send(requests []request) {
+	for _, r := range requests {
+		payload, err := (&Message{Type: MsgRequest, Piece: r.piece}).Encode()
+		if err != nil {
+			continue
+		}
+		_ = r.ap.SendExtension(ExtensionName, payload)
+	}
+}
+
+// release marks the piece as no longer in flight. The caller must hold x.mu.
+func (x *Exchange) release(piece int) {
+	if ap, ok := x.requested[piece]; ok {
+		if _, known := x.peers[ap]; known {
+			x.peers[ap]--
+		}
+	}
+	delete(x.requested, piece)
+	delete(x.requestedAt, piece)
+}
+
+// complete reports whether every piece is in. The caller must hold x.mu.
+func (x *Exchange) complete() bool {
+	for _, piece := range x.pieces {
+		if piece == nil {
+			return false
+		}
+	}
+	return len(x.pieces) > 0
+}
+
+// pieceLength returns the length of the piece of the info dictionary. The caller must hold x.mu.
+func (x *Exchange) pieceLength(piece int) int {
+	if piece < 0 || piece >= len(x.pieces) {
+		return -1
+	}
+	if piece == len(x.pieces)-1 {
+		return x.size - piece*PieceSize
+	}
+	return PieceSize
+}
@@ -0,0 +1,136 @@
+package metadata
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/JoelVCrasta/clover/client"
+	"github.com/JoelVCrasta/clover/message"
+	"github.com/JoelVCrasta/clover/peer"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	msg := &Message{Type: MsgData, Piece: 2, TotalSize: 40000, Data: []byte("piece data")}
+
+	buf, err := msg.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := DecodeMessage(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Type != MsgData || decoded.Piece != 2 || decoded.TotalSize != 40000 || string(decoded.Data) != "piece data" {
+		t.Errorf("unexpected message %+v", decoded)
+	}
+
+	if _, err := DecodeMessage([]byte("d5:piecei0ee")); err == nil {
+		t.Error("expected an error for a message without a type")
+	}
+}
+
+// pump passes the extended messages read from the connection to the client until it is closed.
+func pump(c *client.Client, ap *client.ActivePeer) {
+	for {
+		msg, err := message.ReadMessage(ap.Conn)
+		if err != nil {
+			return
+		}
+		if msg != nil && msg.MessageId == message.ExtendedId {
+			_ = c.HandleExtended(ap, msg)
+		}
+	}
+}
+
+func TestFetch(t *testing.T) {
+	info := bytes.Repeat([]byte("0123456789"), 4000) // 3 pieces, the last one short
+	infoHash := sha1.Sum(info)
+
+	seedClient := client.NewClient(context.Background(), nil, infoHash, [20]byte{})
+	seedClient.RegisterExtension(NewExchange(infoHash, info))
+
+	x := NewExchange(infoHash, nil)
+	fetchClient := client.NewClient(context.Background(), nil, infoHash, [20]byte{})
+	fetchClient.RegisterExtension(x)
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	fetchPeer := &client.ActivePeer{Peer: peer.NewPeer(net.IPv4(203, 0, 113, 1), 6881), Conn: local}
+	seedPeer := &client.ActivePeer{Peer: peer.NewPeer(net.IPv4(203, 0, 113, 2), 6881), Conn: remote}
+
+	// The seed learns our ID from our extended handshake, and we learn its metadata size from its one
+	seedPeer.SetExtendedHandshake(&message.ExtendedHandshake{M: map[string]int{ExtensionName: 1}})
+	go pump(seedClient, seedPeer)
+
+	eh := &message.ExtendedHandshake{M: map[string]int{ExtensionName: 1}, MetadataSize: len(info)}
+	payload, err := eh.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apC := make(chan *client.ActivePeer, 1)
+	apC <- fetchPeer
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The handshake is handled after Fetch started reading the messages of the peer
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_ = fetchClient.HandleExtended(fetchPeer, message.NewExtendedMessage(message.ExtendedHandshakeId, payload))
+	}()
+
+	fetched, err := Fetch(ctx, fetchClient, apC, x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fetched, info) {
+		t.Error("fetched metadata differs")
+	}
+}
+
+func TestFetchBadMetadata(t *testing.T) {
+	info := bytes.Repeat([]byte("x"), 1000)
+	x := NewExchange(sha1.Sum([]byte("something else")), nil)
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	go func() {
+		// Swallow our requests
+		for {
+			if _, err := message.ReadMessage(remote); err != nil {
+				return
+			}
+		}
+	}()
+
+	ap := &client.ActivePeer{Peer: peer.NewPeer(net.IPv4(203, 0, 113, 1), 6881), Conn: local}
+	ap.SetExtendedHandshake(&message.ExtendedHandshake{M: map[string]int{ExtensionName: 1}, MetadataSize: len(info)})
+	x.Handshake(ap)
+
+	// A piece of the wrong length drops the peer
+	bad, _ := (&Message{Type: MsgData, Piece: 0, TotalSize: len(info), Data: info[:10]}).Encode()
+	if err := x.Message(ap, bad); err == nil {
+		t.Error("expected an error for a short piece")
+	}
+
+	// Metadata that does not match the info hash is downloaded again
+	data, _ := (&Message{Type: MsgData, Piece: 0, TotalSize: len(info), Data: info}).Encode()
+	if err := x.Message(ap, data); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-x.Done():
+		t.Fatal("metadata that does not match the info hash was accepted")
+	default:
+	}
+	if x.Info() != nil {
+		t.Error("unexpected metadata")
+	}
+}
@@ -18,6 +18,12 @@ func BencodeUnmarshall(buf []byte) (any, error) {
 	return result, nil
 }
 
+// BencodeUnmarshallPrefix decodes the bencoded value at the start of the buffer and returns the number of bytes it took,
+// for messages that carry raw data after a bencoded header, such as the data messages of ut_metadata.
+func BencodeUnmarshallPrefix(buf []byte) (any, int, error) {
+	return parseValue(buf, 0)
+}
+
 func parseValue(buf []byte, pos int) (any, int, error) {
 	if len(buf) == 0 || buf == nil {
 		return nil, pos, fmt.Errorf("empty buffer")
@@ -99,7 +105,8 @@ func parseString(buf []byte, pos int) ([]byte, int, error) {
 	}
 
 	pos++
-	if (pos + offset) > length {
+	// Compared without adding, so a huge length from the network cannot overflow
+	if offset > length-pos {
 		return nil, pos, fmt.Errorf("out of bounds for offset at pos %d", pos+offset)
 	}
 
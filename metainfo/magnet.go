@@ -0,0 +1,253 @@
+package metainfo
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Magnet is a magnet link of a torrent (BEP 9), which names the torrent by its info hash.
+type Magnet struct {
+	InfoHash [20]byte
+	Name     string   // dn, the display name
+	Trackers []string // tr, the tracker URLs
+	Peers    []string // x.pe, peers to connect to as host:port
+	Select   []int    // so, the indices of the files to download (BEP 53)
+}
+
+// ParseMagnet parses a magnet URI with a BitTorrent info hash, in hex or base32.
+func ParseMagnet(uri string) (*Magnet, error) {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("[magnet] %v", err)
+	}
+	if parsed.Scheme != "magnet" {
+		return nil, fmt.Errorf("[magnet] not a magnet link: %s", uri)
+	}
+
+	query, err := url.ParseQuery(parsed.RawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("[magnet] %v", err)
+	}
+
+	var m Magnet
+	found := false
+	for _, xt := range query["xt"] {
+		encoded, ok := strings.CutPrefix(xt, "urn:btih:")
+		if !ok {
+			continue
+		}
+
+		m.InfoHash, err = decodeInfoHash(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("[magnet] %v", err)
+		}
+		found = true
+		break
+	}
+	if !found {
+		return nil, fmt.Errorf("[magnet] missing urn:btih info hash")
+	}
+
+	m.Name = query.Get("dn")
+
+	seen := make(map[string]bool)
+	for _, tr := range query["tr"] {
+		trackerUrl, ok := parseTrackerUrl(tr)
+		if !ok || seen[trackerUrl] {
+			continue
+		}
+		seen[trackerUrl] = true
+		m.Trackers = append(m.Trackers, trackerUrl)
+	}
+
+	m.Peers = query["x.pe"]
+
+	if so := query.Get("so"); so != "" {
+		m.Select, err = parseSelectOnly(so)
+		if err != nil {
+			return nil, fmt.Errorf("[magnet] %v", err)
+		}
+	}
+
+	return &m, nil
+}
+
+// decodeInfoHash decodes an info hash of 40 hex or 32 base32 characters.
+func decodeInfoHash(encoded string) ([20]byte, error) {
+	var infoHash [20]byte
+
+	var decoded []byte
+	var err error
+	switch len(encoded) {
+	case 40:
+		decoded, err = hex.DecodeString(encoded)
+	case 32:
+		decoded, err = base32.StdEncoding.DecodeString(strings.ToUpper(encoded))
+	default:
+		return infoHash, fmt.Errorf("invalid info hash length %d", len(encoded))
+	}
+	if err != nil {
+		return infoHash, fmt.Errorf("invalid info hash: %v", err)
+	}
+
+	copy(infoHash[:], decoded)
+	return infoHash, nil
+}
+
+// parseSelectOnly parses the file indices of so, a comma separated list of indices and ranges such as 0,2,4-6.
+func parseSelectOnly(so string) ([]int, error) {
+	var indices []int
+
+	for _, part := range strings.Split(so, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+
+		start, err := strconv.Atoi(first)
+		if err != nil || start < 0 {
+			return nil, fmt.Errorf("invalid file index %q", part)
+		}
+		end := start
+		if isRange {
+			end, err = strconv.Atoi(last)
+			if err != nil || end < start {
+				return nil, fmt.Errorf("invalid file range %q", part)
+			}
+		}
+
+		for i := start; i <= end; i++ {
+			indices = append(indices, i)
+		}
+	}
+
+	return indices, nil
+}
+
+// String returns the magnet URI, with the info hash in hex.
+func (m *Magnet) String() string {
+	var b strings.Builder
+	b.WriteString("magnet:?xt=urn:btih:")
+	b.WriteString(hex.EncodeToString(m.InfoHash[:]))
+
+	if m.Name != "" {
+		b.WriteString("&dn=" + url.QueryEscape(m.Name))
+	}
+	for _, tr := range m.Trackers {
+		b.WriteString("&tr=" + url.QueryEscape(tr))
+	}
+	for _, pe := range m.Peers {
+		b.WriteString("&x.pe=" + url.QueryEscape(pe))
+	}
+	if len(m.Select) > 0 {
+		b.WriteString("&so=" + formatSelectOnly(m.Select))
+	}
+
+	return b.String()
+}
+
+// formatSelectOnly formats the file indices of so, joining consecutive indices into ranges.
+func formatSelectOnly(indices []int) string {
+	var parts []string
+
+	for i := 0; i < len(indices); {
+		j := i
+		for j+1 < len(indices) && indices[j+1] == indices[j]+1 {
+			j++
+		}
+
+		if i == j {
+			parts = append(parts, strconv.Itoa(indices[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", indices[i], indices[j]))
+		}
+		i = j + 1
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// Magnet returns the magnet link of the torrent, with its name and every tracker.
+func (t *Torrent) Magnet() *Magnet {
+	m := &Magnet{
+		InfoHash: t.InfoHash,
+		Name:     t.Info.Name,
+	}
+	for _, tier := range t.AnnounceList {
+		m.Trackers = append(m.Trackers, tier...)
+	}
+
+	return m
+}
+
+/*
+Torrent returns the torrent of the magnet link before its metadata is known. It only has the info hash,
+the name and the trackers, one tier each, which is enough to search for peers. SetMetadata completes it.
+*/
+func (m *Magnet) Torrent(outputPath string) *Torrent {
+	t := &Torrent{
+		InfoHash:   m.InfoHash,
+		OutputPath: outputPath,
+	}
+	t.Info.Name = m.Name
+	for _, tr := range m.Trackers {
+		t.AnnounceList = append(t.AnnounceList, []string{tr})
+	}
+	if len(m.Trackers) > 0 {
+		t.Announce = m.Trackers[0]
+	}
+
+	return t
+}
+
+/*
+SetMetadata completes the torrent of a magnet link with its info dictionary, downloaded from the peers.
+The info dictionary must match the info hash. The torrent file is rebuilt from it and the trackers,
+so it can be saved along with the download to resume it.
+*/
+func (t *Torrent) SetMetadata(info []byte) error {
+	if sha1.Sum(info) != t.InfoHash {
+		return fmt.Errorf("[torrent] metadata does not match the info hash")
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("d")
+	if t.Announce != "" {
+		buf.WriteString("8:announce")
+		encodeString(&buf, []byte(t.Announce))
+	}
+	if len(t.AnnounceList) > 0 {
+		tiers := make([]any, len(t.AnnounceList))
+		for i, tier := range t.AnnounceList {
+			urls := make([]any, len(tier))
+			for j, tr := range tier {
+				urls[j] = []byte(tr)
+			}
+			tiers[i] = urls
+		}
+
+		buf.WriteString("13:announce-list")
+		if err := encodeList(&buf, tiers); err != nil {
+			return fmt.Errorf("[torrent] %v", err)
+		}
+	}
+	// The info dictionary is kept as is, as the info hash is computed over its bytes
+	buf.WriteString("4:info")
+	buf.Write(info)
+	buf.WriteString("e")
+
+	full := Torrent{OutputPath: t.OutputPath}
+	if err := full.populateTorrent(buf.Bytes()); err != nil {
+		return fmt.Errorf("[torrent] %v", err)
+	}
+	if full.InfoHash != t.InfoHash {
+		return fmt.Errorf("[torrent] metadata is not canonically bencoded")
+	}
+
+	full.BencodeByteStream = buf.Bytes()
+	*t = full
+	return nil
+}
@@ -0,0 +1,110 @@
+package metainfo
+
+import (
+	"crypto/sha1"
+	"slices"
+	"testing"
+)
+
+func TestParseMagnet(t *testing.T) {
+	uri := "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&dn=Some+File&tr=udp%3A%2F%2Ftracker.example.org%3A6969&tr=wss%3A%2F%2Fignored.example.org&x.pe=10.0.0.1%3A6881&so=0,2,4-6"
+
+	m, err := ParseMagnet(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Name != "Some File" {
+		t.Errorf("unexpected name %q", m.Name)
+	}
+	if m.InfoHash[0] != 0xc1 || m.InfoHash[19] != 0x8a {
+		t.Errorf("unexpected info hash %x", m.InfoHash)
+	}
+	if !slices.Equal(m.Trackers, []string{"udp://tracker.example.org:6969"}) {
+		t.Errorf("unexpected trackers %v", m.Trackers)
+	}
+	if !slices.Equal(m.Peers, []string{"10.0.0.1:6881"}) {
+		t.Errorf("unexpected peers %v", m.Peers)
+	}
+	if !slices.Equal(m.Select, []int{0, 2, 4, 5, 6}) {
+		t.Errorf("unexpected selected files %v", m.Select)
+	}
+
+	// The link survives a round trip
+	again, err := ParseMagnet(m.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.InfoHash != m.InfoHash || again.Name != m.Name || !slices.Equal(again.Select, m.Select) ||
+		!slices.Equal(again.Trackers, m.Trackers) || !slices.Equal(again.Peers, m.Peers) {
+		t.Errorf("round trip changed the link: %+v", again)
+	}
+}
+
+func TestParseMagnetBase32(t *testing.T) {
+	hex, err := ParseMagnet("magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base32, err := ParseMagnet("magnet:?xt=urn:btih:YEX6DQDLXISUVHOJ6UM3GNNKPQJWPKEK")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hex.InfoHash != base32.InfoHash {
+		t.Errorf("base32 info hash %x differs from hex %x", base32.InfoHash, hex.InfoHash)
+	}
+}
+
+func TestParseMagnetErrors(t *testing.T) {
+	for _, uri := range []string{
+		"http://example.org/file.torrent",
+		"magnet:?dn=nothing",
+		"magnet:?xt=urn:btih:1234",
+		"magnet:?xt=urn:btih:zz2fe1c06bba254a9dc9f519b335aa7c1367a88a",
+		"magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&so=3-1",
+	} {
+		if _, err := ParseMagnet(uri); err == nil {
+			t.Errorf("expected an error for %s", uri)
+		}
+	}
+}
+
+func TestSetMetadata(t *testing.T) {
+	info, err := BencodeMarshall(map[string]any{
+		"name":         []byte("file.bin"),
+		"length":       40000,
+		"piece length": 32768,
+		"pieces":       make([]byte, 40),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &Magnet{InfoHash: sha1.Sum(info), Trackers: []string{"udp://tracker.example.org:6969"}}
+	tr := m.Torrent("out")
+
+	if err := tr.SetMetadata(info[:len(info)-1]); err == nil {
+		t.Fatal("metadata that does not match the info hash was accepted")
+	}
+	if err := tr.SetMetadata(info); err != nil {
+		t.Fatal(err)
+	}
+
+	if tr.Info.Name != "file.bin" || tr.Info.Length != 40000 || len(tr.PiecesHash) != 2 || tr.OutputPath != "out" {
+		t.Errorf("unexpected torrent %+v", tr.Info)
+	}
+	if len(tr.AnnounceList) != 1 || tr.AnnounceList[0][0] != "udp://tracker.example.org:6969" {
+		t.Errorf("unexpected trackers %v", tr.AnnounceList)
+	}
+
+	// The rebuilt torrent file parses to the same torrent
+	var reparsed Torrent
+	if err := reparsed.populateTorrent(tr.BencodeByteStream); err != nil || reparsed.InfoHash != m.InfoHash {
+		t.Errorf("rebuilt torrent file does not match: %v", err)
+	}
+
+	if magnet := tr.Magnet(); magnet.InfoHash != m.InfoHash || magnet.Name != "file.bin" {
+		t.Errorf("unexpected magnet %s", magnet)
+	}
+}
@@ -3,19 +3,24 @@ package metainfo
 import (
 	"fmt"
 	"io"
+	"math/rand"
+	"net"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 )
 
 type Torrent struct {
 	Announce     string
-	AnnounceList []string
+	AnnounceList [][]string // tiers of tracker URLs (BEP 12), shuffled within each tier
+	Nodes        []string   // DHT nodes of trackerless torrents as host:port (BEP 5)
 	CreatedBy    string
 	CreationDate int
 	Comment      string
 	Info         Info
 	InfoHash     [20]byte
+	InfoBytes    []byte // the bencoded info dictionary, the metadata of ut_metadata (BEP 9)
 	PiecesHash   [][20]byte
 	IsMultiFile  bool
 	OutputPath   string
@@ -29,6 +34,7 @@ type Info struct {
 	PieceLength int
 	Pieces      []byte
 	Files       []File
+	Private     bool // disables the peer exchange (BEP 27)
 }
 
 type File struct {
@@ -114,6 +120,11 @@ func (t *Torrent) populateTorrent(bencodeByteStream []byte) error {
 		return fmt.Errorf("missing required field: info.pieces")
 	}
 
+	// Optional: private
+	if private, ok := info["private"].(int); ok {
+		t.Info.Private = private == 1
+	}
+
 	// Handle single-file OR multi-file
 	if length, ok := info["length"].(int); ok {
 		// Single-file mode
@@ -161,30 +172,64 @@ func (t *Torrent) populateTorrent(bencodeByteStream []byte) error {
 		return fmt.Errorf("missing required field: either info.length or info.files")
 	}
 
-	// Required: announce-list
+	// Optional: announce-list
 	if announceList, ok := torrent["announce-list"].([]any); ok {
+		seen := make(map[string]bool)
+
 		for _, tier := range announceList {
-			if tracker, ok := tier.([]any); ok {
-				for _, item := range tracker {
-					if str, ok := item.([]byte); ok {
-						parsed, err := url.Parse(string(str))
-						if err != nil {
-							return fmt.Errorf("invalid announce-list entry: %v", err)
-						}
+			trackers, ok := tier.([]any)
+			if !ok {
+				return fmt.Errorf("invalid announce-list format")
+			}
 
-						if parsed.Scheme == "udp" {
-							t.AnnounceList = append(t.AnnounceList, parsed.Host)
-						}
-					} else {
-						return fmt.Errorf("invalid announce-list entry")
-					}
+			var urls []string
+			for _, item := range trackers {
+				str, ok := item.([]byte)
+				if !ok {
+					return fmt.Errorf("invalid announce-list entry")
 				}
-			} else {
-				return fmt.Errorf("invalid announce-list format")
+
+				trackerUrl, ok := parseTrackerUrl(string(str))
+				if !ok || seen[trackerUrl] {
+					continue
+				}
+				seen[trackerUrl] = true
+				urls = append(urls, trackerUrl)
+			}
+
+			if len(urls) > 0 {
+				rand.Shuffle(len(urls), func(i, j int) {
+					urls[i], urls[j] = urls[j], urls[i]
+				})
+				t.AnnounceList = append(t.AnnounceList, urls)
 			}
 		}
 	}
 
+	// Fall back to the announce key when there is no usable announce-list
+	if len(t.AnnounceList) == 0 && t.Announce != "" {
+		if trackerUrl, ok := parseTrackerUrl(t.Announce); ok {
+			t.AnnounceList = [][]string{{trackerUrl}}
+		}
+	}
+
+	// Optional: nodes, a list of [host, port] pairs
+	if nodes, ok := torrent["nodes"].([]any); ok {
+		for _, item := range nodes {
+			pair, ok := item.([]any)
+			if !ok || len(pair) != 2 {
+				continue
+			}
+
+			host, ok := pair[0].([]byte)
+			port, portOk := pair[1].(int)
+			if !ok || !portOk || len(host) == 0 || port <= 0 || port > 65535 {
+				continue
+			}
+			t.Nodes = append(t.Nodes, net.JoinHostPort(string(host), strconv.Itoa(port)))
+		}
+	}
+
 	// Optional fields
 	if createdBy, ok := torrent["created by"].([]byte); ok {
 		t.CreatedBy = string(createdBy)
@@ -203,6 +248,7 @@ func (t *Torrent) populateTorrent(bencodeByteStream []byte) error {
 	}
 	infoHash := hashInfoDirectory(infoEncoded)
 	t.InfoHash = infoHash
+	t.InfoBytes = infoEncoded
 
 	// Split pieces into 20 byte SHA1 hashes
 	piecesHash, err := splitPieces(t.Info.Pieces)
@@ -214,6 +260,21 @@ func (t *Torrent) populateTorrent(bencodeByteStream []byte) error {
 	return nil
 }
 
+// parseTrackerUrl validates a tracker URL and reports whether its scheme is supported.
+func parseTrackerUrl(rawUrl string) (string, bool) {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil || parsed.Host == "" {
+		return "", false
+	}
+
+	switch parsed.Scheme {
+	case "udp", "http", "https":
+		return parsed.String(), true
+	default:
+		return "", false
+	}
+}
+
 func (t Torrent) computeTotalLength() int {
 	totalLength := 0
 
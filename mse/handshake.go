@@ -0,0 +1,253 @@
+package mse
+
+import (
+	"bytes"
+	"crypto/rc4"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// protocolHeader is the start of a plaintext BitTorrent handshake, which tells an incoming plaintext connection apart.
+var protocolHeader = []byte("\x13BitTorrent protocol")
+
+/*
+Initiate performs the MSE handshake as the side that connected, for the torrent with the info hash.
+The initial payload, usually our BitTorrent handshake, is sent encrypted along with it. The policy
+decides the crypto methods we offer, and must not be PolicyPlaintext. The caller sets the deadline.
+*/
+func Initiate(conn net.Conn, infoHash [20]byte, policy Policy, payload []byte) (*Conn, error) {
+	provide := policy.provide()
+	if provide&CryptoRC4 == 0 {
+		return nil, fmt.Errorf("[mse] policy %s does not encrypt", policy)
+	}
+	if len(payload) > 0xffff {
+		return nil, fmt.Errorf("[mse] initial payload too long")
+	}
+
+	// 1. A->B: Ya, PadA
+	keys, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	padA, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(keys.public, padA...)); err != nil {
+		return nil, err
+	}
+
+	// 2. B->A: Yb, PadB
+	yb := make([]byte, keyLength)
+	if _, err := io.ReadFull(conn, yb); err != nil {
+		return nil, err
+	}
+	s, err := keys.secret(yb)
+	if err != nil {
+		return nil, err
+	}
+
+	// 3. A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S), ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	encrypt := newCipher(hash([]byte("keyA"), s, infoHash[:]))
+	decrypt := newCipher(hash([]byte("keyB"), s, infoHash[:]))
+
+	var msg bytes.Buffer
+	msg.Write(hash([]byte("req1"), s))
+	msg.Write(xor(hash([]byte("req2"), infoHash[:]), hash([]byte("req3"), s)))
+
+	var plain bytes.Buffer
+	plain.Write(verificationConstant)
+	binary.Write(&plain, binary.BigEndian, provide)
+	binary.Write(&plain, binary.BigEndian, uint16(0)) // no PadC
+	binary.Write(&plain, binary.BigEndian, uint16(len(payload)))
+	plain.Write(payload)
+
+	encrypted := make([]byte, plain.Len())
+	encrypt.XORKeyStream(encrypted, plain.Bytes())
+	msg.Write(encrypted)
+
+	if _, err := conn.Write(msg.Bytes()); err != nil {
+		return nil, err
+	}
+
+	// 4. B->A: ENCRYPT(VC, crypto_select, len(padD), padD), found by the encrypted VC after PadB
+	vc := make([]byte, len(verificationConstant))
+	decrypt.XORKeyStream(vc, verificationConstant)
+	if err := synchronize(conn, vc, maxPadLength); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 6)
+	if err := readDecrypted(conn, decrypt, header); err != nil {
+		return nil, err
+	}
+	selected := binary.BigEndian.Uint32(header[:4])
+	padLength := int(binary.BigEndian.Uint16(header[4:]))
+	if (selected != CryptoRC4 && selected != CryptoPlaintext) || selected&provide == 0 {
+		return nil, fmt.Errorf("[mse] peer selected crypto method %d, which we did not offer", selected)
+	}
+	if padLength > maxPadLength {
+		return nil, fmt.Errorf("[mse] padding too long")
+	}
+	if err := readDecrypted(conn, decrypt, make([]byte, padLength)); err != nil {
+		return nil, err
+	}
+
+	return newConn(conn, nil, selected, encrypt, decrypt), nil
+}
+
+/*
+Accept performs the handshake of a connection a peer opened to us. A plaintext BitTorrent handshake is
+passed through unless the policy requires encryption, and the MSE handshake is answered unless the policy
+is PolicyPlaintext. The torrent is found among the info hashes. The BitTorrent handshake of the peer is the
+first thing read from the returned connection, whichever way it came. The caller sets the deadline.
+*/
+func Accept(conn net.Conn, policy Policy, infoHashes func() [][20]byte) (*Conn, error) {
+	prefix := make([]byte, len(protocolHeader))
+	if _, err := io.ReadFull(conn, prefix); err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(prefix, protocolHeader) {
+		if policy == PolicyRequire {
+			return nil, fmt.Errorf("[mse] refused plaintext connection")
+		}
+		return newConn(conn, prefix, 0, nil, nil), nil
+	}
+	if policy == PolicyPlaintext {
+		return nil, fmt.Errorf("[mse] refused encrypted connection")
+	}
+
+	// 1. A->B: Ya, PadA
+	ya := make([]byte, keyLength)
+	copy(ya, prefix)
+	if _, err := io.ReadFull(conn, ya[len(prefix):]); err != nil {
+		return nil, err
+	}
+
+	// 2. B->A: Yb, PadB
+	keys, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	s, err := keys.secret(ya)
+	if err != nil {
+		return nil, err
+	}
+	padB, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(keys.public, padB...)); err != nil {
+		return nil, err
+	}
+
+	// 3. A->B: HASH('req1', S) after PadA, then HASH('req2', SKEY) xor HASH('req3', S), which names the torrent
+	if err := synchronize(conn, hash([]byte("req1"), s), maxPadLength); err != nil {
+		return nil, err
+	}
+
+	obfuscated := make([]byte, 20)
+	if _, err := io.ReadFull(conn, obfuscated); err != nil {
+		return nil, err
+	}
+	req2 := xor(obfuscated, hash([]byte("req3"), s))
+
+	var infoHash [20]byte
+	found := false
+	for _, candidate := range infoHashes() {
+		if bytes.Equal(hash([]byte("req2"), candidate[:]), req2) {
+			infoHash, found = candidate, true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("[mse] unknown torrent")
+	}
+
+	encrypt := newCipher(hash([]byte("keyB"), s, infoHash[:]))
+	decrypt := newCipher(hash([]byte("keyA"), s, infoHash[:]))
+
+	// ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	header := make([]byte, 14)
+	if err := readDecrypted(conn, decrypt, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:8], verificationConstant) {
+		return nil, fmt.Errorf("[mse] invalid verification constant")
+	}
+	provide := binary.BigEndian.Uint32(header[8:12])
+	padLength := int(binary.BigEndian.Uint16(header[12:]))
+	if padLength > maxPadLength {
+		return nil, fmt.Errorf("[mse] padding too long")
+	}
+
+	rest := make([]byte, padLength+2)
+	if err := readDecrypted(conn, decrypt, rest); err != nil {
+		return nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(rest[padLength:]))
+	if err := readDecrypted(conn, decrypt, payload); err != nil {
+		return nil, err
+	}
+
+	// Our preference among the methods both sides accept
+	var selected uint32
+	switch accepted := provide & policy.provide(); {
+	case accepted&CryptoRC4 != 0:
+		selected = CryptoRC4
+	case accepted&CryptoPlaintext != 0:
+		selected = CryptoPlaintext
+	default:
+		return nil, fmt.Errorf("[mse] no common crypto method in %d", provide)
+	}
+
+	// 4. B->A: ENCRYPT(VC, crypto_select, len(padD), padD), without padD
+	reply := make([]byte, 14)
+	copy(reply, verificationConstant)
+	binary.BigEndian.PutUint32(reply[8:12], selected)
+	encrypt.XORKeyStream(reply, reply)
+	if _, err := conn.Write(reply); err != nil {
+		return nil, err
+	}
+
+	return newConn(conn, payload, selected, encrypt, decrypt), nil
+}
+
+// synchronize reads up to the pattern, which follows at most maxSkip bytes of padding.
+func synchronize(r io.Reader, pattern []byte, maxSkip int) error {
+	window := make([]byte, 0, maxSkip+len(pattern))
+	b := make([]byte, 1)
+
+	for len(window) < cap(window) {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return err
+		}
+		window = append(window, b[0])
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("[mse] handshake not found")
+}
+
+// readDecrypted reads and decrypts exactly len(buf) bytes.
+func readDecrypted(r io.Reader, c *rc4.Cipher, buf []byte) error {
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+	c.XORKeyStream(buf, buf)
+	return nil
+}
+
+// xor returns a xor b, which have the same length.
+func xor(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
@@ -0,0 +1,202 @@
+package mse
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+)
+
+// Policy decides whether the connections to and from the peers are encrypted.
+type Policy int
+
+const (
+	PolicyPlaintext Policy = iota // never encrypted
+	PolicyPrefer                  // encrypted when the peer supports it, plaintext otherwise
+	PolicyRequire                 // always encrypted, peers that do not support it are dropped
+)
+
+func (p Policy) String() string {
+	switch p {
+	case PolicyPlaintext:
+		return "plaintext"
+	case PolicyPrefer:
+		return "prefer"
+	case PolicyRequire:
+		return "require"
+	default:
+		return "unknown"
+	}
+}
+
+// ParsePolicy parses a policy by its name: plaintext, prefer or require.
+func ParsePolicy(name string) (Policy, error) {
+	for _, p := range []Policy{PolicyPlaintext, PolicyPrefer, PolicyRequire} {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("[mse] unknown encryption policy %q", name)
+}
+
+// The crypto methods of crypto_provide and crypto_select
+const (
+	CryptoPlaintext = 0x01 // only the handshake is obfuscated
+	CryptoRC4       = 0x02 // the whole stream is encrypted
+)
+
+// provide returns the crypto methods we offer or accept under the policy.
+func (p Policy) provide() uint32 {
+	switch p {
+	case PolicyPrefer:
+		return CryptoRC4 | CryptoPlaintext
+	case PolicyRequire:
+		return CryptoRC4
+	default:
+		return CryptoPlaintext
+	}
+}
+
+const (
+	// keyLength is the length of the public keys and the shared secret.
+	keyLength = 96
+
+	// maxPadLength is the longest padding of every step of the handshake.
+	maxPadLength = 512
+
+	// discardLength is the number of RC4 key stream bytes thrown away before use.
+	discardLength = 1024
+)
+
+var (
+	// prime is the 768-bit prime P of the Diffie-Hellman key exchange, with the generator 2.
+	prime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	generator = big.NewInt(2)
+
+	// verificationConstant is VC, which both sides encrypt to find the start of the encrypted stream.
+	verificationConstant = make([]byte, 8)
+)
+
+// keyPair is a Diffie-Hellman key pair.
+type keyPair struct {
+	private *big.Int
+	public  []byte
+}
+
+// newKeyPair generates a key pair with a random 160-bit private key.
+func newKeyPair() (*keyPair, error) {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+
+	private := new(big.Int).SetBytes(buf)
+	public := new(big.Int).Exp(generator, private, prime)
+
+	return &keyPair{private: private, public: public.FillBytes(make([]byte, keyLength))}, nil
+}
+
+// secret computes the shared secret S from the public key of the other side.
+func (k *keyPair) secret(public []byte) ([]byte, error) {
+	y := new(big.Int).SetBytes(public)
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(prime) >= 0 {
+		return nil, fmt.Errorf("[mse] invalid public key")
+	}
+
+	return new(big.Int).Exp(y, k.private, prime).FillBytes(make([]byte, keyLength)), nil
+}
+
+// hash returns the SHA-1 of the concatenated parts, HASH() of the specification.
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+// newCipher returns the RC4 cipher of the key, with the first 1024 bytes of its key stream discarded.
+func newCipher(key []byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(key) // the key is a 20-byte hash, which is always valid
+	discard := make([]byte, discardLength)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+// randomPad returns a padding of random length and content.
+func randomPad() ([]byte, error) {
+	var n [2]byte
+	if _, err := rand.Read(n[:]); err != nil {
+		return nil, err
+	}
+
+	pad := make([]byte, (int(n[0])<<8|int(n[1]))%(maxPadLength+1))
+	if _, err := rand.Read(pad); err != nil {
+		return nil, err
+	}
+	return pad, nil
+}
+
+/*
+Conn is a connection after the handshake. It decrypts what is read and encrypts what is written when RC4
+was selected, so the peer wire protocol runs over it unchanged. The bytes that were received during the
+handshake, such as the initial payload, are read first.
+*/
+type Conn struct {
+	net.Conn
+	reader  io.Reader
+	encrypt *rc4.Cipher // nil for plaintext
+	method  uint32
+	wmu     sync.Mutex
+}
+
+// newConn wraps the connection, reading the buffered bytes before the stream.
+func newConn(conn net.Conn, buffered []byte, method uint32, encrypt, decrypt *rc4.Cipher) *Conn {
+	var reader io.Reader = conn
+	if method == CryptoRC4 {
+		reader = cipher.StreamReader{S: decrypt, R: conn}
+	}
+	if len(buffered) > 0 {
+		reader = io.MultiReader(bytes.NewReader(buffered), reader)
+	}
+
+	c := &Conn{Conn: conn, reader: reader, method: method}
+	if method == CryptoRC4 {
+		c.encrypt = encrypt
+	}
+	return c
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// Write encrypts and writes the bytes. Writes are serialized, as the key stream must stay in order.
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.encrypt == nil {
+		return c.Conn.Write(b)
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	buf := make([]byte, len(b))
+	c.encrypt.XORKeyStream(buf, b)
+	return c.Conn.Write(buf)
+}
+
+// Encrypted reports whether the stream is encrypted with RC4, rather than only the handshake.
+func (c *Conn) Encrypted() bool {
+	return c.method == CryptoRC4
+}
+
+// Obfuscated reports whether the connection went through the MSE handshake, as opposed to a plaintext BitTorrent handshake.
+func (c *Conn) Obfuscated() bool {
+	return c.method != 0
+}
@@ -0,0 +1,156 @@
+package mse
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// connPair returns both ends of a loopback TCP connection, which buffers the handshake unlike net.Pipe.
+func connPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+
+	dialed, err := net.Dial("tcp4", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := <-accepted
+	if remote == nil {
+		t.Fatal("accept failed")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	dialed.SetDeadline(deadline)
+	remote.SetDeadline(deadline)
+	t.Cleanup(func() {
+		dialed.Close()
+		remote.Close()
+	})
+
+	return dialed, remote
+}
+
+type acceptResult struct {
+	conn *Conn
+	err  error
+}
+
+// handshake runs Initiate and Accept with the policies on both ends of a connection.
+func handshake(t *testing.T, outbound, inbound Policy, infoHash [20]byte, payload []byte) (*Conn, error, *Conn, error) {
+	t.Helper()
+
+	dialed, remote := connPair(t)
+	infoHashes := func() [][20]byte { return [][20]byte{{9}, infoHash} }
+
+	result := make(chan acceptResult, 1)
+	go func() {
+		conn, err := Accept(remote, inbound, infoHashes)
+		if err != nil {
+			remote.Close()
+		}
+		result <- acceptResult{conn, err}
+	}()
+
+	out, outErr := Initiate(dialed, [20]byte{1, 2, 3}, outbound, payload)
+	in := <-result
+	return out, outErr, in.conn, in.err
+}
+
+func TestHandshake(t *testing.T) {
+	for _, tc := range []struct {
+		outbound, inbound Policy
+		encrypted         bool
+	}{
+		{PolicyPrefer, PolicyPrefer, true},
+		{PolicyRequire, PolicyPrefer, true},
+		{PolicyPrefer, PolicyRequire, true},
+	} {
+		out, err, in, acceptErr := handshake(t, tc.outbound, tc.inbound, [20]byte{1, 2, 3}, []byte("initial payload"))
+		if err != nil || acceptErr != nil {
+			t.Fatalf("%s to %s: %v, %v", tc.outbound, tc.inbound, err, acceptErr)
+		}
+		if out.Encrypted() != tc.encrypted || in.Encrypted() != tc.encrypted || !in.Obfuscated() {
+			t.Errorf("%s to %s: unexpected crypto method %d", tc.outbound, tc.inbound, out.method)
+		}
+
+		// The initial payload is read first, then the stream continues in both directions
+		buf := make([]byte, len("initial payload"))
+		if _, err := io.ReadFull(in, buf); err != nil || string(buf) != "initial payload" {
+			t.Fatalf("unexpected initial payload %q (%v)", buf, err)
+		}
+
+		go out.Write([]byte("ping"))
+		if _, err := io.ReadFull(in, buf[:4]); err != nil || string(buf[:4]) != "ping" {
+			t.Errorf("unexpected message %q (%v)", buf[:4], err)
+		}
+		go in.Write([]byte("pong"))
+		if _, err := io.ReadFull(out, buf[:4]); err != nil || string(buf[:4]) != "pong" {
+			t.Errorf("unexpected message %q (%v)", buf[:4], err)
+		}
+	}
+}
+
+func TestAcceptPlaintext(t *testing.T) {
+	dialed, remote := connPair(t)
+	hs := append([]byte("\x13BitTorrent protocol"), make([]byte, 48)...)
+	go dialed.Write(hs)
+
+	conn, err := Accept(remote, PolicyPrefer, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.Obfuscated() {
+		t.Error("plaintext connection reported as obfuscated")
+	}
+
+	// The plaintext handshake is read whole, the part sniffed by Accept included
+	buf := make([]byte, len(hs))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf[:20]) != "\x13BitTorrent protocol" {
+		t.Errorf("unexpected handshake %q (%v)", buf, err)
+	}
+
+	// Encryption is required
+	dialed, remote = connPair(t)
+	go dialed.Write(hs)
+	if _, err := Accept(remote, PolicyRequire, nil); err == nil {
+		t.Error("plaintext connection was accepted")
+	}
+}
+
+func TestHandshakeRefused(t *testing.T) {
+	// The peer only accepts plaintext
+	if _, _, _, err := handshake(t, PolicyPrefer, PolicyPlaintext, [20]byte{1, 2, 3}, nil); err == nil {
+		t.Error("encrypted connection was accepted")
+	}
+
+	// A torrent the peer does not have
+	if _, _, _, err := handshake(t, PolicyRequire, PolicyPrefer, [20]byte{4, 5, 6}, nil); err == nil {
+		t.Error("connection for an unknown torrent was accepted")
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	if p, err := ParsePolicy("require"); err != nil || p != PolicyRequire {
+		t.Errorf("unexpected policy %s (%v)", p, err)
+	}
+	if _, err := ParsePolicy("always"); err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+}
@@ -0,0 +1,235 @@
+package peer
+
+import (
+	"strconv"
+	"strings"
+)
+
+// versionChars are the digits of the version characters of peer IDs, where A is 10 and z is 61.
+const versionChars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// ClientInfo is the client software of a peer, identified from its peer ID or its extended handshake.
+type ClientInfo struct {
+	Name    string
+	Version string
+	Code    string // the client code of the peer ID, such as "qB", empty for the extended handshake
+}
+
+func (ci ClientInfo) String() string {
+	if ci.Name == "" {
+		return "unknown"
+	}
+	if ci.Version == "" {
+		return ci.Name
+	}
+	return ci.Name + " " + ci.Version
+}
+
+// Known reports whether the client was identified.
+func (ci ClientInfo) Known() bool {
+	return ci.Name != ""
+}
+
+// azureusClients are the client codes of Azureus-style peer IDs, such as -qB4520-.
+var azureusClients = map[string]string{
+	"7T": "aTorrent",
+	"AG": "Ares",
+	"A~": "Ares",
+	"AR": "Arctic",
+	"AT": "Artemis",
+	"AX": "BitPump",
+	"AZ": "Vuze",
+	"BB": "BitBuddy",
+	"BC": "BitComet",
+	"BE": "baretorrent",
+	"BF": "Bitflu",
+	"BG": "BTG",
+	"BI": "BiglyBT",
+	"BL": "BitCometLite",
+	"BN": "Baidu Netdisk",
+	"BP": "BitTorrent Pro",
+	"BR": "BitRocket",
+	"BT": "BitTorrent",
+	"BW": "BitWombat",
+	"CD": "Enhanced CTorrent",
+	"CT": "CTorrent",
+	"CV": "Clover",
+	"DE": "Deluge",
+	"DP": "Propagate Data Client",
+	"EB": "EBit",
+	"ES": "electric sheep",
+	"FC": "FileCroc",
+	"FD": "Free Download Manager",
+	"FT": "FoxTorrent",
+	"FW": "FrostWire",
+	"FX": "Freebox BitTorrent",
+	"GS": "GSTorrent",
+	"HL": "Halite",
+	"HN": "Hydranode",
+	"IL": "iLivid",
+	"KG": "KGet",
+	"KT": "KTorrent",
+	"LC": "LeechCraft",
+	"LH": "LH-ABC",
+	"LP": "Lphant",
+	"LT": "libtorrent",
+	"LW": "LimeWire",
+	"MO": "MonoTorrent",
+	"MP": "MooPolice",
+	"MR": "Miro",
+	"MT": "MoonlightTorrent",
+	"NX": "Net Transport",
+	"OS": "OneSwarm",
+	"OT": "OmegaTorrent",
+	"PD": "Pando",
+	"PI": "PicoTorrent",
+	"QD": "QQDownload",
+	"QT": "Qt 4 Torrent example",
+	"RT": "Retriever",
+	"SB": "Swiftbit",
+	"SD": "Thunder",
+	"SM": "SoMud",
+	"SS": "SwarmScope",
+	"ST": "SymTorrent",
+	"SZ": "Shareaza",
+	"TB": "Torch",
+	"TL": "Tribler",
+	"TN": "TorrentDotNET",
+	"TR": "Transmission",
+	"TS": "Torrentstorm",
+	"TT": "TuoTu",
+	"UL": "uLeecher!",
+	"UM": "µTorrent Mac",
+	"UT": "µTorrent",
+	"UW": "µTorrent Web",
+	"VG": "Vagaa",
+	"WD": "WebTorrent Desktop",
+	"WT": "BitLet",
+	"WW": "WebTorrent",
+	"WY": "FireTorrent",
+	"XF": "Xfplay",
+	"XL": "Xunlei",
+	"XT": "XanTorrent",
+	"XX": "Xtorrent",
+	"ZT": "ZipTorrent",
+	"lt": "rTorrent",
+	"pX": "pHoeniX",
+	"qB": "qBittorrent",
+	"st": "SharkTorrent",
+}
+
+// shadowClients are the client letters of Shadow-style peer IDs, such as S58B-----.
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow",
+	'T': "BitTornado",
+	'U': "UPnP NAT BitTorrent",
+}
+
+/*
+IdentifyClient identifies the client of a peer from its peer ID, which is one of
+
+	-qB4520-xxxxxxxxxxxx    Azureus-style, a client code and four version characters
+	S58B-----xxxxxxxxxxx    Shadow-style, a client letter and up to five version characters
+	M7-2-3--xxxxxxxxxxxx    Mainline, M and a dash separated version
+
+The name is empty if the peer ID has none of these forms.
+*/
+func IdentifyClient(peerId [20]byte) ClientInfo {
+	id := string(peerId[:])
+
+	if id[0] == '-' && id[7] == '-' && isVersionChars(id[3:7]) {
+		code := id[1:3]
+		name, ok := azureusClients[code]
+		if !ok {
+			name = "Unknown (" + code + ")"
+		}
+		return ClientInfo{Name: name, Version: decodeVersion(id[3:7]), Code: code}
+	}
+
+	if info, ok := identifyMainline(id); ok {
+		return info
+	}
+
+	if name, ok := shadowClients[id[0]]; ok {
+		version := id[1:6]
+		if i := strings.IndexByte(version, '-'); i >= 0 {
+			version = version[:i]
+		}
+		if version != "" && isVersionChars(version) {
+			return ClientInfo{Name: name, Version: decodeVersion(version), Code: id[:1]}
+		}
+	}
+
+	return ClientInfo{}
+}
+
+// identifyMainline identifies the Mainline-style peer IDs, such as M4-3-6-- and M4-20-8-.
+func identifyMainline(id string) (ClientInfo, bool) {
+	if id[0] != 'M' {
+		return ClientInfo{}, false
+	}
+
+	parts := strings.SplitN(id[1:8], "-", 4)
+	if len(parts) < 3 {
+		return ClientInfo{}, false
+	}
+	for _, part := range parts[:3] {
+		if part == "" || strings.Trim(part, "0123456789") != "" {
+			return ClientInfo{}, false
+		}
+	}
+
+	return ClientInfo{Name: "Mainline", Version: strings.Join(parts[:3], "."), Code: "M"}, true
+}
+
+/*
+ParseClientVersion identifies the client of a peer from the "v" of its extended handshake (BEP 10),
+such as "qBittorrent/4.5.2", "Transmission 4.0.5" or "µTorrent 3.6".
+*/
+func ParseClientVersion(v string) ClientInfo {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return ClientInfo{}
+	}
+
+	// The version is the last word if it starts with a digit, after a space or a slash
+	if i := strings.LastIndexAny(v, " /"); i > 0 {
+		version := strings.TrimPrefix(v[i+1:], "v")
+		if version != "" && version[0] >= '0' && version[0] <= '9' {
+			return ClientInfo{Name: strings.TrimSpace(v[:i]), Version: version}
+		}
+	}
+
+	return ClientInfo{Name: v}
+}
+
+func isVersionChars(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(versionChars, s[i]) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeVersion decodes the version characters of a peer ID as a dotted version, dropping the trailing zeros.
+func decodeVersion(chars string) string {
+	var parts []string
+	for i := 0; i < len(chars); i++ {
+		n := strings.IndexByte(versionChars, chars[i])
+		if n < 0 {
+			n = 0
+		}
+		parts = append(parts, strconv.Itoa(n))
+	}
+
+	for len(parts) > 3 && parts[len(parts)-1] == "0" {
+		parts = parts[:len(parts)-1]
+	}
+
+	return strings.Join(parts, ".")
+}
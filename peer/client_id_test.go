@@ -0,0 +1,56 @@
+package peer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIdentifyClient(t *testing.T) {
+	tests := map[string]string{
+		"-qB4520-abcdefghijkl": "qBittorrent 4.5.2",
+		"-TR3000-abcdefghijkl": "Transmission 3.0.0",
+		"-UT360B-abcdefghijkl": "µTorrent 3.6.0.11",
+		"-ZZ1000-abcdefghijkl": "Unknown (ZZ) 1.0.0",
+		"M4-3-6--abcdefghijkl": "Mainline 4.3.6",
+		"M7-10-2-abcdefghijkl": "Mainline 7.10.2",
+		"S58B-----abcdefghijk": "Shadow 5.8.11",
+		"T03I--00abcdefghijkl": "BitTornado 0.3.18",
+		"\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09\x0a\x0b\x0c\x0d\x0e\x0f\x10\x11\x12\x13": "unknown",
+	}
+
+	for id, expected := range tests {
+		if got := IdentifyClient([20]byte([]byte(id))).String(); got != expected {
+			t.Errorf("%q: expected %q, got %q", id, expected, got)
+		}
+	}
+}
+
+func TestParseClientVersion(t *testing.T) {
+	tests := map[string]string{
+		"qBittorrent/4.5.2":  "qBittorrent 4.5.2",
+		"Transmission 4.0.5": "Transmission 4.0.5",
+		"Deluge v2.1.1":      "Deluge 2.1.1",
+		"BitComet":           "BitComet",
+		"":                   "unknown",
+	}
+
+	for v, expected := range tests {
+		if got := ParseClientVersion(v).String(); got != expected {
+			t.Errorf("%q: expected %q, got %q", v, expected, got)
+		}
+	}
+}
+
+func TestGeneratePeerID(t *testing.T) {
+	peerId, err := GeneratePeerID()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(string(peerId[:]), "-CV0100-") {
+		t.Errorf("unexpected peer ID %q", peerId)
+	}
+	if info := IdentifyClient(peerId); info.Name != "Clover" || info.Version != "0.1.0" {
+		t.Errorf("peer ID identified as %s", info)
+	}
+}
@@ -2,46 +2,108 @@ package peer
 
 import (
 	"context"
+	"encoding/binary"
+	"fmt"
 	"net"
+	"net/netip"
 	"strconv"
+	"sync"
+	"time"
 )
 
 type Peer struct {
 	IpAddr net.IP
 	Port   uint16
+
+	Source       string    // the name of the peer source that discovered the peer
+	DiscoveredAt time.Time // when the peer source discovered the peer
 }
 
-// MergeStream merges two channels from the 2 sources (tracker and dht) into a single channel.
-func MergeStream(ctx context.Context, tC <-chan Peer, dhtC <-chan Peer) <-chan Peer {
+/*
+MergeStream merges the channels of the peer sources, such as the trackers, the dht and the peer exchange,
+into a single channel. It is closed once every source is closed or the context is done.
+*/
+func MergeStream(ctx context.Context, sources ...<-chan Peer) <-chan Peer {
 	peerChan := make(chan Peer, 1000)
 
-	go func() {
-		defer close(peerChan)
+	var wg sync.WaitGroup
+	for _, source := range sources {
+		if source == nil {
+			continue
+		}
 
-		for tC != nil || dhtC != nil {
-			select {
-			case peer, ok := <-tC:
-				if !ok {
-					tC = nil
-					continue
-				}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
 				select {
-				case peerChan <- peer:
+				case peer, ok := <-source:
+					if !ok {
+						return
+					}
+					select {
+					case peerChan <- peer:
+					case <-ctx.Done():
+						return
+					}
+
 				case <-ctx.Done():
 					return
 				}
+			}
+		}()
+	}
 
-			case peer, ok := <-dhtC:
+	go func() {
+		wg.Wait()
+		close(peerChan)
+	}()
+
+	return peerChan
+}
+
+/*
+PreferStream passes on the peers of the preferred channel before the peers of the other channel,
+such as the peers on the local network before the ones from the internet. The returned channel
+is unbuffered, so the preference holds at the time the peers are read.
+It is closed once both channels are closed or the context is done.
+*/
+func PreferStream(ctx context.Context, preferred <-chan Peer, rest <-chan Peer) <-chan Peer {
+	peerChan := make(chan Peer)
+
+	go func() {
+		defer close(peerChan)
+
+		for preferred != nil || rest != nil {
+			var p Peer
+			var ok bool
+
+			select {
+			case p, ok = <-preferred:
 				if !ok {
-					dhtC = nil
+					preferred = nil
 					continue
 				}
+			default:
 				select {
-				case peerChan <- peer:
+				case p, ok = <-preferred:
+					if !ok {
+						preferred = nil
+						continue
+					}
+				case p, ok = <-rest:
+					if !ok {
+						rest = nil
+						continue
+					}
 				case <-ctx.Done():
 					return
 				}
+			}
 
+			select {
+			case peerChan <- p:
 			case <-ctx.Done():
 				return
 			}
@@ -51,6 +113,87 @@ func MergeStream(ctx context.Context, tC <-chan Peer, dhtC <-chan Peer) <-chan P
 	return peerChan
 }
 
+// NewPeer creates a peer, storing IPv4-mapped IPv6 addresses in their 4-byte form.
+func NewPeer(ip net.IP, port uint16) Peer {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	return Peer{
+		IpAddr: ip,
+		Port:   port,
+	}
+}
+
+// ParsePeer parses the host:port address of a peer, resolving the host name if it is not an IP address.
+func ParsePeer(addr string) (Peer, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return Peer{}, fmt.Errorf("invalid peer address %q: %w", addr, err)
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return Peer{}, fmt.Errorf("invalid peer port %q", portStr)
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return Peer{}, fmt.Errorf("failed to resolve peer %q: %w", host, err)
+		}
+		ip = ips[0]
+	}
+
+	return NewPeer(ip, uint16(port)), nil
+}
+
+/*
+DecodeCompact decodes a compact peer list, where each peer is an IP address of ipLen bytes
+followed by a 2-byte port. It is 6 bytes per peer for IPv4 (BEP 23) and 18 bytes for IPv6 (BEP 7).
+*/
+func DecodeCompact(buf []byte, ipLen int) ([]Peer, error) {
+	entryLen := ipLen + 2
+	if len(buf)%entryLen != 0 {
+		return nil, fmt.Errorf("invalid compact peers length %d", len(buf))
+	}
+
+	peers := make([]Peer, 0, len(buf)/entryLen)
+	for i := 0; i < len(buf); i += entryLen {
+		ip := make(net.IP, ipLen)
+		copy(ip, buf[i:i+ipLen])
+		peers = append(peers, NewPeer(ip, binary.BigEndian.Uint16(buf[i+ipLen:])))
+	}
+
+	return peers, nil
+}
+
+// EncodeCompact encodes the peer in the compact format, 6 bytes for IPv4 and 18 bytes for IPv6.
+func (p Peer) EncodeCompact() []byte {
+	ip := p.IpAddr.To4()
+	if ip == nil {
+		ip = p.IpAddr.To16()
+	}
+
+	buf := make([]byte, len(ip)+2)
+	copy(buf, ip)
+	binary.BigEndian.PutUint16(buf[len(ip):], p.Port)
+
+	return buf
+}
+
+// IsIPv6 reports whether the peer has an IPv6 address that is not IPv4-mapped.
+func (p Peer) IsIPv6() bool {
+	return p.IpAddr != nil && p.IpAddr.To4() == nil
+}
+
+// AddrPort returns the address of the peer with IPv4-mapped addresses unmapped, so it can be used as a key.
+func (p Peer) AddrPort() netip.AddrPort {
+	addr, _ := netip.AddrFromSlice(p.IpAddr)
+	return netip.AddrPortFrom(addr.Unmap(), p.Port)
+}
+
 func (p Peer) String() string {
 	return net.JoinHostPort(p.IpAddr.String(), strconv.Itoa(int(p.Port)))
 }
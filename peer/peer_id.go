@@ -2,34 +2,52 @@ package peer
 
 import (
 	"crypto/rand"
-	"encoding/hex"
 	"fmt"
+	"strings"
 )
 
+const (
+	// ClientCode is clover's two letter client code in Azureus-style peer IDs.
+	ClientCode = "CV"
+
+	// ClientVersion is clover's version, encoded in its peer ID.
+	ClientVersion = "0.1.0"
+)
+
+// peerIdChars are the characters of the random part of the peer ID.
+const peerIdChars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
 /*
-GeneratePeerID generates a random peer ID for the torrent client.
-The peer ID is a 20-character string that starts with prefix "-CLOVER-".
-The next 12 bytes are random hexadecimal characters.
+GeneratePeerID generates a random Azureus-style peer ID for the torrent client.
+The peer ID starts with "-CV" and the four version characters of clover, such as "-CV0100-"
+for version 0.1.0, followed by 12 random alphanumeric characters.
 */
 func GeneratePeerID() ([20]byte, error) {
-	const PREFIX = "-CLOVER-"
+	prefix := "-" + ClientCode + encodeVersion(ClientVersion) + "-"
 
-	randomBytes := make([]byte, 6)
+	randomBytes := make([]byte, 20-len(prefix))
 	_, err := rand.Read(randomBytes)
 	if err != nil {
 		return [20]byte{}, fmt.Errorf("failed to generate random bytes: %v", err)
 	}
 
-	randomHex := hex.EncodeToString(randomBytes)
-
-	peerID := PREFIX + randomHex
 	var peerIDArray [20]byte
-
-	if len(peerID) != 20 {
-		copy(peerIDArray[:], peerID[:20])
-		return peerIDArray, nil
+	copy(peerIDArray[:], prefix)
+	for i, b := range randomBytes {
+		peerIDArray[len(prefix)+i] = peerIdChars[int(b)%len(peerIdChars)]
 	}
 
-	copy(peerIDArray[:], peerID)
 	return peerIDArray, nil
 }
+
+// encodeVersion encodes a dotted version as the four characters of an Azureus-style peer ID, one per part.
+func encodeVersion(version string) string {
+	encoded := []byte("0000")
+	for i, part := range strings.SplitN(version, ".", 4) {
+		var n int
+		fmt.Sscanf(part, "%d", &n)
+		encoded[i] = versionChars[min(max(n, 0), len(versionChars)-1)]
+	}
+
+	return string(encoded)
+}
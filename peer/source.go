@@ -0,0 +1,207 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// PeerSource discovers the peers of a torrent, such as the trackers, the DHT or a static list of peers.
+type PeerSource interface {
+	// Name identifies the source in the peers it discovers and in the stats.
+	Name() string
+
+	// Start starts the discovery and returns the stream of peers, which is closed when the source stops.
+	Start() (<-chan Peer, error)
+
+	// Stop stops the discovery.
+	Stop()
+}
+
+// funcSource is a peer source made of its start and stop functions.
+type funcSource struct {
+	name  string
+	start func() (<-chan Peer, error)
+	stop  func()
+}
+
+// NewSource creates a peer source from its start and stop functions. The stop function can be nil.
+func NewSource(name string, start func() (<-chan Peer, error), stop func()) PeerSource {
+	return &funcSource{name: name, start: start, stop: stop}
+}
+
+func (s *funcSource) Name() string {
+	return s.name
+}
+
+func (s *funcSource) Start() (<-chan Peer, error) {
+	return s.start()
+}
+
+func (s *funcSource) Stop() {
+	if s.stop != nil {
+		s.stop()
+	}
+}
+
+// StaticSource creates a peer source which discovers the given peers once, such as a list of known seeds.
+func StaticSource(name string, peers []Peer) PeerSource {
+	return NewSource(name, func() (<-chan Peer, error) {
+		peerChan := make(chan Peer, len(peers))
+		for _, p := range peers {
+			peerChan <- p
+		}
+		close(peerChan)
+
+		return peerChan, nil
+	}, nil)
+}
+
+// registeredSource is a source of the merger and whether its peers come first.
+type registeredSource struct {
+	source    PeerSource
+	preferred bool
+}
+
+/*
+Merger starts any number of peer sources and merges their peers into a single stream.
+Every peer is tagged with the name of its source and the time it was discovered,
+and the merger counts the peers each source discovered.
+*/
+type Merger struct {
+	sources []registeredSource
+	counts  map[string]int
+	started bool
+	mu      sync.Mutex
+}
+
+func NewMerger() *Merger {
+	return &Merger{counts: make(map[string]int)}
+}
+
+/*
+Register adds a source to the merger before it is started. The peers of preferred sources,
+such as the peers on the local network, are passed on before the others, see PreferStream.
+*/
+func (m *Merger) Register(source PeerSource, preferred bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.started {
+		return fmt.Errorf("peer source %q registered after start", source.Name())
+	}
+	for _, rs := range m.sources {
+		if rs.source.Name() == source.Name() {
+			return fmt.Errorf("duplicate peer source %q", source.Name())
+		}
+	}
+
+	m.sources = append(m.sources, registeredSource{source: source, preferred: preferred})
+	m.counts[source.Name()] = 0
+	return nil
+}
+
+/*
+Start starts the registered sources and returns the merged stream of their peers, which is closed
+once every source is closed or the context is done. If a source fails to start,
+the sources started so far are stopped and the error is returned.
+*/
+func (m *Merger) Start(ctx context.Context) (<-chan Peer, error) {
+	m.mu.Lock()
+	if m.started {
+		m.mu.Unlock()
+		return nil, fmt.Errorf("peer sources already started")
+	}
+	m.started = true
+	sources := m.sources
+	m.mu.Unlock()
+
+	var preferred, rest []<-chan Peer
+	for i, rs := range sources {
+		peerChan, err := rs.source.Start()
+		if err != nil {
+			for _, started := range sources[:i] {
+				started.source.Stop()
+			}
+			return nil, fmt.Errorf("failed to start peer source %q: %w", rs.source.Name(), err)
+		}
+
+		tagged := m.tag(ctx, rs.source.Name(), peerChan)
+		if rs.preferred {
+			preferred = append(preferred, tagged)
+		} else {
+			rest = append(rest, tagged)
+		}
+	}
+
+	if len(preferred) == 0 {
+		return MergeStream(ctx, rest...), nil
+	}
+	return PreferStream(ctx, MergeStream(ctx, preferred...), MergeStream(ctx, rest...)), nil
+}
+
+// Stop stops the sources in the order they were registered.
+func (m *Merger) Stop() {
+	m.mu.Lock()
+	sources := m.sources
+	started := m.started
+	m.mu.Unlock()
+
+	if !started {
+		return
+	}
+	for _, rs := range sources {
+		rs.source.Stop()
+	}
+}
+
+// Counts returns the number of peers each source discovered, by the name of the source.
+func (m *Merger) Counts() map[string]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	counts := make(map[string]int, len(m.counts))
+	for name, count := range m.counts {
+		counts[name] = count
+	}
+	return counts
+}
+
+// tag sets the source and discovery time of the peers of a source and counts them.
+func (m *Merger) tag(ctx context.Context, name string, source <-chan Peer) <-chan Peer {
+	peerChan := make(chan Peer)
+
+	go func() {
+		defer close(peerChan)
+
+		for {
+			select {
+			case p, ok := <-source:
+				if !ok {
+					return
+				}
+
+				p.Source = name
+				if p.DiscoveredAt.IsZero() {
+					p.DiscoveredAt = time.Now()
+				}
+
+				m.mu.Lock()
+				m.counts[name]++
+				m.mu.Unlock()
+
+				select {
+				case peerChan <- p:
+				case <-ctx.Done():
+					return
+				}
+
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return peerChan
+}
@@ -0,0 +1,63 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestMerger(t *testing.T) {
+	m := NewMerger()
+	m.Register(StaticSource("static", []Peer{NewPeer(net.IPv4(203, 0, 113, 1), 6881), NewPeer(net.IPv4(203, 0, 113, 2), 6881)}), false)
+	m.Register(StaticSource("local", []Peer{NewPeer(net.IPv4(192, 168, 1, 2), 6881)}), true)
+
+	if err := m.Register(StaticSource("static", nil), false); err == nil {
+		t.Error("duplicate source was registered")
+	}
+
+	peerChan, err := m.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var peers []Peer
+	for p := range peerChan {
+		if p.DiscoveredAt.IsZero() {
+			t.Errorf("peer %s has no discovery time", p)
+		}
+		peers = append(peers, p)
+	}
+
+	if len(peers) != 3 {
+		t.Fatalf("expected 3 peers, got %v", peers)
+	}
+	for _, p := range peers {
+		expected := "static"
+		if p.IpAddr.IsPrivate() {
+			expected = "local"
+		}
+		if p.Source != expected {
+			t.Errorf("peer %s has the wrong source %q", p, p.Source)
+		}
+	}
+
+	counts := m.Counts()
+	if counts["static"] != 2 || counts["local"] != 1 {
+		t.Errorf("unexpected counts %v", counts)
+	}
+}
+
+func TestMergerStartError(t *testing.T) {
+	stopped := false
+	m := NewMerger()
+	m.Register(NewSource("first", func() (<-chan Peer, error) { return make(chan Peer), nil }, func() { stopped = true }), false)
+	m.Register(NewSource("broken", func() (<-chan Peer, error) { return nil, errors.New("broken") }, nil), false)
+
+	if _, err := m.Start(context.Background()); err == nil {
+		t.Fatal("expected an error")
+	}
+	if !stopped {
+		t.Error("started source was not stopped")
+	}
+}
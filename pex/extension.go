@@ -0,0 +1,82 @@
+package pex
+
+import (
+	"time"
+
+	"github.com/JoelVCrasta/clover/client"
+)
+
+// pollInterval is how often a connection checks for changes to send, which are sent at most every Interval.
+const pollInterval = 10 * time.Second
+
+// Name returns the name of the peer exchange in the extended handshake, so it can be registered with the client.
+func (px *PeerExchange) Name() string {
+	return ExtensionName
+}
+
+// PeerConnected shares the connected peer with the other connections. We connected to it, so it is reachable.
+// The peers that connected to us are only sent our peers.
+func (px *PeerExchange) PeerConnected(ap *client.ActivePeer) {
+	var flags byte
+	if px.isSeed(ap) {
+		flags |= FlagSeed
+	}
+	if ap.Encrypted {
+		flags |= FlagEncryption
+	}
+
+	if ap.Inbound {
+		px.Accept(ap.Peer, flags)
+		return
+	}
+	px.Connect(ap.Peer, flags|FlagReachable)
+}
+
+// Handshake starts sending the changes of our peers to a peer that supports the peer exchange.
+func (px *PeerExchange) Handshake(ap *client.ActivePeer) {
+	go func() {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+
+		for {
+			if payload := px.Next(ap.Peer); payload != nil {
+				if err := ap.SendExtension(ExtensionName, payload); err != nil {
+					return
+				}
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ap.Done():
+				return
+			case <-px.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Message handles a peer exchange message. A bad message is not worth dropping the peer.
+func (px *PeerExchange) Message(ap *client.ActivePeer, payload []byte) error {
+	_ = px.Receive(ap.Peer, payload)
+	return nil
+}
+
+// PeerDisconnected drops the peer, which is sent as dropped to the other connections.
+func (px *PeerExchange) PeerDisconnected(ap *client.ActivePeer) {
+	px.Disconnect(ap.Peer)
+}
+
+// isSeed reports whether the bitfield of the peer has every piece.
+func (px *PeerExchange) isSeed(ap *client.ActivePeer) bool {
+	if px.numPieces == 0 {
+		return false
+	}
+
+	for i := range px.numPieces {
+		if !ap.Bitfield.Has(i) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,312 @@
+package pex
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/JoelVCrasta/clover/metainfo"
+	"github.com/JoelVCrasta/clover/peer"
+)
+
+const (
+	// ExtensionName is the name of the peer exchange in the extended handshake (BEP 10).
+	ExtensionName = "ut_pex"
+
+	// Interval is how often a connection is sent the changes of our peers (BEP 11).
+	Interval = time.Minute
+
+	// minReceiveInterval is how soon after the previous message a peer exchange message is ignored.
+	minReceiveInterval = 45 * time.Second
+
+	// maxPeers is the number of added and of dropped peers in a single message (BEP 11).
+	maxPeers = 50
+)
+
+// Flags of an added peer (BEP 11)
+const (
+	FlagEncryption = 0x01 // prefers encryption
+	FlagSeed       = 0x02 // is a seed or partial seed
+	FlagUTP        = 0x04 // supports uTP
+	FlagHolepunch  = 0x08 // supports the holepunch extension
+	FlagReachable  = 0x10 // accepts incoming connections
+)
+
+// Message is a peer exchange message with the peers added and dropped since the previous one.
+type Message struct {
+	Added      []peer.Peer
+	AddedFlags []byte // the flags of each added peer
+	Dropped    []peer.Peer
+}
+
+// connection is the peer exchange state of a connected peer.
+type connection struct {
+	peer         peer.Peer
+	flags        byte
+	inbound      bool                 // the peer connected to us, so it is not shared
+	sent         map[string]peer.Peer // the peers the connection was told about
+	lastSent     time.Time
+	lastReceived time.Time
+}
+
+/*
+PeerExchange shares the peers we are connected to with the connected peers (BEP 11),
+and collects the peers they share in a stream, so they can be used as a discovery source
+next to the trackers and the DHT. It must not be used for private torrents.
+*/
+type PeerExchange struct {
+	peerChan    chan peer.Peer
+	connections map[string]*connection
+	numPieces   int
+	mu          sync.Mutex
+	ctx         context.Context
+}
+
+/*
+NewPeerExchange creates a peer exchange for a torrent with the number of pieces, which tells the seeds apart.
+The stream of peers is closed when the context is done.
+*/
+func NewPeerExchange(ctx context.Context, numPieces int) *PeerExchange {
+	px := &PeerExchange{
+		peerChan:    make(chan peer.Peer, 500),
+		connections: make(map[string]*connection),
+		numPieces:   numPieces,
+		ctx:         ctx,
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		px.mu.Lock()
+		defer px.mu.Unlock()
+		close(px.peerChan)
+	}()
+
+	return px
+}
+
+// Peers returns the stream of the peers received from the connected peers.
+func (px *PeerExchange) Peers() <-chan peer.Peer {
+	return px.peerChan
+}
+
+/*
+Connect registers a connection to the peer with its flags, such as FlagSeed.
+It is shared with the other connections, and is sent their peers in the messages of Next.
+*/
+func (px *PeerExchange) Connect(p peer.Peer, flags byte) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	px.connections[p.AddrPort().String()] = &connection{
+		peer:  p,
+		flags: flags,
+		sent:  make(map[string]peer.Peer),
+	}
+}
+
+/*
+Accept registers a connection the peer opened to us. It is sent the peers of the other connections like any other,
+but is not shared with them, as its port is not the one it listens on.
+*/
+func (px *PeerExchange) Accept(p peer.Peer, flags byte) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	px.connections[p.AddrPort().String()] = &connection{
+		peer:    p,
+		flags:   flags,
+		inbound: true,
+		sent:    make(map[string]peer.Peer),
+	}
+}
+
+// Disconnect removes the connection to the peer, which is sent as dropped to the other connections.
+func (px *PeerExchange) Disconnect(p peer.Peer) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	delete(px.connections, p.AddrPort().String())
+}
+
+/*
+Next returns the encoded message for the connection to the peer with the connections added and dropped
+since the previous message, or nil if the interval has not passed or nothing changed.
+Both lists are limited to 50 peers, the rest is sent with the next messages.
+*/
+func (px *PeerExchange) Next(p peer.Peer) []byte {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	conn, ok := px.connections[p.AddrPort().String()]
+	if !ok || time.Since(conn.lastSent) < Interval {
+		return nil
+	}
+	conn.lastSent = time.Now()
+
+	var msg Message
+	for key, other := range px.connections {
+		if other == conn || other.inbound || len(msg.Added) == maxPeers {
+			continue
+		}
+		if _, sent := conn.sent[key]; !sent {
+			conn.sent[key] = other.peer
+			msg.Added = append(msg.Added, other.peer)
+			msg.AddedFlags = append(msg.AddedFlags, other.flags)
+		}
+	}
+	for key, sent := range conn.sent {
+		if len(msg.Dropped) == maxPeers {
+			break
+		}
+		if _, connected := px.connections[key]; !connected {
+			delete(conn.sent, key)
+			msg.Dropped = append(msg.Dropped, sent)
+		}
+	}
+
+	if len(msg.Added) == 0 && len(msg.Dropped) == 0 {
+		return nil
+	}
+
+	buf, err := msg.Encode()
+	if err != nil {
+		return nil
+	}
+	return buf
+}
+
+/*
+Receive handles a peer exchange message from the connected peer, and sends the added peers to the stream,
+seeds first. Messages that arrive sooner than the interval allows are ignored.
+*/
+func (px *PeerExchange) Receive(p peer.Peer, payload []byte) error {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+
+	conn, ok := px.connections[p.AddrPort().String()]
+	if !ok || px.ctx.Err() != nil {
+		return nil
+	}
+	if !conn.lastReceived.IsZero() && time.Since(conn.lastReceived) < minReceiveInterval {
+		return nil
+	}
+	conn.lastReceived = time.Now()
+
+	msg, err := DecodeMessage(payload)
+	if err != nil {
+		return err
+	}
+
+	added := make([]int, 0, min(len(msg.Added), maxPeers))
+	for i := range msg.Added[:min(len(msg.Added), maxPeers)] {
+		added = append(added, i)
+	}
+	// Clover only downloads, so the seeds are the most useful peers
+	slices.SortStableFunc(added, func(a, b int) int {
+		return int(msg.flags(b)&FlagSeed) - int(msg.flags(a)&FlagSeed)
+	})
+
+	for _, i := range added {
+		select {
+		case px.peerChan <- msg.Added[i]:
+		default:
+			// Drop the peers that do not fit, rather than blocking the connection
+		}
+	}
+
+	return nil
+}
+
+// flags returns the flags of the added peer at the index, or 0 if there are none.
+func (m *Message) flags(i int) byte {
+	if i < len(m.AddedFlags) {
+		return m.AddedFlags[i]
+	}
+	return 0
+}
+
+/*
+Encode bencodes the message, with the IPv4 peers under added, added.f and dropped
+and the IPv6 peers under added6, added6.f and dropped6.
+*/
+func (m *Message) Encode() ([]byte, error) {
+	var added, addedFlags, dropped, added6, addedFlags6, dropped6 []byte
+
+	for i, p := range m.Added {
+		if p.IsIPv6() {
+			added6 = append(added6, p.EncodeCompact()...)
+			addedFlags6 = append(addedFlags6, m.flags(i))
+		} else {
+			added = append(added, p.EncodeCompact()...)
+			addedFlags = append(addedFlags, m.flags(i))
+		}
+	}
+	for _, p := range m.Dropped {
+		if p.IsIPv6() {
+			dropped6 = append(dropped6, p.EncodeCompact()...)
+		} else {
+			dropped = append(dropped, p.EncodeCompact()...)
+		}
+	}
+
+	return metainfo.BencodeMarshall(map[string]any{
+		"added":    added,
+		"added.f":  addedFlags,
+		"dropped":  dropped,
+		"added6":   added6,
+		"added6.f": addedFlags6,
+		"dropped6": dropped6,
+	})
+}
+
+// DecodeMessage decodes a bencoded peer exchange message.
+func DecodeMessage(payload []byte) (*Message, error) {
+	decoded, err := metainfo.BencodeUnmarshall(payload)
+	if err != nil {
+		return nil, fmt.Errorf("[pex] invalid message: %v", err)
+	}
+
+	dict, ok := decoded.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("[pex] invalid message format")
+	}
+
+	var m Message
+	for _, family := range []struct {
+		added, flags, dropped string
+		ipLen                 int
+	}{
+		{"added", "added.f", "dropped", net.IPv4len},
+		{"added6", "added6.f", "dropped6", net.IPv6len},
+	} {
+		compact, _ := dict[family.added].([]byte)
+		added, err := peer.DecodeCompact(compact, family.ipLen)
+		if err != nil {
+			return nil, fmt.Errorf("[pex] %v", err)
+		}
+
+		// Flags are optional, a missing flag is 0
+		flags, _ := dict[family.flags].([]byte)
+		for i := range added {
+			var f byte
+			if i < len(flags) {
+				f = flags[i]
+			}
+			m.AddedFlags = append(m.AddedFlags, f)
+		}
+		m.Added = append(m.Added, added...)
+
+		compact, _ = dict[family.dropped].([]byte)
+		dropped, err := peer.DecodeCompact(compact, family.ipLen)
+		if err != nil {
+			return nil, fmt.Errorf("[pex] %v", err)
+		}
+		m.Dropped = append(m.Dropped, dropped...)
+	}
+
+	return &m, nil
+}
@@ -0,0 +1,103 @@
+package pex
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/JoelVCrasta/clover/peer"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	msg := &Message{
+		Added:      []peer.Peer{peer.NewPeer(net.ParseIP("10.0.0.1"), 6881), peer.NewPeer(net.ParseIP("2001:db8::1"), 6882)},
+		AddedFlags: []byte{FlagSeed, FlagReachable | FlagUTP},
+		Dropped:    []peer.Peer{peer.NewPeer(net.ParseIP("10.0.0.2"), 6883)},
+	}
+
+	buf, err := msg.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := DecodeMessage(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(decoded.Added) != 2 || decoded.Added[0].String() != "10.0.0.1:6881" || decoded.Added[1].String() != "[2001:db8::1]:6882" {
+		t.Errorf("unexpected added peers %v", decoded.Added)
+	}
+	if string(decoded.AddedFlags) != string(msg.AddedFlags) {
+		t.Errorf("unexpected flags %v", decoded.AddedFlags)
+	}
+	if len(decoded.Dropped) != 1 || decoded.Dropped[0].String() != "10.0.0.2:6883" {
+		t.Errorf("unexpected dropped peers %v", decoded.Dropped)
+	}
+}
+
+func TestNextDeltas(t *testing.T) {
+	px := NewPeerExchange(context.Background(), 0)
+
+	a := peer.NewPeer(net.ParseIP("10.0.0.1"), 1)
+	b := peer.NewPeer(net.ParseIP("10.0.0.2"), 2)
+	c := peer.NewPeer(net.ParseIP("10.0.0.3"), 3)
+	px.Connect(a, 0)
+	px.Connect(b, FlagSeed)
+	px.Connect(c, 0)
+
+	msg, err := DecodeMessage(px.Next(a))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Added) != 2 || len(msg.Dropped) != 0 {
+		t.Fatalf("expected the 2 other peers to be added, got %+v", msg)
+	}
+
+	// Nothing is sent before the interval has passed
+	px.Disconnect(c)
+	if px.Next(a) != nil {
+		t.Fatal("message sent before the interval")
+	}
+
+	px.connections[a.AddrPort().String()].lastSent = time.Now().Add(-Interval)
+	msg, err = DecodeMessage(px.Next(a))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Added) != 0 || len(msg.Dropped) != 1 || msg.Dropped[0].String() != c.String() {
+		t.Errorf("expected only the disconnected peer to be dropped, got %+v", msg)
+	}
+}
+
+func TestReceive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	px := NewPeerExchange(ctx, 0)
+
+	from := peer.NewPeer(net.ParseIP("10.0.0.1"), 1)
+	px.Connect(from, 0)
+
+	leecher := peer.NewPeer(net.ParseIP("10.0.1.1"), 1)
+	seed := peer.NewPeer(net.ParseIP("10.0.1.2"), 2)
+	buf, _ := (&Message{Added: []peer.Peer{leecher, seed}, AddedFlags: []byte{0, FlagSeed}}).Encode()
+
+	if err := px.Receive(from, buf); err != nil {
+		t.Fatal(err)
+	}
+	if p := <-px.Peers(); p.String() != seed.String() {
+		t.Errorf("expected the seed first, got %s", p)
+	}
+	if p := <-px.Peers(); p.String() != leecher.String() {
+		t.Errorf("expected the leecher, got %s", p)
+	}
+
+	// A second message right away is ignored
+	px.Receive(from, buf)
+	select {
+	case p := <-px.Peers():
+		t.Errorf("peer %s received from a message sent too soon", p)
+	default:
+	}
+}
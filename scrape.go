@@ -0,0 +1,20 @@
+package torrent
+
+import (
+	"context"
+
+	"github.com/JoelVCrasta/clover/metainfo"
+	"github.com/JoelVCrasta/clover/tracker"
+)
+
+// ScrapeTorrent reads the torrent file and asks every tracker in its announce list for the swarm health.
+// Cancelling the context stops the scrapes that are still running.
+func ScrapeTorrent(ctx context.Context, inputPath string) (*metainfo.Torrent, []tracker.ScrapeReport, error) {
+	var tr metainfo.Torrent
+	if err := tr.Torrent(inputPath, ""); err != nil {
+		return nil, nil, err
+	}
+
+	reports := tracker.ScrapeAll(ctx, tr.AnnounceList, [][20]byte{tr.InfoHash})
+	return &tr, reports, nil
+}
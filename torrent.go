@@ -3,16 +3,24 @@ package torrent
 import (
 	"context"
 	"fmt"
+	"log"
 	"os"
 	"os/signal"
+	"sync"
+	"syscall"
 
 	"github.com/JoelVCrasta/clover/client"
+	"github.com/JoelVCrasta/clover/config"
 	"github.com/JoelVCrasta/clover/download"
+	"github.com/JoelVCrasta/clover/ipfilter"
+	"github.com/JoelVCrasta/clover/metadata"
 	"github.com/JoelVCrasta/clover/metainfo"
 	"github.com/JoelVCrasta/clover/peer"
 )
 
-func StartTorrent(inputPath string, outputPath string) error {
+// StartTorrent downloads the torrent file to the output path.
+// The given peer sources, such as a static list of peers, are used along with the built-in ones.
+func StartTorrent(inputPath string, outputPath string, sources ...peer.PeerSource) error {
 	fmt.Println("Reading torrent file...")
 	var tr metainfo.Torrent
 	err := tr.Torrent(inputPath, outputPath)
@@ -29,20 +37,136 @@ func StartTorrent(inputPath string, outputPath string) error {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
 
+	filter, err := loadIPFilter(ctx)
+	if err != nil {
+		return err
+	}
+	startListener()
+
+	dm := download.NewDownloadManager(ctx, tr)
+
 	fmt.Println("Searching for peers...")
-	pC, err := StartPeerDiscovery(ctx, tr.AnnounceList, tr.InfoHash, peerId)
+	pd, err := StartPeerDiscovery(ctx, &tr, peerId, dm, sources...)
 	if err != nil {
 		return err
 	}
+	defer pd.Stop()
 
-	fmt.Println("Started download...")
-	client := client.NewClient(ctx, pC, tr.InfoHash, peerId)
-	apC := client.StartClient()
+	runDownload(ctx, &tr, peerId, dm, pd, filter, nil)
+	return nil
+}
+
+/*
+runDownload downloads the torrent from the peers of the discovery, and the known peers, such as those found
+while the metadata of a magnet link was downloaded. The download manager is set as the stats provider of the trackers.
+*/
+func runDownload(ctx context.Context, tr *metainfo.Torrent, peerId [20]byte, dm *download.DownloadManager, pd *PeerDiscovery, filter *ipfilter.Filter, known []peer.Peer) {
+	pd.SetStatsProvider(dm)
+	dm.SetDHT(pd.DHT())
+	dm.SetSourceCounter(pd)
+	dm.SetOnComplete(pd.Completed)
 
-	dm := download.NewDownloadManager(ctx, tr, client)
+	fmt.Println("Started download...")
+	c := newClient(ctx, pd, tr.InfoHash, peerId, filter)
+	c.SetMetadataSize(len(tr.InfoBytes))
+	c.RegisterExtension(metadata.NewExchange(tr.InfoHash, tr.InfoBytes))
+	// A magnet link may turn out to be a private torrent only once its metadata is known
+	if pd.PeerExchange() != nil && !tr.Info.Private {
+		c.RegisterExtension(pd.PeerExchange())
+	}
+	for _, p := range known {
+		c.AddPeer(p)
+	}
+	apC := c.StartClient()
 
 	// go StartTUI(dm)
-	dm.StartDownload(apC)
+	dm.StartDownload(c, apC)
+}
 
-	return nil
+// newClient creates a client for the peers of the discovery with the IP filter and the client policy of the config,
+// which also gets the peers that connect to us for the torrent.
+func newClient(ctx context.Context, pd *PeerDiscovery, infoHash [20]byte, peerId [20]byte, filter *ipfilter.Filter) *client.Client {
+	var policy client.ClientPolicy
+	if len(config.Config.BannedClients) > 0 {
+		policy = client.BanClients(config.Config.BannedClients...)
+	}
+
+	c := client.NewClient(ctx, pd.Peers, infoHash, peerId)
+	c.SetIPFilter(filter)
+	c.SetClientPolicy(policy)
+	if pd.DHT() != nil {
+		c.SetDHTPort(pd.DHT().Port())
+	}
+	if l := startListener(); l != nil {
+		l.Add(c)
+		go func() {
+			<-ctx.Done()
+			l.Remove(c)
+		}()
+	}
+
+	return c
+}
+
+var (
+	// listener accepts the peer connections of every torrent, started by the first one
+	listener     *client.Listener
+	listenerOnce sync.Once
+)
+
+/*
+startListener starts accepting peer connections on the configured port, or on a free port if it is taken.
+The config is updated with the real port before the peer discovery starts, so the trackers, the DHT and
+the local service discovery announce it. Without a listener, clover only connects to peers.
+*/
+func startListener() *client.Listener {
+	listenerOnce.Do(func() {
+		l, err := client.Listen(config.Config.Port)
+		if err != nil {
+			log.Printf("%v, using a free port", err)
+			l, err = client.Listen(0)
+		}
+		if err != nil {
+			log.Printf("%v", err)
+			return
+		}
+
+		config.Config.Port = l.Port()
+		listener = l
+	})
+
+	return listener
+}
+
+// loadIPFilter loads the IP filter files of the config, reloaded on SIGHUP, or returns nil if there are none.
+func loadIPFilter(ctx context.Context) (*ipfilter.Filter, error) {
+	if len(config.Config.IPFilterFiles) == 0 {
+		return nil, nil
+	}
+
+	filter, err := ipfilter.Load(config.Config.IPFilterFiles...)
+	if err != nil {
+		return nil, err
+	}
+	go reloadOnHangup(ctx, filter)
+
+	return filter, nil
+}
+
+// reloadOnHangup reloads the IP filter files on SIGHUP until the context is done.
+func reloadOnHangup(ctx context.Context, filter *ipfilter.Filter) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			if err := filter.Reload(); err != nil {
+				log.Printf("%v", err)
+			}
+		}
+	}
 }
@@ -0,0 +1,206 @@
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/JoelVCrasta/clover/config"
+	"github.com/JoelVCrasta/clover/metainfo"
+	"github.com/JoelVCrasta/clover/peer"
+)
+
+// httpEvents maps the announce events to the values of the HTTP event parameter.
+var httpEvents = map[uint32]string{
+	EventCompleted: "completed",
+	EventStarted:   "started",
+	EventStopped:   "stopped",
+}
+
+type HTTPTracker struct {
+	announceUrl string
+	client      *http.Client
+	trackerId   string
+}
+
+// NewHTTPTracker creates a client for the HTTP or HTTPS tracker at the given announce URL.
+func NewHTTPTracker(announceUrl string) *HTTPTracker {
+	return &HTTPTracker{
+		announceUrl: announceUrl,
+		client: &http.Client{
+			Timeout: config.Config.HTTPTrackerTimeout,
+		},
+	}
+}
+
+/*
+AnnounceTracker sends an HTTP GET announce request to the tracker (BEP 3).
+It asks for a compact peer list (BEP 23) but also accepts the dictionary model.
+It returns an AnnounceResponse object containing the response from the tracker.
+Cancelling the context aborts the request.
+*/
+func (h *HTTPTracker) AnnounceTracker(ctx context.Context, arq AnnounceRequest, peerId [20]byte) (*AnnounceResponse, error) {
+	announceUrl, err := h.buildAnnounceUrl(arq, peerId)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, announceUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tracker responded with status %s", res.Status)
+	}
+
+	var a AnnounceResponse
+	if err := a.decodeHTTPAnnounceResponse(body); err != nil {
+		return nil, err
+	}
+
+	if a.TrackerId != "" {
+		h.trackerId = a.TrackerId
+	}
+
+	return &a, nil
+}
+
+// Close releases the idle keep-alive connections held for the tracker.
+func (h *HTTPTracker) Close() {
+	h.client.CloseIdleConnections()
+}
+
+// buildAnnounceUrl appends the announce parameters to the tracker's announce URL.
+func (h *HTTPTracker) buildAnnounceUrl(arq AnnounceRequest, peerId [20]byte) (string, error) {
+	base, err := url.Parse(h.announceUrl)
+	if err != nil {
+		return "", err
+	}
+
+	params := url.Values{}
+	params.Set("info_hash", string(arq.InfoHash[:]))
+	params.Set("peer_id", string(peerId[:]))
+	params.Set("port", strconv.Itoa(int(arq.Port)))
+	params.Set("uploaded", strconv.FormatUint(arq.Uploaded, 10))
+	params.Set("downloaded", strconv.FormatUint(arq.Downloaded, 10))
+	params.Set("left", strconv.FormatUint(arq.Left, 10))
+	params.Set("compact", "1")
+	params.Set("numwant", strconv.Itoa(int(arq.Numwant)))
+	params.Set("key", strconv.FormatUint(uint64(arq.Key), 16))
+
+	if event, ok := httpEvents[arq.Event]; ok {
+		params.Set("event", event)
+	}
+	if h.trackerId != "" {
+		params.Set("trackerid", h.trackerId)
+	}
+
+	query := params.Encode()
+	if base.RawQuery != "" {
+		query = base.RawQuery + "&" + query
+	}
+	base.RawQuery = query
+
+	return base.String(), nil
+}
+
+// decodeHTTPAnnounceResponse decodes the bencoded response of an HTTP announce request.
+func (a *AnnounceResponse) decodeHTTPAnnounceResponse(body []byte) error {
+	decoded, err := metainfo.BencodeUnmarshall(body)
+	if err != nil {
+		return fmt.Errorf("invalid tracker response: %v", err)
+	}
+
+	dict, ok := decoded.(map[string]any)
+	if !ok {
+		return fmt.Errorf("invalid tracker response format")
+	}
+
+	if reason, ok := dict["failure reason"].([]byte); ok {
+		return &TrackerError{Message: string(reason)}
+	}
+
+	a.Action = 1
+
+	if warning, ok := dict["warning message"].([]byte); ok {
+		a.Warning = string(warning)
+	}
+	if interval, ok := dict["interval"].(int); ok && interval > 0 {
+		a.Interval = uint32(interval)
+	}
+	if minInterval, ok := dict["min interval"].(int); ok && minInterval > 0 {
+		a.MinInterval = uint32(minInterval)
+	}
+	if trackerId, ok := dict["tracker id"].([]byte); ok {
+		a.TrackerId = string(trackerId)
+	}
+	if complete, ok := dict["complete"].(int); ok && complete > 0 {
+		a.Seeders = uint32(complete)
+	}
+	if incomplete, ok := dict["incomplete"].(int); ok && incomplete > 0 {
+		a.Leechers = uint32(incomplete)
+	}
+
+	switch peers := dict["peers"].(type) {
+	case []byte:
+		// Compact model (BEP 23)
+		compact, err := peer.DecodeCompact(peers, net.IPv4len)
+		if err != nil {
+			return err
+		}
+		a.Peers = append(a.Peers, compact...)
+
+	case []any:
+		// Dictionary model
+		for _, item := range peers {
+			p, ok := item.(map[string]any)
+			if !ok {
+				continue
+			}
+
+			ipStr, ok := p["ip"].([]byte)
+			if !ok {
+				continue
+			}
+			ip := net.ParseIP(strings.TrimSpace(string(ipStr)))
+			if ip == nil {
+				continue
+			}
+
+			port, ok := p["port"].(int)
+			if !ok || port <= 0 || port > 65535 {
+				continue
+			}
+
+			a.Peers = append(a.Peers, peer.NewPeer(ip, uint16(port)))
+		}
+	}
+
+	// IPv6 peers in the compact model (BEP 7)
+	if peers6, ok := dict["peers6"].([]byte); ok {
+		compact, err := peer.DecodeCompact(peers6, net.IPv6len)
+		if err != nil {
+			return err
+		}
+		a.Peers = append(a.Peers, compact...)
+	}
+
+	return nil
+}
@@ -0,0 +1,165 @@
+package tracker_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/JoelVCrasta/clover/metainfo"
+	"github.com/JoelVCrasta/clover/peer"
+	"github.com/JoelVCrasta/clover/tracker"
+)
+
+var (
+	testInfoHash = [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+	testPeerId   = [20]byte{'-', 'C', 'L', 'O', 'V', 'E', 'R', '-'}
+)
+
+// newHTTPTracker starts a stand-in HTTP tracker that replies to every announce with the given dictionary.
+func newHTTPTracker(t *testing.T, response map[string]any) *httptest.Server {
+	t.Helper()
+
+	body, err := metainfo.BencodeMarshall(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("info_hash") != string(testInfoHash[:]) {
+			t.Errorf("unexpected info_hash %q", query.Get("info_hash"))
+		}
+		if query.Get("peer_id") != string(testPeerId[:]) {
+			t.Errorf("unexpected peer_id %q", query.Get("peer_id"))
+		}
+		if query.Get("compact") != "1" {
+			t.Errorf("expected compact=1, got %q", query.Get("compact"))
+		}
+		w.Write(body)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestHTTPAnnounceCompact(t *testing.T) {
+	srv := newHTTPTracker(t, map[string]any{
+		"interval":        900,
+		"min interval":    300,
+		"tracker id":      "abc",
+		"warning message": "slow down",
+		"complete":        4,
+		"incomplete":      2,
+		"peers":           []byte{10, 0, 0, 1, 0x1a, 0xe1, 10, 0, 0, 2, 0x1a, 0xe2},
+	})
+
+	ht := tracker.NewHTTPTracker(srv.URL + "/announce")
+	defer ht.Close()
+
+	res, err := ht.AnnounceTracker(context.Background(), tracker.AnnounceRequest{InfoHash: testInfoHash, Port: 6881}, testPeerId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Interval != 900 || res.MinInterval != 300 {
+		t.Errorf("unexpected intervals %d/%d", res.Interval, res.MinInterval)
+	}
+	if res.TrackerId != "abc" || res.Warning != "slow down" {
+		t.Errorf("unexpected tracker id %q or warning %q", res.TrackerId, res.Warning)
+	}
+	if res.Seeders != 4 || res.Leechers != 2 {
+		t.Errorf("unexpected swarm size %d/%d", res.Seeders, res.Leechers)
+	}
+	if len(res.Peers) != 2 || res.Peers[0].String() != "10.0.0.1:6881" || res.Peers[1].String() != "10.0.0.2:6882" {
+		t.Errorf("unexpected peers %v", res.Peers)
+	}
+}
+
+func TestHTTPAnnounceDictionary(t *testing.T) {
+	srv := newHTTPTracker(t, map[string]any{
+		"interval": 900,
+		"peers": []any{
+			map[string]any{"ip": "10.0.0.3", "port": 51413, "peer id": "-TR3000-000000000000"},
+		},
+	})
+
+	ht := tracker.NewHTTPTracker(srv.URL + "/announce")
+	defer ht.Close()
+
+	res, err := ht.AnnounceTracker(context.Background(), tracker.AnnounceRequest{InfoHash: testInfoHash}, testPeerId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.Peers) != 1 || res.Peers[0].String() != "10.0.0.3:51413" {
+		t.Errorf("unexpected peers %v", res.Peers)
+	}
+}
+
+func TestHTTPAnnounceIPv6(t *testing.T) {
+	peers6 := append(
+		peer.NewPeer(net.ParseIP("2001:db8::1"), 6881).EncodeCompact(),
+		peer.NewPeer(net.IPv6loopback, 6882).EncodeCompact()...,
+	)
+	srv := newHTTPTracker(t, map[string]any{
+		"interval": 900,
+		"peers":    []byte{10, 0, 0, 1, 0x1a, 0xe1},
+		"peers6":   peers6,
+	})
+
+	ht := tracker.NewHTTPTracker(srv.URL + "/announce")
+	defer ht.Close()
+
+	res, err := ht.AnnounceTracker(context.Background(), tracker.AnnounceRequest{InfoHash: testInfoHash}, testPeerId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.Peers) != 3 || res.Peers[1].String() != "[2001:db8::1]:6881" || res.Peers[2].String() != "[::1]:6882" {
+		t.Errorf("unexpected peers %v", res.Peers)
+	}
+}
+
+func TestHTTPAnnounceFailure(t *testing.T) {
+	srv := newHTTPTracker(t, map[string]any{
+		"failure reason": "torrent not registered",
+	})
+
+	ht := tracker.NewHTTPTracker(srv.URL + "/announce")
+	defer ht.Close()
+
+	_, err := ht.AnnounceTracker(context.Background(), tracker.AnnounceRequest{InfoHash: testInfoHash}, testPeerId)
+	trackerErr, ok := err.(*tracker.TrackerError)
+	if !ok {
+		t.Fatalf("expected *tracker.TrackerError, got %v", err)
+	}
+	if trackerErr.Message != "torrent not registered" {
+		t.Errorf("unexpected failure reason %q", trackerErr.Message)
+	}
+}
+
+func TestTrackerManagerHTTP(t *testing.T) {
+	srv := newHTTPTracker(t, map[string]any{
+		"interval": 900,
+		"peers":    []byte{10, 0, 0, 1, 0x1a, 0xe1},
+	})
+
+	tm := tracker.NewTrackerManager(context.Background(), [][]string{{srv.URL + "/announce"}}, testInfoHash, testPeerId)
+	peerChan, err := tm.StartTracker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tm.StopTracker()
+
+	select {
+	case p := <-peerChan:
+		if p.String() != "10.0.0.1:6881" {
+			t.Errorf("unexpected peer %s", p.String())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no peers received from HTTP tracker")
+	}
+}
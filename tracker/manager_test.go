@@ -0,0 +1,309 @@
+package tracker_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/JoelVCrasta/clover/config"
+	"github.com/JoelVCrasta/clover/metainfo"
+	"github.com/JoelVCrasta/clover/tracker"
+)
+
+// newFlakyHTTPTracker starts a stand-in HTTP tracker that fails the first `failures` announces.
+func newFlakyHTTPTracker(t *testing.T, failures int32) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var announces atomic.Int32
+	failure, _ := metainfo.BencodeMarshall(map[string]any{"failure reason": "try again later"})
+	success, _ := metainfo.BencodeMarshall(map[string]any{
+		"interval": 900,
+		"peers":    []byte{10, 0, 0, 9, 0x1a, 0xe1},
+	})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if announces.Add(1) <= failures {
+			w.Write(failure)
+			return
+		}
+		w.Write(success)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, &announces
+}
+
+// withBackoff shortens the tracker backoff for the duration of the test.
+func withBackoff(t *testing.T, allTiers bool) {
+	t.Helper()
+
+	saved := config.Config
+	config.Config.TrackerMinBackoff = 10 * time.Millisecond
+	config.Config.TrackerMaxBackoff = 50 * time.Millisecond
+	config.Config.AnnounceToAllTiers = allTiers
+	t.Cleanup(func() { config.Config = saved })
+}
+
+func TestTrackerManagerNextTier(t *testing.T) {
+	withBackoff(t, false)
+
+	bad, badAnnounces := newFlakyHTTPTracker(t, 1<<30)
+	good, _ := newFlakyHTTPTracker(t, 0)
+
+	tiers := [][]string{{bad.URL + "/announce"}, {good.URL + "/announce"}}
+	tm := tracker.NewTrackerManager(context.Background(), tiers, testInfoHash, testPeerId)
+	peerChan, err := tm.StartTracker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tm.StopTracker()
+
+	select {
+	case p := <-peerChan:
+		if p.String() != "10.0.0.9:6881" {
+			t.Errorf("unexpected peer %s", p.String())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no peers received from the second tier")
+	}
+
+	if badAnnounces.Load() == 0 {
+		t.Error("first tier was never tried")
+	}
+}
+
+func TestTrackerManagerBackoff(t *testing.T) {
+	withBackoff(t, true)
+
+	srv, announces := newFlakyHTTPTracker(t, 3)
+
+	tm := tracker.NewTrackerManager(context.Background(), [][]string{{srv.URL + "/announce"}}, testInfoHash, testPeerId)
+	peerChan, err := tm.StartTracker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tm.StopTracker()
+
+	select {
+	case <-peerChan:
+		if announces.Load() != 4 {
+			t.Errorf("expected 4 announces, got %d", announces.Load())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("tracker was not retried after failing")
+	}
+}
+
+// fakeStats is a StatsProvider with fixed values.
+type fakeStats struct {
+	left atomic.Uint64
+}
+
+func (f *fakeStats) AnnounceStats() tracker.AnnounceStats {
+	return tracker.AnnounceStats{Downloaded: 1000, Left: f.left.Load()}
+}
+
+func TestTrackerManagerEvents(t *testing.T) {
+	withBackoff(t, true)
+
+	var mu sync.Mutex
+	var events, lefts []string
+
+	body, _ := metainfo.BencodeMarshall(map[string]any{
+		"interval": 900,
+		"peers":    []byte{10, 0, 0, 1, 0x1a, 0xe1},
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("port") != strconv.Itoa(int(config.Config.Port)) || query.Get("downloaded") != "1000" {
+			t.Errorf("unexpected announce parameters %v", query)
+		}
+
+		mu.Lock()
+		events = append(events, query.Get("event"))
+		lefts = append(lefts, query.Get("left"))
+		mu.Unlock()
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	stats := &fakeStats{}
+	stats.left.Store(500)
+
+	tm := tracker.NewTrackerManager(context.Background(), [][]string{{srv.URL + "/announce"}}, testInfoHash, testPeerId)
+	tm.SetStatsProvider(stats)
+
+	peerChan, err := tm.StartTracker()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-peerChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no peers received from tracker")
+	}
+
+	stats.left.Store(0)
+	tm.StopTracker()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if !slices.Equal(events, []string{"started", "completed", "stopped"}) {
+		t.Errorf("unexpected events %q", events)
+	}
+	if !slices.Equal(lefts, []string{"500", "0", "0"}) {
+		t.Errorf("unexpected left values %q", lefts)
+	}
+}
+
+func TestTrackerManagerCompleted(t *testing.T) {
+	withBackoff(t, true)
+
+	events := make(chan string, 10)
+	body, _ := metainfo.BencodeMarshall(map[string]any{
+		"interval": 900,
+		"peers":    []byte{10, 0, 0, 1, 0x1a, 0xe1},
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events <- r.URL.Query().Get("event")
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	stats := &fakeStats{}
+	stats.left.Store(500)
+
+	tm := tracker.NewTrackerManager(context.Background(), [][]string{{srv.URL + "/announce"}}, testInfoHash, testPeerId)
+	tm.SetStatsProvider(stats)
+	defer tm.StopTracker()
+
+	peerChan, err := tm.StartTracker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event := <-events; event != "started" {
+		t.Fatalf("expected started, got %q", event)
+	}
+	<-peerChan
+
+	// The completed event does not wait for the interval of 900 seconds
+	stats.left.Store(0)
+	tm.Completed()
+
+	select {
+	case event := <-events:
+		if event != "completed" {
+			t.Errorf("expected completed, got %q", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("completed was not announced when the download finished")
+	}
+}
+
+func TestTrackerManagerStatus(t *testing.T) {
+	withBackoff(t, true)
+
+	bad, _ := newFlakyHTTPTracker(t, 1<<30)
+	good := newHTTPTracker(t, map[string]any{
+		"interval":   900,
+		"complete":   4,
+		"incomplete": 2,
+		"peers":      []byte{10, 0, 0, 1, 0x1a, 0xe1, 10, 0, 0, 2, 0x1a, 0xe2},
+	})
+
+	tiers := [][]string{{bad.URL + "/announce"}, {good.URL + "/announce"}}
+	tm := tracker.NewTrackerManager(context.Background(), tiers, testInfoHash, testPeerId)
+	peerChan, err := tm.StartTracker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tm.StopTracker()
+
+	for range 2 {
+		select {
+		case <-peerChan:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no peers received from tracker")
+		}
+	}
+
+	var trackers []tracker.Tracker
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		trackers = tm.Trackers()
+		if trackers[0].Failures > 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if len(trackers) != 2 {
+		t.Fatalf("expected 2 trackers, got %d", len(trackers))
+	}
+	if failing := trackers[0]; failing.Tier != 0 || failing.Failures == 0 || failing.LastError == nil {
+		t.Errorf("unexpected state of the failing tracker %+v", failing)
+	}
+	working := trackers[1]
+	if working.Tier != 1 || working.LastError != nil || working.LastAnnounce.IsZero() {
+		t.Errorf("unexpected state of the working tracker %+v", working)
+	}
+	if working.PeersReturned != 2 || working.Seeders != 4 || working.Leechers != 2 {
+		t.Errorf("unexpected announce results %+v", working)
+	}
+	if until := time.Until(working.NextAnnounce); until < 890*time.Second || until > 900*time.Second {
+		t.Errorf("unexpected next announce in %v", until)
+	}
+}
+
+func TestTrackerManagerAddRemove(t *testing.T) {
+	withBackoff(t, true)
+
+	srv := newHTTPTracker(t, map[string]any{
+		"interval": 900,
+		"peers":    []byte{10, 0, 0, 1, 0x1a, 0xe1},
+	})
+
+	tm := tracker.NewTrackerManager(context.Background(), nil, testInfoHash, testPeerId)
+	peerChan, err := tm.StartTracker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tm.StopTracker()
+
+	if err := tm.AddTracker("wss://tracker.example/announce", 0); err == nil {
+		t.Error("expected an error for an unsupported scheme")
+	}
+	if err := tm.AddTracker(srv.URL+"/announce", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.AddTracker(srv.URL+"/announce", 0); err == nil {
+		t.Error("expected an error for a duplicate tracker")
+	}
+
+	select {
+	case p := <-peerChan:
+		if p.String() != "10.0.0.1:6881" {
+			t.Errorf("unexpected peer %s", p.String())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no peers received from the added tracker")
+	}
+
+	if !tm.RemoveTracker(srv.URL + "/announce") {
+		t.Error("tracker was not removed")
+	}
+	if tm.RemoveTracker(srv.URL + "/announce") {
+		t.Error("tracker was removed twice")
+	}
+	if trackers := tm.Trackers(); len(trackers) != 0 {
+		t.Errorf("expected no trackers, got %+v", trackers)
+	}
+}
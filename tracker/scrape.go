@@ -1,70 +1,293 @@
 package tracker
 
 import (
+	"context"
 	"encoding/binary"
-	"log"
-	"time"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 
 	"github.com/JoelVCrasta/clover/config"
+	"github.com/JoelVCrasta/clover/metainfo"
 )
 
+// MaxScrapeHashes is the number of info hashes that fit in a single UDP scrape request (BEP 15).
+const MaxScrapeHashes = 74
+
+// ErrScrapeNotSupported is returned for HTTP trackers whose announce URL does not follow the scrape convention.
+var ErrScrapeNotSupported = errors.New("tracker does not support scrape")
+
 type ScrapeRequest struct {
 	ConnectionId  uint64
 	Action        uint32
 	TransactionId uint32
-	InfoHash      [20]byte
+	InfoHashes    [][20]byte
 }
 
 type ScrapeResponse struct {
-	action        uint32
-	transactionId uint32
-	seeders       uint32
-	leechers      uint32
-	completed     uint32
+	Action        uint32
+	TransactionId uint32
+	Results       []ScrapeResult
+}
+
+// ScrapeResult is the swarm health of a single torrent as reported by the tracker.
+type ScrapeResult struct {
+	InfoHash  [20]byte
+	Seeders   uint32
+	Leechers  uint32
+	Completed uint32
+}
+
+// ScrapeReport is the outcome of scraping a single tracker.
+type ScrapeReport struct {
+	Url      string
+	Response *ScrapeResponse
+	Err      error
+}
+
+// scraper is implemented by both the UDP and the HTTP tracker clients.
+type scraper interface {
+	Scrape(ctx context.Context, infoHashes [][20]byte) (*ScrapeResponse, error)
+	Close()
 }
 
 /*
-Scrape sends a scrape request to the tracker.
-It includes the connectionID, action, transaction ID, and info hash.
-It returns a ScrapeResponse object containing the response from the tracker.
+Scrape sends a scrape request for up to MaxScrapeHashes info hashes to the tracker.
+It includes the connectionID, action, transaction ID, and the info hashes.
+It returns a ScrapeResponse object containing a result for every info hash, in the same order.
 */
-func (c Connection) Scrape() (*ScrapeResponse, error) {
+func (c *Connection) Scrape(ctx context.Context, infoHashes [][20]byte) (*ScrapeResponse, error) {
+	if err := validateScrapeHashes(infoHashes); err != nil {
+		return nil, err
+	}
+
 	sr := ScrapeRequest{
-		ConnectionId:  c.connectionId,
-		Action:        2,
-		TransactionId: c.transactionId,
+		Action:     actionScrape,
+		InfoHashes: infoHashes,
+	}
+
+	body := make([]byte, 0, 20*len(sr.InfoHashes))
+	for _, infoHash := range sr.InfoHashes {
+		body = append(body, infoHash[:]...) // 20 bytes each
+	}
+
+	buf, err := c.request(ctx, sr.Action, body, 8+12*len(sr.InfoHashes))
+	if err != nil {
+		return nil, err
+	}
+
+	var s ScrapeResponse
+	s.decodeScrapeResponse(buf, sr.InfoHashes)
+	return &s, nil
+}
+
+// decodeScrapeResponse decodes the response from the scrape request and returns a ScrapeResponse object.
+func (s *ScrapeResponse) decodeScrapeResponse(buf []byte, infoHashes [][20]byte) {
+	s.Action = binary.BigEndian.Uint32(buf)
+	s.TransactionId = binary.BigEndian.Uint32(buf[4:])
+	s.Results = make([]ScrapeResult, len(infoHashes))
+
+	for i, infoHash := range infoHashes {
+		offset := 8 + i*12
+
+		s.Results[i] = ScrapeResult{
+			InfoHash:  infoHash,
+			Seeders:   binary.BigEndian.Uint32(buf[offset:]),
+			Completed: binary.BigEndian.Uint32(buf[offset+4:]),
+			Leechers:  binary.BigEndian.Uint32(buf[offset+8:]),
+		}
 	}
+}
 
-	packet := make([]byte, 32)
-	binary.BigEndian.PutUint64(packet, sr.ConnectionId)       // 8 bytes
-	binary.BigEndian.PutUint32(packet[8:], sr.Action)         // 4 bytes
-	binary.BigEndian.PutUint32(packet[12:], sr.TransactionId) // 4 bytes
-	copy(packet[16:], sr.InfoHash[:])                         // 20 bytes
+/*
+Scrape sends an HTTP scrape request for the info hashes to the tracker.
+The scrape URL is derived from the announce URL by convention, see ScrapeUrl.
+It returns a ScrapeResponse object containing a result for every info hash the tracker knows about.
+*/
+func (h *HTTPTracker) Scrape(ctx context.Context, infoHashes [][20]byte) (*ScrapeResponse, error) {
+	if err := validateScrapeHashes(infoHashes); err != nil {
+		return nil, err
+	}
 
-	n, err := c.conn.Write(packet[:])
+	scrapeUrl, err := ScrapeUrl(h.announceUrl)
 	if err != nil {
 		return nil, err
 	}
-	c.conn.SetDeadline(time.Now().Add(config.Config.TrackerConnectTimeout))
 
-	buf := make([]byte, 1024)
-	_, err = c.conn.Read(buf)
+	params := url.Values{}
+	for _, infoHash := range infoHashes {
+		params.Add("info_hash", string(infoHash[:]))
+	}
+
+	base, err := url.Parse(scrapeUrl)
 	if err != nil {
 		return nil, err
 	}
+	query := params.Encode()
+	if base.RawQuery != "" {
+		query = base.RawQuery + "&" + query
+	}
+	base.RawQuery = query
 
-	log.Printf("Recieved %v from scrape request\n ", n)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tracker responded with status %s", res.Status)
+	}
 
 	var s ScrapeResponse
-	s.decodeScrapeResponse(buf)
+	if err := s.decodeHTTPScrapeResponse(body, infoHashes); err != nil {
+		return nil, err
+	}
+
 	return &s, nil
 }
 
-// decodeScrapeResponse decodes the response from the scrape request and returns a ScrapeResponse object.
-func (s *ScrapeResponse) decodeScrapeResponse(buf []byte) {
-	s.action = binary.BigEndian.Uint32(buf)
-	s.transactionId = binary.BigEndian.Uint32(buf[4:])
-	s.seeders = binary.BigEndian.Uint32(buf[8:])
-	s.leechers = binary.BigEndian.Uint32(buf[12:])
-	s.completed = binary.BigEndian.Uint32(buf[16:])
+// decodeHTTPScrapeResponse decodes the bencoded files dictionary of an HTTP scrape response.
+func (s *ScrapeResponse) decodeHTTPScrapeResponse(body []byte, infoHashes [][20]byte) error {
+	decoded, err := metainfo.BencodeUnmarshall(body)
+	if err != nil {
+		return fmt.Errorf("invalid tracker response: %v", err)
+	}
+
+	dict, ok := decoded.(map[string]any)
+	if !ok {
+		return fmt.Errorf("invalid tracker response format")
+	}
+
+	if reason, ok := dict["failure reason"].([]byte); ok {
+		return &TrackerError{Message: string(reason)}
+	}
+
+	files, ok := dict["files"].(map[string]any)
+	if !ok {
+		return fmt.Errorf("missing files in scrape response")
+	}
+
+	s.Action = actionScrape
+	for _, infoHash := range infoHashes {
+		file, ok := files[string(infoHash[:])].(map[string]any)
+		if !ok {
+			continue
+		}
+
+		result := ScrapeResult{InfoHash: infoHash}
+		if complete, ok := file["complete"].(int); ok && complete > 0 {
+			result.Seeders = uint32(complete)
+		}
+		if incomplete, ok := file["incomplete"].(int); ok && incomplete > 0 {
+			result.Leechers = uint32(incomplete)
+		}
+		if downloaded, ok := file["downloaded"].(int); ok && downloaded > 0 {
+			result.Completed = uint32(downloaded)
+		}
+		s.Results = append(s.Results, result)
+	}
+
+	return nil
+}
+
+/*
+ScrapeUrl derives the scrape URL of an HTTP tracker from its announce URL.
+By convention the last path segment has to start with "announce", which is replaced with "scrape".
+*/
+func ScrapeUrl(announceUrl string) (string, error) {
+	parsed, err := url.Parse(announceUrl)
+	if err != nil {
+		return "", err
+	}
+
+	i := strings.LastIndex(parsed.Path, "/")
+	if i < 0 || !strings.HasPrefix(parsed.Path[i+1:], "announce") {
+		return "", ErrScrapeNotSupported
+	}
+
+	parsed.Path = parsed.Path[:i+1] + "scrape" + strings.TrimPrefix(parsed.Path[i+1:], "announce")
+	parsed.RawPath = ""
+
+	return parsed.String(), nil
+}
+
+// ScrapeTracker connects to the UDP or HTTP tracker at the URL and scrapes the info hashes.
+func ScrapeTracker(ctx context.Context, trackerUrl string, infoHashes [][20]byte) (*ScrapeResponse, error) {
+	conn, err := dialTracker(ctx, trackerUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	s, ok := conn.(scraper)
+	if !ok {
+		return nil, ErrScrapeNotSupported
+	}
+
+	return s.Scrape(ctx, infoHashes)
+}
+
+/*
+ScrapeAll scrapes the info hashes from every tracker of every tier concurrently,
+with at most MaxTrackerConnections trackers at a time.
+It returns a report for every tracker, in the order of the tiers, with the error of the context for the trackers
+that were not scraped before it was cancelled.
+*/
+func ScrapeAll(ctx context.Context, tiers [][]string, infoHashes [][20]byte) []ScrapeReport {
+	var reports []ScrapeReport
+	for _, tier := range tiers {
+		for _, trackerUrl := range tier {
+			reports = append(reports, ScrapeReport{Url: trackerUrl})
+		}
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, max(config.Config.MaxTrackerConnections, 1))
+
+	for i := range reports {
+		wg.Add(1)
+		go func(report *ScrapeReport) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				report.Err = ctx.Err()
+				return
+			}
+			defer func() { <-sem }()
+
+			report.Response, report.Err = ScrapeTracker(ctx, report.Url, infoHashes)
+		}(&reports[i])
+	}
+	wg.Wait()
+
+	return reports
+}
+
+// validateScrapeHashes checks that the info hashes fit in a single scrape request.
+func validateScrapeHashes(infoHashes [][20]byte) error {
+	if len(infoHashes) == 0 {
+		return fmt.Errorf("no info hashes to scrape")
+	}
+	if len(infoHashes) > MaxScrapeHashes {
+		return fmt.Errorf("too many info hashes to scrape: %d, at most %d", len(infoHashes), MaxScrapeHashes)
+	}
+
+	return nil
 }
@@ -0,0 +1,93 @@
+package tracker_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/JoelVCrasta/clover/metainfo"
+	"github.com/JoelVCrasta/clover/tracker"
+)
+
+func TestScrapeUrl(t *testing.T) {
+	tests := []struct {
+		announce string
+		scrape   string
+	}{
+		{"http://example.com/announce", "http://example.com/scrape"},
+		{"http://example.com/x/announce", "http://example.com/x/scrape"},
+		{"http://example.com/announce.php", "http://example.com/scrape.php"},
+		{"http://example.com/announce?x2%0644", "http://example.com/scrape?x2%0644"},
+		{"http://example.com/a", ""},
+		{"http://example.com/announce?x=2/4", "http://example.com/scrape?x=2/4"},
+		{"http://example.com/x%064announce", ""},
+	}
+
+	for _, test := range tests {
+		scrape, err := tracker.ScrapeUrl(test.announce)
+		if test.scrape == "" {
+			if err != tracker.ErrScrapeNotSupported {
+				t.Errorf("%s: expected ErrScrapeNotSupported, got %q, %v", test.announce, scrape, err)
+			}
+			continue
+		}
+		if err != nil || scrape != test.scrape {
+			t.Errorf("%s: expected %s, got %q, %v", test.announce, test.scrape, scrape, err)
+		}
+	}
+}
+
+func TestHTTPScrape(t *testing.T) {
+	other := [20]byte{9, 9, 9}
+	body, _ := metainfo.BencodeMarshall(map[string]any{
+		"files": map[string]any{
+			string(testInfoHash[:]): map[string]any{"complete": 5, "incomplete": 3, "downloaded": 50},
+			string(other[:]):        map[string]any{"complete": 1, "incomplete": 0, "downloaded": 2},
+		},
+	})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" {
+			t.Errorf("unexpected scrape path %s", r.URL.Path)
+		}
+		if len(r.URL.Query()["info_hash"]) != 2 {
+			t.Errorf("expected 2 info hashes, got %v", r.URL.Query()["info_hash"])
+		}
+		w.Write(body)
+	}))
+	defer srv.Close()
+
+	res, err := tracker.ScrapeTracker(context.Background(), srv.URL+"/announce", [][20]byte{testInfoHash, other})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.Results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(res.Results))
+	}
+	if r := res.Results[0]; r.InfoHash != testInfoHash || r.Seeders != 5 || r.Leechers != 3 || r.Completed != 50 {
+		t.Errorf("unexpected result %+v", r)
+	}
+	if r := res.Results[1]; r.InfoHash != other || r.Seeders != 1 || r.Completed != 2 {
+		t.Errorf("unexpected result %+v", r)
+	}
+}
+
+func TestScrapeAllCancelled(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected scrape of a cancelled context")
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	reports := tracker.ScrapeAll(ctx, [][]string{{srv.URL + "/announce"}, {srv.URL + "/announce"}}, [][20]byte{testInfoHash})
+	for _, report := range reports {
+		if !errors.Is(report.Err, context.Canceled) {
+			t.Errorf("%s: expected the error of the context, got %v", report.Url, report.Err)
+		}
+	}
+}
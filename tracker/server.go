@@ -0,0 +1,330 @@
+package tracker
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/JoelVCrasta/clover/config"
+	"github.com/JoelVCrasta/clover/peer"
+)
+
+const (
+	// defaultNumwant is the number of peers returned when the client does not ask for a specific number.
+	defaultNumwant = 50
+
+	// maxNumwant is the most peers returned by a single announce.
+	maxNumwant = 200
+)
+
+// ServerOptions configures the built-in tracker server.
+type ServerOptions struct {
+	UDPAddr    string        // address of the UDP tracker (BEP 15), empty to disable it
+	HTTPAddr   string        // address of the HTTP tracker (BEP 3), empty to disable it
+	Interval   time.Duration // announce interval sent to the clients
+	PeerExpiry time.Duration // peers that did not announce for this long are dropped
+	Allowlist  [][20]byte    // if not empty, only these torrents are tracked
+}
+
+// Server is a lightweight BitTorrent tracker which keeps the swarms in memory.
+type Server struct {
+	opts    ServerOptions
+	allowed map[[20]byte]struct{}
+	secret  [16]byte
+
+	udpConn    *net.UDPConn
+	httpServer *http.Server
+	httpAddr   net.Addr
+
+	mu     sync.Mutex
+	swarms map[[20]byte]*swarm
+
+	wg        sync.WaitGroup
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// swarm is the state of a single torrent.
+type swarm struct {
+	peers     map[netip.AddrPort]*swarmPeer
+	completed uint32
+}
+
+type swarmPeer struct {
+	peerId   [20]byte
+	left     uint64
+	lastSeen time.Time
+}
+
+/*
+NewServer creates a tracker server with the given options.
+The interval defaults to DefaultTrackerInterval and peers expire after one and a half intervals by default.
+*/
+func NewServer(opts ServerOptions) *Server {
+	if opts.Interval <= 0 {
+		opts.Interval = time.Duration(config.Config.DefaultTrackerInterval) * time.Second
+	}
+	if opts.PeerExpiry <= 0 {
+		opts.PeerExpiry = opts.Interval * 3 / 2
+	}
+
+	s := &Server{
+		opts:   opts,
+		swarms: make(map[[20]byte]*swarm),
+		done:   make(chan struct{}),
+	}
+
+	if len(opts.Allowlist) > 0 {
+		s.allowed = make(map[[20]byte]struct{}, len(opts.Allowlist))
+		for _, infoHash := range opts.Allowlist {
+			s.allowed[infoHash] = struct{}{}
+		}
+	}
+
+	return s
+}
+
+// Start opens the UDP and HTTP listeners and starts serving requests in the background.
+func (s *Server) Start() error {
+	if s.opts.UDPAddr == "" && s.opts.HTTPAddr == "" {
+		return fmt.Errorf("no tracker address to listen on")
+	}
+
+	if _, err := rand.Read(s.secret[:]); err != nil {
+		return err
+	}
+
+	if s.opts.UDPAddr != "" {
+		udpAddr, err := net.ResolveUDPAddr("udp", s.opts.UDPAddr)
+		if err != nil {
+			return err
+		}
+
+		s.udpConn, err = net.ListenUDP("udp", udpAddr)
+		if err != nil {
+			return err
+		}
+
+		s.wg.Add(1)
+		go s.serveUDP()
+	}
+
+	if s.opts.HTTPAddr != "" {
+		listener, err := net.Listen("tcp", s.opts.HTTPAddr)
+		if err != nil {
+			if s.udpConn != nil {
+				s.udpConn.Close()
+			}
+			return err
+		}
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/announce", s.handleAnnounce)
+		mux.HandleFunc("/scrape", s.handleScrape)
+
+		s.httpAddr = listener.Addr()
+		s.httpServer = &http.Server{
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.httpServer.Serve(listener)
+		}()
+	}
+
+	s.wg.Add(1)
+	go s.expirePeers()
+
+	return nil
+}
+
+// UDPAddr returns the address the UDP tracker listens on, or nil if it is disabled.
+func (s *Server) UDPAddr() net.Addr {
+	if s.udpConn == nil {
+		return nil
+	}
+	return s.udpConn.LocalAddr()
+}
+
+// HTTPAddr returns the address the HTTP tracker listens on, or nil if it is disabled.
+func (s *Server) HTTPAddr() net.Addr {
+	return s.httpAddr
+}
+
+// Close stops the listeners and waits for the server to shut down.
+func (s *Server) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+
+		if s.udpConn != nil {
+			s.udpConn.Close()
+		}
+		if s.httpServer != nil {
+			s.httpServer.Close()
+		}
+
+		s.wg.Wait()
+	})
+}
+
+/*
+announce records the announce of the peer at addr and returns the state of the swarm
+with up to numwant other peers.
+A stopped event removes the peer from the swarm.
+*/
+func (s *Server) announce(arq AnnounceRequest, peerId [20]byte, addr netip.AddrPort) (*AnnounceResponse, error) {
+	if !s.isAllowed(arq.InfoHash) {
+		return nil, &TrackerError{Message: "torrent not allowed"}
+	}
+	if arq.Port == 0 {
+		return nil, &TrackerError{Message: "invalid port"}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sw, ok := s.swarms[arq.InfoHash]
+	if !ok {
+		sw = &swarm{peers: make(map[netip.AddrPort]*swarmPeer)}
+		s.swarms[arq.InfoHash] = sw
+	}
+
+	if arq.Event == EventStopped {
+		delete(sw.peers, addr)
+	} else {
+		p, ok := sw.peers[addr]
+		if !ok {
+			p = &swarmPeer{}
+			sw.peers[addr] = p
+		}
+
+		if arq.Event == EventCompleted && (!ok || p.left > 0) {
+			sw.completed++
+		}
+		p.peerId = peerId
+		p.left = arq.Left
+		p.lastSeen = time.Now()
+	}
+
+	numwant := int(arq.Numwant)
+	if arq.Numwant == 0xffffffff {
+		// -1 asks for the default number of peers (BEP 15)
+		numwant = defaultNumwant
+	}
+	numwant = min(numwant, maxNumwant)
+	if arq.Event == EventStopped {
+		numwant = 0
+	}
+
+	seeders, leechers := sw.count()
+	a := &AnnounceResponse{
+		Action:      actionAnnounce,
+		Interval:    uint32(s.opts.Interval / time.Second),
+		MinInterval: uint32(s.opts.Interval / time.Second / 2),
+		Seeders:     seeders,
+		Leechers:    leechers,
+	}
+
+	// Map iteration order is random, so every announce gets a different sample of the swarm
+	for peerAddr := range sw.peers {
+		if len(a.Peers) >= numwant {
+			break
+		}
+		if peerAddr == addr {
+			continue
+		}
+		a.Peers = append(a.Peers, peer.NewPeer(peerAddr.Addr().AsSlice(), peerAddr.Port()))
+	}
+
+	return a, nil
+}
+
+// scrape returns the state of the swarms of the info hashes, unknown torrents are reported as empty.
+func (s *Server) scrape(infoHashes [][20]byte) []ScrapeResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	results := make([]ScrapeResult, 0, len(infoHashes))
+	for _, infoHash := range infoHashes {
+		result := ScrapeResult{InfoHash: infoHash}
+
+		if sw, ok := s.swarms[infoHash]; ok && s.isAllowed(infoHash) {
+			result.Seeders, result.Leechers = sw.count()
+			result.Completed = sw.completed
+		}
+		results = append(results, result)
+	}
+
+	return results
+}
+
+// isAllowed reports whether the torrent is tracked by this server.
+func (s *Server) isAllowed(infoHash [20]byte) bool {
+	if s.allowed == nil {
+		return true
+	}
+
+	_, ok := s.allowed[infoHash]
+	return ok
+}
+
+// failureMessage returns the message sent to the client for a rejected request.
+func failureMessage(err error) string {
+	var trackerErr *TrackerError
+	if errors.As(err, &trackerErr) {
+		return trackerErr.Message
+	}
+	return err.Error()
+}
+
+// expirePeers periodically drops the peers that stopped announcing, and the swarms left empty.
+func (s *Server) expirePeers() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(max(s.opts.PeerExpiry/4, time.Second))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+
+		deadline := time.Now().Add(-s.opts.PeerExpiry)
+
+		s.mu.Lock()
+		for infoHash, sw := range s.swarms {
+			for addr, p := range sw.peers {
+				if p.lastSeen.Before(deadline) {
+					delete(sw.peers, addr)
+				}
+			}
+			if len(sw.peers) == 0 && sw.completed == 0 {
+				delete(s.swarms, infoHash)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// count returns the number of seeders and leechers in the swarm.
+func (sw *swarm) count() (seeders, leechers uint32) {
+	for _, p := range sw.peers {
+		if p.left == 0 {
+			seeders++
+		} else {
+			leechers++
+		}
+	}
+
+	return seeders, leechers
+}
@@ -0,0 +1,162 @@
+package tracker
+
+import (
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+
+	"github.com/JoelVCrasta/clover/metainfo"
+)
+
+// httpEventIds maps the values of the HTTP event parameter back to the announce events.
+var httpEventIds = map[string]uint32{
+	"":          EventNone,
+	"completed": EventCompleted,
+	"started":   EventStarted,
+	"stopped":   EventStopped,
+}
+
+/*
+handleAnnounce answers an HTTP announce request (BEP 3).
+Peers are returned in the compact model (BEP 23) with IPv6 peers in peers6 (BEP 7),
+unless the client asks for the dictionary model with compact=0.
+*/
+func (s *Server) handleAnnounce(w http.ResponseWriter, r *http.Request) {
+	remote, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		writeHTTPFailure(w, "invalid remote address")
+		return
+	}
+
+	query := r.URL.Query()
+	arq, peerId, err := parseHTTPAnnounce(query)
+	if err != nil {
+		writeHTTPFailure(w, failureMessage(err))
+		return
+	}
+
+	a, err := s.announce(arq, peerId, netip.AddrPortFrom(remote.Addr().Unmap(), arq.Port))
+	if err != nil {
+		writeHTTPFailure(w, failureMessage(err))
+		return
+	}
+
+	response := map[string]any{
+		"interval":     int(a.Interval),
+		"min interval": int(a.MinInterval),
+		"complete":     int(a.Seeders),
+		"incomplete":   int(a.Leechers),
+	}
+
+	if query.Get("compact") == "0" {
+		peers := make([]any, 0, len(a.Peers))
+		for _, p := range a.Peers {
+			peers = append(peers, map[string]any{
+				"ip":   p.IpAddr.String(),
+				"port": int(p.Port),
+			})
+		}
+		response["peers"] = peers
+	} else {
+		var peers, peers6 []byte
+		for _, p := range a.Peers {
+			if p.IsIPv6() {
+				peers6 = append(peers6, p.EncodeCompact()...)
+			} else {
+				peers = append(peers, p.EncodeCompact()...)
+			}
+		}
+
+		response["peers"] = peers
+		if len(peers6) > 0 {
+			response["peers6"] = peers6
+		}
+	}
+
+	writeBencoded(w, response)
+}
+
+// parseHTTPAnnounce decodes the parameters of an HTTP announce request.
+func parseHTTPAnnounce(query url.Values) (AnnounceRequest, [20]byte, error) {
+	var arq AnnounceRequest
+	var peerId [20]byte
+
+	infoHash := query.Get("info_hash")
+	if len(infoHash) != 20 {
+		return arq, peerId, &TrackerError{Message: "invalid info_hash"}
+	}
+	if len(query.Get("peer_id")) != 20 {
+		return arq, peerId, &TrackerError{Message: "invalid peer_id"}
+	}
+	copy(arq.InfoHash[:], infoHash)
+	copy(peerId[:], query.Get("peer_id"))
+
+	port, err := strconv.ParseUint(query.Get("port"), 10, 16)
+	if err != nil {
+		return arq, peerId, &TrackerError{Message: "invalid port"}
+	}
+	arq.Port = uint16(port)
+
+	event, ok := httpEventIds[query.Get("event")]
+	if !ok {
+		return arq, peerId, &TrackerError{Message: "invalid event"}
+	}
+	arq.Event = event
+
+	// Missing or malformed transfer statistics are treated as zero
+	arq.Uploaded, _ = strconv.ParseUint(query.Get("uploaded"), 10, 64)
+	arq.Downloaded, _ = strconv.ParseUint(query.Get("downloaded"), 10, 64)
+	arq.Left, _ = strconv.ParseUint(query.Get("left"), 10, 64)
+
+	arq.Numwant = defaultNumwant
+	if numwant, err := strconv.ParseUint(query.Get("numwant"), 10, 32); err == nil {
+		arq.Numwant = uint32(numwant)
+	}
+
+	return arq, peerId, nil
+}
+
+// handleScrape answers an HTTP scrape request with the state of every requested torrent the tracker knows about.
+func (s *Server) handleScrape(w http.ResponseWriter, r *http.Request) {
+	var infoHashes [][20]byte
+	for _, infoHash := range r.URL.Query()["info_hash"] {
+		if len(infoHash) != 20 {
+			writeHTTPFailure(w, "invalid info_hash")
+			return
+		}
+		infoHashes = append(infoHashes, [20]byte([]byte(infoHash)))
+	}
+
+	if err := validateScrapeHashes(infoHashes); err != nil {
+		writeHTTPFailure(w, err.Error())
+		return
+	}
+
+	files := make(map[string]any, len(infoHashes))
+	for _, result := range s.scrape(infoHashes) {
+		files[string(result.InfoHash[:])] = map[string]any{
+			"complete":   int(result.Seeders),
+			"incomplete": int(result.Leechers),
+			"downloaded": int(result.Completed),
+		}
+	}
+
+	writeBencoded(w, map[string]any{"files": files})
+}
+
+// writeHTTPFailure rejects the request with a failure reason, which trackers send with status 200.
+func writeHTTPFailure(w http.ResponseWriter, reason string) {
+	writeBencoded(w, map[string]any{"failure reason": reason})
+}
+
+func writeBencoded(w http.ResponseWriter, response map[string]any) {
+	body, err := metainfo.BencodeMarshall(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(body)
+}
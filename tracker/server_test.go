@@ -0,0 +1,137 @@
+package tracker_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/JoelVCrasta/clover/config"
+	"github.com/JoelVCrasta/clover/tracker"
+)
+
+// newTestServer starts a tracker server on loopback and allows the clients to reach it.
+func newTestServer(t *testing.T, allowlist ...[20]byte) *tracker.Server {
+	t.Helper()
+
+	saved := config.Config
+	config.Config.AllowLoopbackTrackers = true
+	config.Config.TrackerConnectTimeout = time.Second
+	t.Cleanup(func() { config.Config = saved })
+
+	srv := tracker.NewServer(tracker.ServerOptions{
+		UDPAddr:   "127.0.0.1:0",
+		HTTPAddr:  "127.0.0.1:0",
+		Interval:  time.Minute,
+		Allowlist: allowlist,
+	})
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestServerAnnounceLoop(t *testing.T) {
+	srv := newTestServer(t)
+	udpUrl := "udp://" + srv.UDPAddr().String()
+	httpUrl := "http://" + srv.HTTPAddr().String() + "/announce"
+
+	// A seeder on another port joins the swarm over HTTP
+	seeder := tracker.NewHTTPTracker(httpUrl)
+	defer seeder.Close()
+
+	seederPeerId := [20]byte{'-', 'S', 'E', 'E', 'D', '-'}
+	res, err := seeder.AnnounceTracker(context.Background(), tracker.AnnounceRequest{
+		InfoHash: testInfoHash,
+		Port:     7000,
+		Event:    tracker.EventCompleted,
+		Numwant:  50,
+	}, seederPeerId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Seeders != 1 || len(res.Peers) != 0 {
+		t.Errorf("unexpected response to the seeder %+v", res)
+	}
+
+	// The manager announces over UDP and has to learn about the seeder
+	tm := tracker.NewTrackerManager(context.Background(), [][]string{{udpUrl}}, testInfoHash, testPeerId)
+	peerChan, err := tm.StartTracker()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case p := <-peerChan:
+		if p.String() != "127.0.0.1:7000" {
+			t.Errorf("unexpected peer %s", p.String())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no peers received from the tracker server")
+	}
+
+	scrape, err := tracker.ScrapeTracker(context.Background(), httpUrl, [][20]byte{testInfoHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := scrape.Results[0]; result.Seeders != 1 || result.Leechers != 1 || result.Completed != 1 {
+		t.Errorf("unexpected scrape result %+v", result)
+	}
+
+	// The stopped event removes the manager from the swarm
+	tm.StopTracker()
+
+	scrape, err = tracker.ScrapeTracker(context.Background(), udpUrl, [][20]byte{testInfoHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := scrape.Results[0]; result.Seeders != 1 || result.Leechers != 0 {
+		t.Errorf("unexpected scrape result after stopping %+v", result)
+	}
+}
+
+func TestServerAllowlist(t *testing.T) {
+	srv := newTestServer(t, testInfoHash)
+
+	for _, trackerUrl := range []string{
+		"udp://" + srv.UDPAddr().String(),
+		"http://" + srv.HTTPAddr().String() + "/announce",
+	} {
+		tm := tracker.NewTrackerManager(context.Background(), nil, [20]byte{9}, testPeerId)
+		if err := tm.AddTracker(trackerUrl, 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tm.StartTracker(); err != nil {
+			t.Fatal(err)
+		}
+
+		var status tracker.Tracker
+		deadline := time.Now().Add(5 * time.Second)
+		for status.LastError == nil && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+			status = tm.Trackers()[0]
+		}
+		tm.StopTracker()
+
+		var trackerErr *tracker.TrackerError
+		if !errors.As(status.LastError, &trackerErr) || trackerErr.Message != "torrent not allowed" {
+			t.Errorf("%s: expected the torrent to be rejected, got %v", trackerUrl, status.LastError)
+		}
+	}
+}
+
+func TestLoopbackTrackerRejected(t *testing.T) {
+	srv := newTestServer(t)
+	config.Config.AllowLoopbackTrackers = false
+
+	if _, err := tracker.ConnectTracker(context.Background(), srv.UDPAddr().String()); err == nil {
+		t.Error("expected loopback trackers to be rejected by default")
+	}
+	_, port, _ := net.SplitHostPort(srv.UDPAddr().String())
+	if _, err := tracker.ConnectTracker(context.Background(), net.JoinHostPort("localhost", port)); err == nil {
+		t.Error("expected localhost trackers to be rejected by default")
+	}
+}
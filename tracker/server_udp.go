@@ -0,0 +1,175 @@
+package tracker
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// udpMaxPacket keeps announce responses below the usual Ethernet MTU.
+const udpMaxPacket = 1472
+
+// serveUDP reads and answers the requests of the UDP tracker until the socket is closed.
+func (s *Server) serveUDP() {
+	defer s.wg.Done()
+
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := s.udpConn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				continue
+			}
+			return
+		}
+
+		addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+		if response := s.handleUDPPacket(buf[:n], addr); response != nil {
+			s.udpConn.WriteToUDPAddrPort(response, addr)
+		}
+	}
+}
+
+/*
+handleUDPPacket handles a single connect, announce or scrape request (BEP 15).
+It returns the response packet, or nil if the packet has to be ignored.
+*/
+func (s *Server) handleUDPPacket(packet []byte, addr netip.AddrPort) []byte {
+	if len(packet) < 16 {
+		return nil
+	}
+
+	connectionId := binary.BigEndian.Uint64(packet)
+	action := binary.BigEndian.Uint32(packet[8:])
+	transactionId := binary.BigEndian.Uint32(packet[12:])
+
+	if action == actionConnect {
+		if connectionId != protocolId {
+			return nil
+		}
+
+		response := make([]byte, 16)
+		binary.BigEndian.PutUint32(response, actionConnect)
+		binary.BigEndian.PutUint32(response[4:], transactionId)
+		binary.BigEndian.PutUint64(response[8:], s.connectionId(addr, time.Now()))
+		return response
+	}
+
+	if !s.validConnectionId(connectionId, addr) {
+		return udpErrorPacket(transactionId, "invalid connection id")
+	}
+
+	switch action {
+	case actionAnnounce:
+		return s.handleUDPAnnounce(packet, transactionId, addr)
+
+	case actionScrape:
+		var infoHashes [][20]byte
+		for i := 16; i+20 <= len(packet); i += 20 {
+			infoHashes = append(infoHashes, [20]byte(packet[i:i+20]))
+		}
+		if err := validateScrapeHashes(infoHashes); err != nil {
+			return udpErrorPacket(transactionId, err.Error())
+		}
+
+		response := make([]byte, 8, 8+12*len(infoHashes))
+		binary.BigEndian.PutUint32(response, actionScrape)
+		binary.BigEndian.PutUint32(response[4:], transactionId)
+		for _, result := range s.scrape(infoHashes) {
+			response = binary.BigEndian.AppendUint32(response, result.Seeders)
+			response = binary.BigEndian.AppendUint32(response, result.Completed)
+			response = binary.BigEndian.AppendUint32(response, result.Leechers)
+		}
+		return response
+
+	default:
+		return udpErrorPacket(transactionId, "unknown action")
+	}
+}
+
+// handleUDPAnnounce decodes an announce request and returns the response with peers of the requester's address family.
+func (s *Server) handleUDPAnnounce(packet []byte, transactionId uint32, addr netip.AddrPort) []byte {
+	if len(packet) < 98 {
+		return udpErrorPacket(transactionId, "invalid announce request")
+	}
+
+	arq := AnnounceRequest{
+		Action:        actionAnnounce,
+		TransactionId: transactionId,
+		InfoHash:      [20]byte(packet[16:36]),
+		PeerId:        [20]byte(packet[36:56]),
+		Downloaded:    binary.BigEndian.Uint64(packet[56:]),
+		Left:          binary.BigEndian.Uint64(packet[64:]),
+		Uploaded:      binary.BigEndian.Uint64(packet[72:]),
+		Event:         binary.BigEndian.Uint32(packet[80:]),
+		IpAddr:        binary.BigEndian.Uint32(packet[84:]),
+		Key:           binary.BigEndian.Uint32(packet[88:]),
+		Numwant:       binary.BigEndian.Uint32(packet[92:]),
+		Port:          binary.BigEndian.Uint16(packet[96:]),
+	}
+
+	// The IP address field is ignored, peers are always registered with their source address
+	a, err := s.announce(arq, arq.PeerId, netip.AddrPortFrom(addr.Addr(), arq.Port))
+	if err != nil {
+		return udpErrorPacket(transactionId, failureMessage(err))
+	}
+
+	response := make([]byte, 20, udpMaxPacket)
+	binary.BigEndian.PutUint32(response, actionAnnounce)
+	binary.BigEndian.PutUint32(response[4:], transactionId)
+	binary.BigEndian.PutUint32(response[8:], a.Interval)
+	binary.BigEndian.PutUint32(response[12:], a.Leechers)
+	binary.BigEndian.PutUint32(response[16:], a.Seeders)
+
+	// Only peers of the same address family fit in the response (BEP 15)
+	for _, p := range a.Peers {
+		if p.IsIPv6() != addr.Addr().Is6() {
+			continue
+		}
+
+		compact := p.EncodeCompact()
+		if len(response)+len(compact) > udpMaxPacket {
+			break
+		}
+		response = append(response, compact...)
+	}
+
+	return response
+}
+
+/*
+connectionId derives the connection ID of the client from a secret, its address and the current minute,
+so no state has to be kept for the issued IDs.
+*/
+func (s *Server) connectionId(addr netip.AddrPort, now time.Time) uint64 {
+	h := sha1.New()
+	h.Write(s.secret[:])
+	h.Write(binary.BigEndian.AppendUint64(nil, uint64(now.Unix()/60)))
+	h.Write(addr.Addr().AsSlice())
+	h.Write(binary.BigEndian.AppendUint16(nil, addr.Port()))
+
+	return binary.BigEndian.Uint64(h.Sum(nil))
+}
+
+// validConnectionId accepts the IDs issued in the current and the previous minute, at least one minute as required by BEP 15.
+func (s *Server) validConnectionId(connectionId uint64, addr netip.AddrPort) bool {
+	now := time.Now()
+	return connectionId == s.connectionId(addr, now) || connectionId == s.connectionId(addr, now.Add(-time.Minute))
+}
+
+// udpErrorPacket creates an error response (action 3) with the message.
+func udpErrorPacket(transactionId uint32, message string) []byte {
+	response := make([]byte, 8, 8+len(message))
+	binary.BigEndian.PutUint32(response, actionError)
+	binary.BigEndian.PutUint32(response[4:], transactionId)
+
+	return append(response, message...)
+}
@@ -2,11 +2,12 @@ package tracker
 
 import (
 	"context"
-	"encoding/binary"
 	"fmt"
-	"log"
+	"math"
 	"math/rand"
-	"net"
+	"net/url"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/JoelVCrasta/clover/config"
@@ -14,28 +15,43 @@ import (
 )
 
 type TrackerManager struct {
-	// Trackers    []*Tracker
-	trackerUrls []string
-	infoHash    [20]byte
-	peerId      [20]byte
-	ctx         context.Context
-	cancel      context.CancelFunc
+	tiers    [][]string
+	trackers map[string]*Tracker
+	stats    StatsProvider
+	infoHash [20]byte
+	peerId   [20]byte
+	key      uint32
+	peerChan chan peer.Peer
+	changed  chan struct{}
+	complete chan struct{}
+	stopped  bool
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+	ctx      context.Context
+	cancel   context.CancelFunc
 }
 
-// Maybe needed for stats and reconnects in future
-// type Tracker struct {
-// 	Url          string
-// 	Connection   *Connection
-// 	Interval     time.Duration
-// 	LastAnnounce time.Time
-// }
+// Tracker is the state of a single tracker, used for reconnects and to report its health.
+type Tracker struct {
+	Url           string
+	Tier          int
+	LastAnnounce  time.Time
+	NextAnnounce  time.Time
+	LastError     error
+	Failures      int
+	PeersReturned int
+	Seeders       uint32
+	Leechers      uint32
 
-type Connection struct {
-	conn          *net.UDPConn
-	connectionId  uint64
-	transactionId uint32
+	conn      announcer
+	started   bool
+	completed bool
 }
 
+// allTiers makes an announce loop walk every tier, as described in BEP 12.
+const allTiers = -1
+
 type AnnounceRequest struct {
 	ConnectionId  uint64
 	Action        uint32
@@ -56,275 +72,623 @@ type AnnounceResponse struct {
 	Action        uint32
 	TransactionId uint32
 	Interval      uint32
+	MinInterval   uint32
 	Leechers      uint32
 	Seeders       uint32
+	TrackerId     string
+	Warning       string
 	Peers         []peer.Peer
 }
 
-func NewTrackerManager(ctx context.Context, trackerUrls []string, infoHash, peerId [20]byte) *TrackerManager {
+// announcer is implemented by both the UDP and the HTTP tracker clients.
+type announcer interface {
+	AnnounceTracker(ctx context.Context, arq AnnounceRequest, peerId [20]byte) (*AnnounceResponse, error)
+	Close()
+}
+
+// TrackerError is returned when the tracker rejects a request and tells us why.
+type TrackerError struct {
+	Message string
+}
+
+func (e *TrackerError) Error() string {
+	return fmt.Sprintf("tracker error: %s", e.Message)
+}
+
+// Announce events, numbered as in BEP 15.
+const (
+	EventNone      uint32 = 0
+	EventCompleted uint32 = 1
+	EventStarted   uint32 = 2
+	EventStopped   uint32 = 3
+)
+
+// stoppedTimeout bounds how long StopTracker waits for the announce loops to exit, and then for the stopped announces.
+const stoppedTimeout = 3 * time.Second
+
+// AnnounceStats are the transfer statistics reported to the trackers.
+type AnnounceStats struct {
+	Downloaded uint64
+	Left       uint64
+	Uploaded   uint64
+}
+
+// StatsProvider supplies the statistics sent with every announce.
+type StatsProvider interface {
+	AnnounceStats() AnnounceStats
+}
+
+/*
+NewTrackerManager creates a tracker manager for the given announce tiers (BEP 12).
+The tiers are copied so the manager can reorder them as trackers respond.
+*/
+func NewTrackerManager(ctx context.Context, tiers [][]string, infoHash, peerId [20]byte) *TrackerManager {
 	ctx, cancel := context.WithCancel(ctx)
 
-	return &TrackerManager{
-		// Trackers:    make([]*Tracker, 0),
-		trackerUrls: trackerUrls,
-		infoHash:    infoHash,
-		peerId:      peerId,
-		ctx:         ctx,
-		cancel:      cancel,
+	tm := &TrackerManager{
+		trackers: make(map[string]*Tracker),
+		infoHash: infoHash,
+		peerId:   peerId,
+		key:      rand.Uint32(),
+		changed:  make(chan struct{}),
+		complete: make(chan struct{}),
+		ctx:      ctx,
+		cancel:   cancel,
 	}
+
+	for _, tier := range tiers {
+		var urls []string
+		for _, trackerUrl := range tier {
+			if _, exists := tm.trackers[trackerUrl]; exists {
+				continue
+			}
+			tm.trackers[trackerUrl] = &Tracker{Url: trackerUrl, Tier: len(tm.tiers)}
+			urls = append(urls, trackerUrl)
+		}
+
+		if len(urls) > 0 {
+			tm.tiers = append(tm.tiers, urls)
+		}
+	}
+
+	return tm
 }
 
 /*
-Start connects to all trackers and starts announcing.
+Start connects to the trackers and starts announcing.
+If AnnounceToAllTiers is set, every tier is announced to independently, otherwise only the first
+working tracker across all tiers is used as described in BEP 12.
 It will periodically re-announce to the trackers.
 It returns a channel of Peer objects that can be used to connect to peers.
 */
 func (tm *TrackerManager) StartTracker() (<-chan peer.Peer, error) {
-	peerChan := make(chan peer.Peer, 500)
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
 
-	for _, url := range tm.trackerUrls {
-		go func(trackerUrl string) {
-			conn, err := ConnectTracker(trackerUrl)
-			if err != nil {
-				// log.Printf("[tracker] failed to connect to tracker %s: %v", trackerUrl, err)
-				return
-			}
-			defer conn.Close()
-
-			// Create an announce request
-			arq := AnnounceRequest{
-				Key:        rand.Uint32(),
-				InfoHash:   tm.infoHash,
-				IpAddr:     0,
-				Port:       6881,
-				Uploaded:   0,
-				Downloaded: 0,
-				Left:       500,
-				Event:      0,
-				Numwant:    50,
-			}
+	if tm.peerChan != nil || tm.stopped {
+		return nil, fmt.Errorf("tracker manager already started")
+	}
+	tm.peerChan = make(chan peer.Peer, 500)
+
+	if config.Config.AnnounceToAllTiers {
+		for i := range tm.tiers {
+			tm.wg.Add(1)
+			go tm.announceLoop(i)
+		}
+	} else {
+		tm.wg.Add(1)
+		go tm.announceLoop(allTiers)
+	}
 
-			response, err := conn.AnnounceTracker(arq, tm.peerId)
-			if err != nil {
-				// log.Printf("[tracker] announce failed for %s: %v", trackerUrl, err)
-				return
-			}
+	return tm.peerChan, nil
+}
 
-			// log.Printf("[tracker] recieved peers from %s", trackerUrl)
+/*
+SetStatsProvider sets the source of the downloaded, left and uploaded values sent with every announce.
+It has to be called before StartTracker, without one the manager announces that nothing is downloaded yet.
+*/
+func (tm *TrackerManager) SetStatsProvider(stats StatsProvider) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
 
-			for _, p := range response.Peers {
-				if p.IpAddr.IsUnspecified() {
-					continue
-				}
+	tm.stats = stats
+}
 
-				select {
-				case peerChan <- p:
-				case <-tm.ctx.Done():
-					return
-				}
+// Trackers returns a snapshot of the state of every tracker, in tier order.
+func (tm *TrackerManager) Trackers() []Tracker {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	var snapshot []Tracker
+	for _, tier := range tm.tiers {
+		for _, trackerUrl := range tier {
+			t := *tm.trackers[trackerUrl]
+			t.conn = nil
+			snapshot = append(snapshot, t)
+		}
+	}
 
-			}
+	return snapshot
+}
 
-			// Periodically re-announce to the tracker
-			interval := response.Interval
-			if response.Interval <= 0 {
-				interval = config.Config.DefaultTrackerInterval
+/*
+AddTracker adds a tracker to the given tier of a new or running manager.
+A tier index that does not exist yet appends a new tier, which gets its own announce loop
+when AnnounceToAllTiers is set.
+*/
+func (tm *TrackerManager) AddTracker(trackerUrl string, tier int) error {
+	parsed, err := url.Parse(trackerUrl)
+	if err != nil {
+		return err
+	}
+	switch parsed.Scheme {
+	case "udp", "http", "https":
+	default:
+		return fmt.Errorf("unsupported tracker scheme %q", parsed.Scheme)
+	}
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	if tm.stopped {
+		return fmt.Errorf("tracker manager stopped")
+	}
+	if _, exists := tm.trackers[trackerUrl]; exists {
+		return fmt.Errorf("tracker %s already added", trackerUrl)
+	}
+
+	newTier := tier < 0 || tier >= len(tm.tiers)
+	if newTier {
+		tier = len(tm.tiers)
+		tm.tiers = append(tm.tiers, nil)
+	}
+	tm.tiers[tier] = append(tm.tiers[tier], trackerUrl)
+	tm.trackers[trackerUrl] = &Tracker{Url: trackerUrl, Tier: tier}
+
+	if tm.peerChan != nil && newTier && config.Config.AnnounceToAllTiers {
+		tm.wg.Add(1)
+		go tm.announceLoop(tier)
+	}
+
+	// Wake up the loops that are waiting for a tracker to retry
+	close(tm.changed)
+	tm.changed = make(chan struct{})
+
+	return nil
+}
+
+/*
+Completed tells the manager that the download finished, so the trackers are sent the completed event
+right away rather than with the next periodic announce.
+*/
+func (tm *TrackerManager) Completed() {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	select {
+	case <-tm.complete:
+	default:
+		close(tm.complete)
+	}
+}
+
+/*
+RemoveTracker removes a tracker from the manager and reports whether it was found.
+A tracker that was sent a started event gets a best-effort stopped announce.
+*/
+func (tm *TrackerManager) RemoveTracker(trackerUrl string) bool {
+	tm.mu.Lock()
+	t, ok := tm.trackers[trackerUrl]
+	if !ok {
+		tm.mu.Unlock()
+		return false
+	}
+
+	delete(tm.trackers, trackerUrl)
+	tm.tiers[t.Tier] = slices.DeleteFunc(slices.Clone(tm.tiers[t.Tier]), func(u string) bool {
+		return u == trackerUrl
+	})
+	started := t.started
+	tm.mu.Unlock()
+
+	go func() {
+		if started {
+			ctx, cancel := context.WithTimeout(context.Background(), stoppedTimeout)
+			tm.announce(ctx, t, EventStopped)
+			cancel()
+		}
+		tm.closeConn(t)
+	}()
+
+	return true
+}
+
+/*
+Stop stops the tracker manager and closes all connections.
+Every tracker that was sent a started event gets a best-effort stopped announce, preceded by a
+completed announce if the download finished since the last announce. The announces in flight are
+cancelled, and neither they nor the stopped announces hold it up for more than stoppedTimeout each.
+*/
+func (tm *TrackerManager) StopTracker() {
+	tm.stopOnce.Do(func() {
+		tm.mu.Lock()
+		tm.stopped = true
+		tm.mu.Unlock()
+
+		if tm.cancel != nil {
+			tm.cancel()
+		}
+		waitTimeout(&tm.wg, stoppedTimeout)
+
+		tm.mu.Lock()
+		var started, all []*Tracker
+		for _, t := range tm.trackers {
+			if t.started {
+				started = append(started, t)
 			}
+			all = append(all, t)
+		}
+		tm.mu.Unlock()
 
-			ticker := time.NewTicker(time.Duration(interval) * time.Second)
-			defer ticker.Stop()
+		ctx, cancel := context.WithTimeout(context.Background(), stoppedTimeout)
+		defer cancel()
 
-			for {
-				select {
-				case <-ticker.C:
-					response, err = conn.AnnounceTracker(arq, tm.peerId)
-					if err != nil {
-						log.Printf("[tracker] re-announce failed for %s: %v", trackerUrl, err)
+		var wg sync.WaitGroup
+		for _, t := range started {
+			wg.Add(1)
+			go func(t *Tracker) {
+				defer wg.Done()
+
+				if tm.nextEvent(t) == EventCompleted {
+					if _, err := tm.announce(ctx, t, EventCompleted); err != nil {
 						return
 					}
+				}
+				tm.announce(ctx, t, EventStopped)
+			}(t)
+		}
+		waitTimeout(&wg, stoppedTimeout)
+
+		for _, t := range all {
+			tm.closeConn(t)
+		}
+		// log.Println("[tracker] stopped trackers")
+	})
+}
 
-					for _, p := range response.Peers {
-						if p.IpAddr.IsUnspecified() {
-							continue
-						}
+/*
+announceLoop announces to the first working tracker of its tier, or of all tiers, and periodically re-announces.
+When every tracker has failed, it waits until the earliest one may be retried or a tracker is added.
+It announces again at once when the download completes.
+*/
+func (tm *TrackerManager) announceLoop(tierIndex int) {
+	defer tm.wg.Done()
 
-						select {
-						case peerChan <- p:
-						case <-tm.ctx.Done():
-							return
-						}
-					}
+	tm.mu.Lock()
+	complete := tm.complete
+	tm.mu.Unlock()
+
+	for {
+		var wait time.Duration
 
+		tm.mu.Lock()
+		changed := tm.changed
+		tm.mu.Unlock()
+
+		response, ok := tm.announceTiers(tierIndex)
+		if ok {
+			for _, p := range response.Peers {
+				if p.IpAddr.IsUnspecified() {
+					continue
+				}
+
+				select {
+				case tm.peerChan <- p:
 				case <-tm.ctx.Done():
 					return
 				}
 			}
 
-		}(url)
+			// Only wake up early while there is no working tracker
+			changed = nil
+			wait = announceInterval(response)
+		} else {
+			wait = tm.nextRetry(tierIndex)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-changed:
+			timer.Stop()
+		case <-complete:
+			timer.Stop()
+			complete = nil
+		case <-tm.ctx.Done():
+			timer.Stop()
+			return
+		}
 	}
+}
 
-	return peerChan, nil
+/*
+announceTiers walks the tiers in order and the trackers of each tier in order, skipping trackers that are backing off.
+The first tracker that responds is moved to the front of its tier and its response is returned.
+*/
+func (tm *TrackerManager) announceTiers(tierIndex int) (*AnnounceResponse, bool) {
+	for _, trackers := range tm.loopTiers(tierIndex) {
+		for _, t := range trackers {
+			if tm.ctx.Err() != nil {
+				return nil, false
+			}
+			if !tm.canAnnounce(t) {
+				continue
+			}
+
+			event := tm.nextEvent(t)
+			response, err := tm.announce(tm.ctx, t, event)
+			if tm.ctx.Err() != nil {
+				// Stopped during the announce, which is not the tracker's fault
+				return nil, false
+			}
+			if err != nil {
+				// log.Printf("[tracker] announce failed for %s: %v", t.Url, err)
+				tm.markFailed(t, err)
+				continue
+			}
+
+			tm.markSucceeded(t, event, response)
+			return response, true
+		}
+	}
+
+	return nil, false
 }
 
-// Stop stops the tracker manager and closes all connections.
-func (tm *TrackerManager) StopTracker() {
-	if tm.cancel != nil {
-		tm.cancel()
+// loopTiers returns the trackers of the tiers an announce loop walks, in order.
+func (tm *TrackerManager) loopTiers(tierIndex int) [][]*Tracker {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	tiers := tm.tiers
+	if tierIndex != allTiers {
+		tiers = tm.tiers[tierIndex : tierIndex+1]
+	}
+
+	result := make([][]*Tracker, 0, len(tiers))
+	for _, tier := range tiers {
+		trackers := make([]*Tracker, 0, len(tier))
+		for _, trackerUrl := range tier {
+			trackers = append(trackers, tm.trackers[trackerUrl])
+		}
+		result = append(result, trackers)
 	}
 
-	// log.Println("[tracker] stopped trackers")
+	return result
 }
 
 /*
-ConnectTracker establishes a UDP connection to the tracker.
-It sends a connection packet which includes a BitTorrent UDP magic constant, action, and transaction ID.
-It returns a Connection object containing the trackers connection ID and transaction ID.
+announce sends an announce with the given event to the tracker, reusing its connection if one is already open.
+Cancelling the context aborts the connect and the announce.
 */
-func ConnectTracker(trackerUrl string) (*Connection, error) {
-	udpAddress, err := net.ResolveUDPAddr("udp", trackerUrl)
-	if err != nil {
-		return nil, err
+func (tm *TrackerManager) announce(ctx context.Context, t *Tracker, event uint32) (*AnnounceResponse, error) {
+	tm.mu.Lock()
+	conn := t.conn
+	tm.mu.Unlock()
+
+	if conn == nil {
+		var err error
+		conn, err = dialTracker(ctx, t.Url)
+		if err != nil {
+			return nil, err
+		}
+
+		tm.mu.Lock()
+		t.conn = conn
+		tm.mu.Unlock()
 	}
 
-	if udpAddress.IP.String() == "127.0.0.1" {
-		return nil, fmt.Errorf("resolving to localhost is not allowed")
+	stats := tm.announceStats()
+	arq := AnnounceRequest{
+		Key:        tm.key,
+		InfoHash:   tm.infoHash,
+		IpAddr:     0,
+		Port:       config.Config.Port,
+		Uploaded:   stats.Uploaded,
+		Downloaded: stats.Downloaded,
+		Left:       stats.Left,
+		Event:      event,
+		Numwant:    50,
 	}
-
-	conn, err := net.DialUDP("udp", nil, udpAddress)
-	if err != nil {
-		return nil, err
+	if event == EventStopped {
+		arq.Numwant = 0
 	}
 
-	connectionPacket := getConnectionPacket()
-
-	_, err = conn.Write(connectionPacket[:])
-	if err != nil {
-		return nil, err
-	}
+	return conn.AnnounceTracker(ctx, arq, tm.peerId)
+}
 
-	conn.SetDeadline(time.Now().Add(config.Config.TrackerConnectTimeout))
-	buf := make([]byte, 32)
-	_, err = conn.Read(buf)
+// announceStats returns the current statistics of the stats provider, if one is set.
+func (tm *TrackerManager) announceStats() AnnounceStats {
+	tm.mu.Lock()
+	stats := tm.stats
+	tm.mu.Unlock()
 
-	conn.SetDeadline(time.Time{})
-	if err != nil {
-		return nil, err
+	if stats == nil {
+		return AnnounceStats{Left: math.MaxInt64}
 	}
+	return stats.AnnounceStats()
+}
 
-	action := binary.BigEndian.Uint32(buf)
-	transactionId := binary.BigEndian.Uint32(buf[4:])
-	connectionId := binary.BigEndian.Uint64(buf[8:])
-
-	if action == 3 {
-		return nil, fmt.Errorf("tracker returned error")
+/*
+nextEvent returns the event to send with the next announce to the tracker.
+The first successful announce is started, and completed is sent once when nothing is left to download.
+*/
+func (tm *TrackerManager) nextEvent(t *Tracker) uint32 {
+	tm.mu.Lock()
+	started := t.started
+	completed := t.completed
+	tm.mu.Unlock()
+
+	if !started {
+		return EventStarted
+	}
+	if !completed && tm.announceStats().Left == 0 {
+		return EventCompleted
 	}
 
-	// log.Printf("Recieved %v bytes from tracker connection request\n", n)
-	// log.Printf("Response from server, Action: %d, transactionId: %d, connectionId: %d\n", action, transactionId, connectionId)
+	return EventNone
+}
 
-	return &Connection{
-		conn:          conn,
-		connectionId:  connectionId,
-		transactionId: transactionId,
-	}, nil
+// canAnnounce reports whether the tracker is not waiting out a backoff.
+func (tm *TrackerManager) canAnnounce(t *Tracker) bool {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	return t.Failures == 0 || !time.Now().Before(t.NextAnnounce)
 }
 
-// Close closes the UDP connection to the tracker.
-func (c *Connection) Close() {
-	if c.conn != nil {
-		c.conn.Close()
-		c.conn = nil
+// markFailed drops the tracker's connection and schedules the next attempt with exponential backoff.
+func (tm *TrackerManager) markFailed(t *Tracker, err error) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	if t.conn != nil {
+		t.conn.Close()
+		t.conn = nil
 	}
+
+	t.Failures++
+	t.LastError = err
+	t.LastAnnounce = time.Now()
+	t.NextAnnounce = t.LastAnnounce.Add(retryBackoff(t.Failures))
 }
 
 /*
-AnnounceTracker sends an announce request to the tracker.
-It includes the action, transaction ID, info hash, peer ID, and other parameters.
-It returns an AnnounceResponse object containing the response from the tracker.
+markSucceeded resets the tracker's backoff, records the event it accepted and the response,
+and promotes it to the front of its tier (BEP 12).
 */
-func (c Connection) AnnounceTracker(arq AnnounceRequest, peerId [20]byte) (*AnnounceResponse, error) {
-
-	arq.Action = 1
-	arq.ConnectionId = c.connectionId
-	arq.TransactionId = rand.Uint32()
-	arq.PeerId = peerId
-
-	packet := make([]byte, 98)
-	binary.BigEndian.PutUint64(packet, arq.ConnectionId)       // 8 bytes
-	binary.BigEndian.PutUint32(packet[8:], arq.Action)         // 4 bytes
-	binary.BigEndian.PutUint32(packet[12:], arq.TransactionId) // 4 bytes
-	copy(packet[16:], arq.InfoHash[:])                         // 20 bytes
-	copy(packet[36:], arq.PeerId[:])                           // 20 bytes
-	binary.BigEndian.PutUint64(packet[56:], arq.Downloaded)    // 8 bytes
-	binary.BigEndian.PutUint64(packet[64:], arq.Left)          // 8 bytes
-	binary.BigEndian.PutUint64(packet[72:], arq.Uploaded)      // 8 bytes
-	binary.BigEndian.PutUint32(packet[80:], arq.Event)         // 4 bytes
-	binary.BigEndian.PutUint32(packet[84:], arq.IpAddr)        // 4 bytes
-	binary.BigEndian.PutUint32(packet[88:], arq.Key)           // 4 bytes
-	binary.BigEndian.PutUint32(packet[92:], arq.Numwant)       // 4 bytes
-	binary.BigEndian.PutUint16(packet[96:], arq.Port)          // 2 bytes
-
-	// log.Println("Announce packet:", packet[:])
-
-	n, err := c.conn.Write(packet[:])
-	if err != nil {
-		return nil, err
+func (tm *TrackerManager) markSucceeded(t *Tracker, event uint32, response *AnnounceResponse) {
+	finished := tm.announceStats().Left == 0
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	t.Failures = 0
+	t.LastError = nil
+	t.LastAnnounce = time.Now()
+	t.NextAnnounce = t.LastAnnounce.Add(announceInterval(response))
+	t.PeersReturned = len(response.Peers)
+	t.Seeders = response.Seeders
+	t.Leechers = response.Leechers
+
+	switch event {
+	case EventStarted:
+		t.started = true
+		// A download that is already finished has nothing left to complete
+		t.completed = finished
+	case EventCompleted:
+		t.completed = true
 	}
-	c.conn.SetDeadline(time.Now().Add(config.Config.TrackerConnectTimeout))
 
-	buf := make([]byte, 1024)
-	_, err = c.conn.Read(buf)
-	if err != nil {
-		return nil, err
+	tier := tm.tiers[t.Tier]
+	if i := slices.Index(tier, t.Url); i > 0 {
+		copy(tier[1:i+1], tier[:i])
+		tier[0] = t.Url
 	}
+}
 
-	// log.Printf("Recieved %v bytes from announce request\n ", n)
+// nextRetry returns how long to wait until the first tracker of the loop's tiers may be retried.
+func (tm *TrackerManager) nextRetry(tierIndex int) time.Duration {
+	wait := config.Config.TrackerMaxBackoff
 
-	var a AnnounceResponse
-	a.decodeAnnounceResponse(buf, n)
+	for _, trackers := range tm.loopTiers(tierIndex) {
+		for _, t := range trackers {
+			tm.mu.Lock()
+			failures, retryAt := t.Failures, t.NextAnnounce
+			tm.mu.Unlock()
 
-	if a.Action == 3 {
-		return nil, fmt.Errorf("tracker error on announce")
+			if failures == 0 {
+				return config.Config.TrackerMinBackoff
+			}
+			wait = min(wait, time.Until(retryAt))
+		}
 	}
 
-	return &a, nil
+	return max(wait, config.Config.TrackerMinBackoff)
 }
 
-// decodeAnnounceResponse decodes the response from the announce request.and returns an AnnounceResponse object.
-func (a *AnnounceResponse) decodeAnnounceResponse(buf []byte, n int) {
-	peersCount := (n - 20) / 6
-	peers := make([]peer.Peer, peersCount)
+// closeConn closes the open connection of the tracker, if any.
+func (tm *TrackerManager) closeConn(t *Tracker) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
 
-	a.Action = binary.BigEndian.Uint32(buf[0:])
-	a.TransactionId = binary.BigEndian.Uint32(buf[4:])
-	a.Interval = binary.BigEndian.Uint32(buf[8:])
-	a.Leechers = binary.BigEndian.Uint32(buf[12:])
-	a.Seeders = binary.BigEndian.Uint32(buf[16:])
-	a.Peers = peers
+	if t.conn != nil {
+		t.conn.Close()
+		t.conn = nil
+	}
+}
+
+// announceInterval returns how long to wait before re-announcing, honouring the tracker's min interval.
+func announceInterval(response *AnnounceResponse) time.Duration {
+	interval := response.Interval
+	if interval <= 0 {
+		interval = config.Config.DefaultTrackerInterval
+	}
+	if interval < response.MinInterval {
+		interval = response.MinInterval
+	}
 
-	for i := range peersCount {
-		offset := i * 6
+	return time.Duration(interval) * time.Second
+}
 
-		ip := make(net.IP, 4)
-		copy(ip, buf[20+offset : 20+offset+4])
-		a.Peers[i].IpAddr = ip
-		a.Peers[i].Port = binary.BigEndian.Uint16(buf[24+offset:])
+// retryBackoff doubles the delay after every consecutive failure, bounded by the configured maximum.
+func retryBackoff(failures int) time.Duration {
+	backoff := config.Config.TrackerMinBackoff
+	for i := 1; i < failures && backoff < config.Config.TrackerMaxBackoff; i++ {
+		backoff *= 2
 	}
+
+	return min(backoff, config.Config.TrackerMaxBackoff)
 }
 
-type ConnPacket [16]byte
+// dialTracker picks the UDP or HTTP tracker client based on the scheme of the announce URL.
+func dialTracker(ctx context.Context, trackerUrl string) (announcer, error) {
+	parsed, err := url.Parse(trackerUrl)
+	if err != nil {
+		return nil, err
+	}
 
-// getConnectionPacket creates a connection packet for the BitTorrent protocol.
-func getConnectionPacket() ConnPacket {
-	var cp ConnPacket
+	switch parsed.Scheme {
+	case "udp":
+		conn, err := ConnectTracker(ctx, parsed.Host)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
 
-	magicConstant := uint64(0x41727101980)
-	action := uint32(0)
-	transactionId := rand.Uint32()
+	case "http", "https":
+		return NewHTTPTracker(trackerUrl), nil
 
-	binary.BigEndian.PutUint64(cp[0:8], magicConstant)
-	binary.BigEndian.PutUint32(cp[8:12], action)
-	binary.BigEndian.PutUint32(cp[12:16], transactionId)
+	default:
+		return nil, fmt.Errorf("unsupported tracker scheme %q", parsed.Scheme)
+	}
+}
 
-	return cp
+// waitTimeout waits for the wait group for at most the timeout, and reports whether it finished.
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
 }
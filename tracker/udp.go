@@ -0,0 +1,343 @@
+package tracker
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/JoelVCrasta/clover/config"
+	"github.com/JoelVCrasta/clover/peer"
+)
+
+const (
+	actionConnect  uint32 = 0
+	actionAnnounce uint32 = 1
+	actionScrape   uint32 = 2
+	actionError    uint32 = 3
+
+	protocolId = uint64(0x41727101980)
+)
+
+// connectionIdTTL is how long a connection ID can be used before it has to be requested again (BEP 15).
+var connectionIdTTL = time.Minute
+
+var (
+	// ErrTrackerTimeout is returned when the tracker did not respond after all retransmissions.
+	ErrTrackerTimeout = errors.New("tracker did not respond")
+
+	// errNoResponse is returned by a single exchange when the tracker did not respond in time.
+	errNoResponse = errors.New("no response")
+)
+
+type Connection struct {
+	conn         *net.UDPConn
+	ipLen        int // the length of the peer addresses of the announces, by the address family of the tracker
+	connectionId uint64
+	connectedAt  time.Time
+	mu           sync.Mutex
+}
+
+/*
+ConnectTracker establishes a UDP connection to the tracker.
+Every IPv4 and IPv6 address the tracker host resolves to is tried in turn until one responds, all within
+a single retransmit schedule, so a dead tracker costs the same however many addresses it has.
+Loopback addresses, including localhost, 127.0.0.1 and ::1, are skipped unless AllowLoopbackTrackers is set.
+It sends a connection packet which includes a BitTorrent UDP magic constant, action, and transaction ID.
+It returns a Connection object containing the trackers connection ID. Cancelling the context aborts the connect.
+*/
+func ConnectTracker(ctx context.Context, trackerUrl string) (*Connection, error) {
+	host, portStr, err := net.SplitHostPort(trackerUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := net.LookupPort("udp", portStr)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+
+	budget, cancel := context.WithTimeout(ctx, connectBudget())
+	defer cancel()
+
+	err = fmt.Errorf("no addresses found for %s", host)
+	for _, ip := range ips {
+		if budget.Err() != nil {
+			break
+		}
+		if ip.IsLoopback() && !config.Config.AllowLoopbackTrackers {
+			err = fmt.Errorf("resolving to localhost is not allowed")
+			continue
+		}
+
+		var conn *Connection
+		conn, err = dialUDPTracker(budget, &net.UDPAddr{IP: ip, Port: port})
+		if err == nil {
+			return conn, nil
+		}
+	}
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if budget.Err() != nil {
+		return nil, ErrTrackerTimeout
+	}
+	return nil, err
+}
+
+// connectBudget returns how long the whole retransmit schedule of a connect lasts.
+func connectBudget() time.Duration {
+	var budget time.Duration
+	for attempt := 0; attempt <= config.Config.TrackerMaxRetransmits; attempt++ {
+		budget += retransmitTimeout(attempt)
+	}
+	return budget
+}
+
+// dialUDPTracker opens the UDP socket to the tracker and obtains a connection ID.
+func dialUDPTracker(ctx context.Context, udpAddress *net.UDPAddr) (*Connection, error) {
+	conn, err := net.DialUDP("udp", nil, udpAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	// Trackers reached over IPv6 answer with 18-byte IPv6 peers (BEP 15)
+	ipLen := net.IPv4len
+	if udpAddress.IP.To4() == nil {
+		ipLen = net.IPv6len
+	}
+
+	c := &Connection{conn: conn, ipLen: ipLen}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.connect(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Close closes the UDP connection to the tracker.
+func (c *Connection) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+/*
+AnnounceTracker sends an announce request to the tracker.
+It includes the action, transaction ID, info hash, peer ID, and other parameters.
+It returns an AnnounceResponse object containing the response from the tracker.
+Cancelling the context interrupts the wait for the response.
+*/
+func (c *Connection) AnnounceTracker(ctx context.Context, arq AnnounceRequest, peerId [20]byte) (*AnnounceResponse, error) {
+	arq.Action = actionAnnounce
+	arq.PeerId = peerId
+
+	body := make([]byte, 82)
+	copy(body[0:], arq.InfoHash[:])                       // 20 bytes
+	copy(body[20:], arq.PeerId[:])                        // 20 bytes
+	binary.BigEndian.PutUint64(body[40:], arq.Downloaded) // 8 bytes
+	binary.BigEndian.PutUint64(body[48:], arq.Left)       // 8 bytes
+	binary.BigEndian.PutUint64(body[56:], arq.Uploaded)   // 8 bytes
+	binary.BigEndian.PutUint32(body[64:], arq.Event)      // 4 bytes
+	binary.BigEndian.PutUint32(body[68:], arq.IpAddr)     // 4 bytes
+	binary.BigEndian.PutUint32(body[72:], arq.Key)        // 4 bytes
+	binary.BigEndian.PutUint32(body[76:], arq.Numwant)    // 4 bytes
+	binary.BigEndian.PutUint16(body[80:], arq.Port)       // 2 bytes
+
+	buf, err := c.request(ctx, actionAnnounce, body, 20)
+	if err != nil {
+		return nil, err
+	}
+
+	var a AnnounceResponse
+	if err := a.decodeAnnounceResponse(buf, c.ipLen); err != nil {
+		return nil, err
+	}
+
+	return &a, nil
+}
+
+/*
+request sends a request with the given action and body to the tracker and returns the validated response.
+A new connection ID is requested first whenever the current one is older than one minute.
+The connect and the request share one retransmit schedule: every packet that is not answered within
+15 * 2^n seconds moves on to the next n, up to TrackerMaxRetransmits.
+*/
+func (c *Connection) request(ctx context.Context, action uint32, body []byte, minLength int) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		return nil, fmt.Errorf("connection closed")
+	}
+
+	for attempt := 0; attempt <= config.Config.TrackerMaxRetransmits; attempt++ {
+		if time.Since(c.connectedAt) >= connectionIdTTL {
+			err := c.requestConnectionId(ctx, retransmitTimeout(attempt))
+			if errors.Is(err, errNoResponse) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		transactionId := rand.Uint32()
+
+		packet := make([]byte, 16+len(body))
+		binary.BigEndian.PutUint64(packet, c.connectionId)     // 8 bytes
+		binary.BigEndian.PutUint32(packet[8:], action)         // 4 bytes
+		binary.BigEndian.PutUint32(packet[12:], transactionId) // 4 bytes
+		copy(packet[16:], body)
+
+		buf, err := c.exchange(ctx, packet, action, transactionId, minLength, retransmitTimeout(attempt))
+		if errors.Is(err, errNoResponse) {
+			continue
+		}
+		return buf, err
+	}
+
+	return nil, ErrTrackerTimeout
+}
+
+// connect requests a new connection ID from the tracker, retransmitting the connect packet if needed.
+func (c *Connection) connect(ctx context.Context) error {
+	for attempt := 0; attempt <= config.Config.TrackerMaxRetransmits; attempt++ {
+		err := c.requestConnectionId(ctx, retransmitTimeout(attempt))
+		if errors.Is(err, errNoResponse) {
+			continue
+		}
+		return err
+	}
+
+	return ErrTrackerTimeout
+}
+
+// requestConnectionId sends a single connect packet and stores the connection ID of the response.
+func (c *Connection) requestConnectionId(ctx context.Context, timeout time.Duration) error {
+	packet := getConnectionPacket()
+	transactionId := binary.BigEndian.Uint32(packet[12:16])
+
+	buf, err := c.exchange(ctx, packet[:], actionConnect, transactionId, 16, timeout)
+	if err != nil {
+		return err
+	}
+
+	c.connectionId = binary.BigEndian.Uint64(buf[8:])
+	c.connectedAt = time.Now()
+	return nil
+}
+
+/*
+exchange writes a single packet and waits for the matching response until the timeout runs out.
+Responses with an unknown transaction ID or that are too short to be valid are ignored.
+An error response (action 3) is returned as a TrackerError, and the context error once it is cancelled.
+*/
+func (c *Connection) exchange(ctx context.Context, packet []byte, action, transactionId uint32, minLength int, timeout time.Duration) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if _, err := c.conn.Write(packet); err != nil {
+		return nil, err
+	}
+
+	conn := c.conn
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	// Cancelling the context moves the deadline to the past, which ends the read at once
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	buf := make([]byte, 2048)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				return nil, errNoResponse
+			}
+			return nil, err
+		}
+
+		if n < 8 || binary.BigEndian.Uint32(buf[4:]) != transactionId {
+			continue
+		}
+
+		switch responseAction := binary.BigEndian.Uint32(buf); responseAction {
+		case actionError:
+			return nil, &TrackerError{Message: string(buf[8:n])}
+
+		case action:
+			if n < minLength {
+				return nil, fmt.Errorf("tracker response too short: %d bytes", n)
+			}
+			return append([]byte(nil), buf[:n]...), nil
+
+		default:
+			return nil, fmt.Errorf("unexpected action %d in tracker response", responseAction)
+		}
+	}
+}
+
+// retransmitTimeout returns the BEP 15 timeout of 15 * 2^n seconds for the nth attempt.
+func retransmitTimeout(attempt int) time.Duration {
+	return config.Config.TrackerConnectTimeout << attempt
+}
+
+// decodeAnnounceResponse decodes the response from the announce request, with peer addresses of ipLen bytes.
+func (a *AnnounceResponse) decodeAnnounceResponse(buf []byte, ipLen int) error {
+	if len(buf) < 20 {
+		return fmt.Errorf("invalid announce response length %d", len(buf))
+	}
+
+	peers, err := peer.DecodeCompact(buf[20:], ipLen)
+	if err != nil {
+		return err
+	}
+
+	a.Action = binary.BigEndian.Uint32(buf[0:])
+	a.TransactionId = binary.BigEndian.Uint32(buf[4:])
+	a.Interval = binary.BigEndian.Uint32(buf[8:])
+	a.Leechers = binary.BigEndian.Uint32(buf[12:])
+	a.Seeders = binary.BigEndian.Uint32(buf[16:])
+	a.Peers = peers
+
+	return nil
+}
+
+type ConnPacket [16]byte
+
+// getConnectionPacket creates a connection packet for the BitTorrent protocol.
+func getConnectionPacket() ConnPacket {
+	var cp ConnPacket
+
+	transactionId := rand.Uint32()
+
+	binary.BigEndian.PutUint64(cp[0:8], protocolId)
+	binary.BigEndian.PutUint32(cp[8:12], actionConnect)
+	binary.BigEndian.PutUint32(cp[12:16], transactionId)
+
+	return cp
+}
@@ -0,0 +1,376 @@
+package tracker
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/JoelVCrasta/clover/config"
+	"github.com/JoelVCrasta/clover/peer"
+)
+
+// udpStandIn is a minimal BEP 15 tracker used to exercise the UDP client.
+type udpStandIn struct {
+	conn      *net.UDPConn
+	drop      atomic.Int32  // number of incoming packets to ignore
+	bogus     atomic.Bool   // send a response with the wrong transaction ID first
+	failure   string        // reply to announces with an error
+	ttl       time.Duration // lifetime of the issued connection IDs
+	connects  atomic.Int32
+	announces atomic.Int32
+
+	mu      sync.Mutex
+	issued  map[uint64]time.Time
+	counter uint64
+}
+
+func newUDPStandIn(t *testing.T, failure string) *udpStandIn {
+	t.Helper()
+	return newUDPStandInAt(t, net.IPv4(127, 0, 0, 1), failure)
+}
+
+// newUDPStandInAt starts the stand-in on the given address, IPv6 stand-ins answer with IPv6 peers.
+func newUDPStandInAt(t *testing.T, ip net.IP, failure string) *udpStandIn {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &udpStandIn{
+		conn:    conn,
+		failure: failure,
+		ttl:     connectionIdTTL,
+		issued:  make(map[uint64]time.Time),
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	saved := config.Config
+	config.Config.TrackerConnectTimeout = 20 * time.Millisecond
+	config.Config.TrackerMaxRetransmits = 2
+	config.Config.AllowLoopbackTrackers = true
+	t.Cleanup(func() { config.Config = saved })
+
+	go s.serve()
+	return s
+}
+
+func (s *udpStandIn) addr() *net.UDPAddr {
+	return s.conn.LocalAddr().(*net.UDPAddr)
+}
+
+func (s *udpStandIn) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if n < 16 {
+			continue
+		}
+		if s.drop.Load() > 0 {
+			s.drop.Add(-1)
+			continue
+		}
+
+		connectionId := binary.BigEndian.Uint64(buf)
+		action := binary.BigEndian.Uint32(buf[8:])
+		transactionId := binary.BigEndian.Uint32(buf[12:])
+
+		if s.bogus.CompareAndSwap(true, false) {
+			s.conn.WriteToUDP(s.packet(action, transactionId+1, nil), addr)
+		}
+
+		switch action {
+		case actionConnect:
+			s.connects.Add(1)
+			s.mu.Lock()
+			s.counter++
+			id := s.counter
+			s.issued[id] = time.Now()
+			s.mu.Unlock()
+
+			body := make([]byte, 8)
+			binary.BigEndian.PutUint64(body, id)
+			s.conn.WriteToUDP(s.packet(actionConnect, transactionId, body), addr)
+
+		case actionAnnounce:
+			s.announces.Add(1)
+			s.mu.Lock()
+			issuedAt, ok := s.issued[connectionId]
+			s.mu.Unlock()
+
+			if !ok || time.Since(issuedAt) > s.ttl {
+				s.conn.WriteToUDP(s.packet(actionError, transactionId, []byte("connection id expired")), addr)
+				continue
+			}
+			if s.failure != "" {
+				s.conn.WriteToUDP(s.packet(actionError, transactionId, []byte(s.failure)), addr)
+				continue
+			}
+
+			body := make([]byte, 12)
+			binary.BigEndian.PutUint32(body, 1800)
+			binary.BigEndian.PutUint32(body[4:], 1)
+			binary.BigEndian.PutUint32(body[8:], 2)
+
+			if addr.IP.To4() == nil {
+				body = append(body, peer.NewPeer(net.ParseIP("2001:db8::1"), 6881).EncodeCompact()...)
+			} else {
+				body = append(body, peer.NewPeer(net.IPv4(10, 0, 0, 1), 6881).EncodeCompact()...)
+			}
+			s.conn.WriteToUDP(s.packet(actionAnnounce, transactionId, body), addr)
+
+		case actionScrape:
+			// Every torrent has as many seeders as the first byte of its info hash
+			var body []byte
+			for i := 16; i+20 <= n; i += 20 {
+				entry := make([]byte, 12)
+				binary.BigEndian.PutUint32(entry, uint32(buf[i]))
+				binary.BigEndian.PutUint32(entry[4:], 7)
+				binary.BigEndian.PutUint32(entry[8:], 3)
+				body = append(body, entry...)
+			}
+			s.conn.WriteToUDP(s.packet(actionScrape, transactionId, body), addr)
+		}
+	}
+}
+
+func (s *udpStandIn) packet(action, transactionId uint32, body []byte) []byte {
+	packet := make([]byte, 8+len(body))
+	binary.BigEndian.PutUint32(packet, action)
+	binary.BigEndian.PutUint32(packet[4:], transactionId)
+	copy(packet[8:], body)
+	return packet
+}
+
+func announceTestRequest() AnnounceRequest {
+	return AnnounceRequest{InfoHash: [20]byte{1}, Port: 6881, Numwant: 50}
+}
+
+func TestUDPAnnounce(t *testing.T) {
+	s := newUDPStandIn(t, "")
+
+	conn, err := dialUDPTracker(context.Background(), s.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	res, err := conn.AnnounceTracker(context.Background(), announceTestRequest(), [20]byte{2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Interval != 1800 || res.Leechers != 1 || res.Seeders != 2 {
+		t.Errorf("unexpected response %+v", res)
+	}
+	if len(res.Peers) != 1 || res.Peers[0].String() != "10.0.0.1:6881" {
+		t.Errorf("unexpected peers %v", res.Peers)
+	}
+}
+
+func TestUDPPacketLoss(t *testing.T) {
+	s := newUDPStandIn(t, "")
+
+	s.drop.Store(1)
+	conn, err := dialUDPTracker(context.Background(), s.addr())
+	if err != nil {
+		t.Fatalf("connect was not retransmitted: %v", err)
+	}
+	defer conn.Close()
+
+	s.drop.Store(2)
+	if _, err := conn.AnnounceTracker(context.Background(), announceTestRequest(), [20]byte{2}); err != nil {
+		t.Fatalf("announce was not retransmitted: %v", err)
+	}
+
+	if s.announces.Load() != 1 {
+		t.Errorf("expected 1 answered announce, got %d", s.announces.Load())
+	}
+}
+
+func TestUDPTimeout(t *testing.T) {
+	s := newUDPStandIn(t, "")
+
+	s.drop.Store(1 << 20)
+	_, err := dialUDPTracker(context.Background(), s.addr())
+	if !errors.Is(err, ErrTrackerTimeout) {
+		t.Fatalf("expected ErrTrackerTimeout, got %v", err)
+	}
+}
+
+func TestUDPCancel(t *testing.T) {
+	s := newUDPStandIn(t, "")
+
+	conn, err := dialUDPTracker(context.Background(), s.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The tracker stops answering and the timeout is long, only the context ends the wait
+	config.Config.TrackerConnectTimeout = time.Minute
+	s.drop.Store(1 << 20)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = conn.AnnounceTracker(ctx, announceTestRequest(), [20]byte{2})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the context error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("announce took %s after the context was done", elapsed)
+	}
+}
+
+func TestConnectTrackerLoopbackIPv6(t *testing.T) {
+	s := newUDPStandInAt(t, net.IPv6loopback, "")
+
+	conn, err := ConnectTracker(context.Background(), s.addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.AnnounceTracker(context.Background(), announceTestRequest(), [20]byte{2}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnectTrackerCancel(t *testing.T) {
+	s := newUDPStandIn(t, "")
+	config.Config.TrackerConnectTimeout = time.Minute
+	s.drop.Store(1 << 20)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := ConnectTracker(ctx, s.addr().String()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the context error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("connect took %s after the context was done", elapsed)
+	}
+}
+
+func TestUDPConnectionIdExpiry(t *testing.T) {
+	savedTTL := connectionIdTTL
+	connectionIdTTL = 100 * time.Millisecond
+	t.Cleanup(func() { connectionIdTTL = savedTTL })
+
+	s := newUDPStandIn(t, "")
+
+	conn, err := dialUDPTracker(context.Background(), s.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.AnnounceTracker(context.Background(), announceTestRequest(), [20]byte{2}); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	if _, err := conn.AnnounceTracker(context.Background(), announceTestRequest(), [20]byte{2}); err != nil {
+		t.Fatalf("announce with an expired connection id failed: %v", err)
+	}
+	if s.connects.Load() != 2 {
+		t.Errorf("expected 2 connects, got %d", s.connects.Load())
+	}
+}
+
+func TestUDPTransactionMismatch(t *testing.T) {
+	s := newUDPStandIn(t, "")
+
+	conn, err := dialUDPTracker(context.Background(), s.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s.bogus.Store(true)
+	if _, err := conn.AnnounceTracker(context.Background(), announceTestRequest(), [20]byte{2}); err != nil {
+		t.Fatalf("response with a foreign transaction id was not ignored: %v", err)
+	}
+}
+
+func TestUDPTrackerError(t *testing.T) {
+	s := newUDPStandIn(t, "unregistered torrent")
+
+	conn, err := dialUDPTracker(context.Background(), s.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = conn.AnnounceTracker(context.Background(), announceTestRequest(), [20]byte{2})
+
+	var trackerErr *TrackerError
+	if !errors.As(err, &trackerErr) || trackerErr.Message != "unregistered torrent" {
+		t.Fatalf("expected TrackerError, got %v", err)
+	}
+}
+
+func TestUDPAnnounceIPv6(t *testing.T) {
+	s := newUDPStandInAt(t, net.IPv6loopback, "")
+
+	conn, err := dialUDPTracker(context.Background(), s.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	res, err := conn.AnnounceTracker(context.Background(), announceTestRequest(), [20]byte{2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.Peers) != 1 || res.Peers[0].String() != "[2001:db8::1]:6881" {
+		t.Errorf("unexpected peers %v", res.Peers)
+	}
+}
+
+func TestUDPScrape(t *testing.T) {
+	s := newUDPStandIn(t, "")
+
+	conn, err := dialUDPTracker(context.Background(), s.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	infoHashes := make([][20]byte, MaxScrapeHashes)
+	for i := range infoHashes {
+		infoHashes[i][0] = byte(i)
+	}
+
+	res, err := conn.Scrape(context.Background(), infoHashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.Results) != MaxScrapeHashes {
+		t.Fatalf("expected %d results, got %d", MaxScrapeHashes, len(res.Results))
+	}
+	for i, result := range res.Results {
+		if result.InfoHash != infoHashes[i] || result.Seeders != uint32(i) || result.Completed != 7 || result.Leechers != 3 {
+			t.Errorf("unexpected result %d: %+v", i, result)
+		}
+	}
+
+	if _, err := conn.Scrape(context.Background(), make([][20]byte, MaxScrapeHashes+1)); err == nil {
+		t.Error("expected an error for too many info hashes")
+	}
+}